@@ -6,17 +6,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"time"
 
 	"github.com/r3labs/diff/v3"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/async"
 	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/internal/cliutil"
 	"github.com/alanbriolat/video-archiver/internal/session"
 	_ "github.com/alanbriolat/video-archiver/providers"
+	"github.com/alanbriolat/video-archiver/ratelimit"
 )
 
 func main() {
@@ -33,21 +36,43 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	// Providers added by flags only apply to this run, so they go in a copy of the default registry
+	registry := video_archiver.DefaultProviderRegistry.Clone()
+
 	app := &cli.App{
 		Name:  "download-video",
 		Usage: "download a single video",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:  "target",
-				Value: ".",
-				Usage: "save downloaded video to `DIR`",
+		Flags: append(cliutil.Flags(),
+			&cli.BoolFlag{
+				Name:  "resolve",
+				Usage: "follow redirects and canonical links to find where each URL really points before matching it",
 			},
-		},
+		),
 		Action: func(c *cli.Context) error {
 			target := c.String("target")
-			err := download(ctx, c.Args().Slice(), target)
+			if err := cliutil.RegisterProviders(c, registry); err != nil {
+				return err
+			}
+			rateLimit, err := ratelimit.ParseRate(c.String("limit-rate"))
+			if err != nil {
+				return err
+			}
+			httpConfig, err := cliutil.ParseHTTPConfig(c)
+			if err != nil {
+				return err
+			}
+			options, err := cliutil.ParseOptions(c)
+			if err != nil {
+				return err
+			}
+			resolveHops := 0
+			if c.Bool("resolve") {
+				resolveHops = video_archiver.DefaultMaxHops
+			}
+			err = download(ctx, registry, c.Args().Slice(), target, rateLimit, httpConfig, options, c.Bool("sidecars"), resolveHops)
 			return err
 		},
+		Commands:        cliutil.Commands(registry),
 		HideHelpCommand: true,
 	}
 
@@ -67,54 +92,76 @@ func main() {
 	}
 }
 
-func download(ctx context.Context, sources []string, target string) error {
+func download(ctx context.Context, registry *video_archiver.ProviderRegistry, sources []string, target string, rateLimit int64, httpConfig video_archiver.HTTPConfig, options video_archiver.Options, sidecars bool, resolveHops int) error {
 	logger := zap.S()
 	logger.Infof("Downloading into %s from %s", target, sources)
 
 	cfg := session.DefaultConfig
+	cfg.ProviderRegistry = registry
 	cfg.DefaultSavePath = target
+	cfg.RateLimit = rateLimit
+	cfg.HTTP = httpConfig
+	cfg.Options = options
+	cfg.Sidecars = sidecars
+	cfg.MaxResolveHops = resolveHops
 	ses, err := session.New(cfg, ctx)
 	if err != nil {
 		return err
 	}
 	defer ses.Close()
 
-	var downloads sync.WaitGroup
+	events := generic.Unwrap(ses.Subscribe())
+	defer events.Close()
+	// Downloads that haven't stopped yet, including any children added by a collection (e.g. a playlist)
+	pending := make(map[session.DownloadID]bool)
 	for _, source := range sources {
 		dl, err := ses.AddDownload(source, nil)
 		if err != nil {
 			logger.Errorf("failed to add download for %#v: %v", source, err)
 			continue
 		}
-		downloads.Add(1)
-		go func() {
-			defer downloads.Done()
-			initialState := generic.Unwrap(dl.State())
-			logger := logger.Named(fmt.Sprintf("client/%v", initialState.ID))
-			events := generic.Unwrap(dl.Subscribe())
-			dl.Start()
-			for event := range events.Receive() {
-				logger.Debugf("event %T: %v", event, event.Download())
-				switch e := event.(type) {
-				case session.DownloadUpdated:
-					changes, err := diff.Diff(e.OldState, e.NewState)
-					if err != nil {
-						logger.Errorf("failed to diff old and new download state: %v", err)
-					} else {
-						for _, change := range changes {
-							logger.Debugf("%v: %#v -> %#v", change.Path, change.From, change.To)
-						}
-					}
-				case session.DownloadStopped:
-					state := generic.Unwrap(e.Download().State())
+		pending[dl.ID()] = true
+		dl.Start()
+	}
+
+	for len(pending) > 0 {
+		event, ok := <-events.Receive()
+		if !ok {
+			break
+		}
+		logger := logger.Named(fmt.Sprintf("client/%v", event.Download().ID()))
+		logger.Debugf("event %T: %v", event, event.Download())
+		switch e := event.(type) {
+		case session.DownloadAdded:
+			// Children are started by the session when their parent is started
+			state := generic.Unwrap(e.Download().State())
+			if pending[state.ParentID] {
+				logger.Infof("Added %v from collection", state.URL)
+				pending[state.ID] = true
+			}
+		case session.DownloadUpdated:
+			changes, err := diff.Diff(e.OldState, e.NewState)
+			if err != nil {
+				logger.Errorf("failed to diff old and new download state: %v", err)
+			} else {
+				for _, change := range changes {
+					logger.Debugf("%v: %#v -> %#v", change.Path, change.From, change.To)
+				}
+			}
+		case session.DownloadStopped:
+			if pending[e.Download().ID()] {
+				state := generic.Unwrap(e.Download().State())
+				if !state.NextRetryAt.IsZero() {
+					// Still pending until the retry either succeeds or fails permanently
+					logger.Infof("Download failed, retrying at %v: %v", state.NextRetryAt.Format(time.RFC3339), state.Error)
+				} else {
 					logger.Infof("Download stopped with status %#v", state.Status)
-					return
+					delete(pending, state.ID)
 				}
 			}
-		}()
+		}
 	}
 
-	downloads.Wait()
 	ses.Close()
 	return nil
 }
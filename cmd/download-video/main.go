@@ -15,7 +15,9 @@ import (
 	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/async"
 	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/internal/cliutil"
 	_ "github.com/alanbriolat/video-archiver/providers"
+	"github.com/alanbriolat/video-archiver/ratelimit"
 )
 
 func main() {
@@ -30,25 +32,48 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	// Providers added by flags only apply to this run, so they go in a copy of the default registry
+	registry := video_archiver.DefaultProviderRegistry.Clone()
+
 	app := &cli.App{
 		Name:  "download-video",
 		Usage: "download a single video",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:  "target",
-				Value: ".",
-				Usage: "save downloaded video to `DIR`",
-			},
-		},
+		Flags: cliutil.Flags(),
 		Action: func(c *cli.Context) error {
 			target := c.String("target")
+			if err := cliutil.RegisterProviders(c, registry); err != nil {
+				return err
+			}
+			rateLimit, err := ratelimit.ParseRate(c.String("limit-rate"))
+			if err != nil {
+				return err
+			}
+			limiter := ratelimit.New(rateLimit)
+			httpConfig, err := cliutil.ParseHTTPConfig(c)
+			if err != nil {
+				return err
+			}
+			client, err := httpConfig.NewClient()
+			if err != nil {
+				return err
+			}
+			options, err := cliutil.ParseOptions(c)
+			if err != nil {
+				return err
+			}
+			if c.Bool("sidecars") {
+				options[video_archiver.OptionSidecars] = "true"
+			}
+			ctx := video_archiver.WithOptions(video_archiver.WithHTTPClient(ctx, client), options)
+			ctx = video_archiver.WithProviderRegistry(ctx, registry)
 			for _, source := range c.Args().Slice() {
-				if err := download(ctx, source, target); err != nil {
+				if err := download(ctx, source, target, limiter, c.Bool("sidecars")); err != nil {
 					return err
 				}
 			}
 			return nil
 		},
+		Commands:        cliutil.Commands(registry),
 		HideHelpCommand: true,
 	}
 
@@ -65,25 +90,43 @@ func main() {
 	}
 }
 
-func download(ctx context.Context, source string, target string) error {
+func download(ctx context.Context, source string, target string, limiter *ratelimit.Limiter, sidecars bool) error {
 	logger := zap.S()
 	logger.Infof("Downloading from %s into %s", source, target)
 
-	match, err := video_archiver.DefaultProviderRegistry.Match(source)
+	match, err := video_archiver.ProviderRegistryFromContext(ctx).Match(source)
 	if err != nil {
 		return fmt.Errorf("match failed: %w", err)
 	}
+	return downloadSource(ctx, match.Source, target, limiter, sidecars)
+}
+
+func downloadSource(ctx context.Context, source video_archiver.Source, target string, limiter *ratelimit.Limiter, sidecars bool) error {
+	logger := zap.S()
 
 	logger.Info("Starting recon...")
-	resolved, err := match.Source.Recon(ctx)
+	resolved, err := source.Recon(ctx)
 	if err != nil {
 		return fmt.Errorf("recon failed: %w", err)
 	}
 
+	if collection, ok := resolved.(video_archiver.CollectionSource); ok {
+		children := collection.Children()
+		logger.Infof("Downloading %d item(s) from %v", len(children), resolved)
+		for _, child := range children {
+			logger.Infof("Downloading from %s", child.URL())
+			if err := downloadSource(ctx, child, target, limiter, sidecars); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	logger.Info("Starting download...")
 	bar := progressbar.DefaultBytes(1, "downloading")
 	downloadBuilder := video_archiver.NewDownloadBuilder()
 	downloadBuilder.WithContext(ctx)
+	downloadBuilder.WithRateLimiter(limiter)
 	downloadBuilder.WithProgressCallback(func(downloaded int, expected int) {
 		if bar.GetMax() != expected {
 			bar.ChangeMax(expected)
@@ -98,6 +141,14 @@ func download(ctx context.Context, source string, target string) error {
 	if err != nil {
 		return fmt.Errorf("download failed: %w", err)
 	}
+	if info, ok := resolved.(video_archiver.InfoSource); ok && sidecars {
+		if err = video_archiver.WriteSidecars(download, info.Info()); err != nil {
+			return fmt.Errorf("failed to write metadata files: %w", err)
+		}
+	}
+	if err = download.Commit(); err != nil {
+		return fmt.Errorf("failed to save download: %w", err)
+	}
 	logger.Info("Download complete!")
 
 	return nil
@@ -6,8 +6,12 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path"
-	"strings"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/alanbriolat/video-archiver/ratelimit"
+	"github.com/alanbriolat/video-archiver/util"
 )
 
 type Download interface {
@@ -23,9 +27,15 @@ type Download interface {
 	// Close cleans up any resources associated with the Download, including deleting its temporary directory.
 	Close() error
 
-	// Context is the cancellable context of this Download.
+	// Commit moves all files created by the Download from its temporary directory to their target paths. Should be
+	// called once ResolvedSource.Download has completed successfully.
+	Commit() error
+
+	// Context is the cancellable context of this Download, which also carries the http.Client to use for requests (see
+	// HTTPClientFromContext).
 	Context() context.Context
 
+	// CreateFile creates the named file in the temporary directory, to be moved to its target path by Commit.
 	CreateFile(filename string) (io.WriteCloser, error)
 
 	// Progress returns the downloaded and expected bytes of the download.
@@ -49,8 +59,9 @@ type Download interface {
 	// SaveURL will make a GET request to the URL and then download the resulting stream like SaveStream.
 	SaveURL(filename string, url string) error
 
-	// TempSaveStream is like SaveStream, but writing to a temporary file.
-	//TempSaveStream(filename string, stream io.Reader) error
+	// TempSaveStream is like SaveStream, but writing to a temporary file (named according to pattern, as for
+	// os.CreateTemp) which will not be moved by Commit. Returns the path of the temporary file.
+	TempSaveStream(pattern string, stream io.Reader) (string, error)
 
 	// Write will ignore the data but will send the byte count to AddDownloadedBytes. Allows progress tracking using
 	// io.MultiWriter (but ensure the Download is the last writer to avoid counting failed writes).
@@ -62,22 +73,39 @@ type download struct {
 	cancel           context.CancelFunc
 	progressCallback func(int, int)
 	targetPrefix     string
-	//tempDir          string
-	expectedBytes   int
-	downloadedBytes int
+	tempDir          string
+	keepTempDir      bool
+	progressMu       sync.Mutex
+	expectedBytes    int
+	downloadedBytes  int
+	mu               sync.Mutex
+	files            []string
+	committed        bool
+	resume           map[string]ResumeInfo
+	resumeCallback   func([]ResumeInfo)
+	fileCallback     func(string)
+	rateLimiters     []*ratelimit.Limiter
+	httpClient       *http.Client
 }
 
 func (d *download) AddDownloadedBytes(n int) {
-	d.downloadedBytes += n
-	if d.progressCallback != nil {
-		d.progressCallback(d.Progress())
-	}
+	d.updateProgress(n, 0)
 }
 
 func (d *download) AddExpectedBytes(n int) {
-	d.expectedBytes += n
+	d.updateProgress(0, n)
+}
+
+// updateProgress adds to the progress counters, which may happen from several goroutines at once if a provider is
+// downloading streams in parallel. The progress callback is called with the lock held, so it doesn't need to be
+// thread-safe itself.
+func (d *download) updateProgress(downloaded int, expected int) {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	d.downloadedBytes += downloaded
+	d.expectedBytes += expected
 	if d.progressCallback != nil {
-		d.progressCallback(d.Progress())
+		d.progressCallback(d.downloadedBytes, d.expectedBytes)
 	}
 }
 
@@ -86,9 +114,42 @@ func (d *download) Cancel() {
 }
 
 func (d *download) Close() error {
-	//if err := os.RemoveAll(d.tempDir); err != nil {
-	//	return fmt.Errorf("failed to delete temp dir: %w", err)
-	//}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.keepTempDir && !d.committed {
+		return nil
+	}
+	if err := os.RemoveAll(d.tempDir); err != nil {
+		return fmt.Errorf("failed to delete temp dir: %w", err)
+	}
+	return nil
+}
+
+func (d *download) Commit() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.files) > 0 {
+		filename := d.files[0]
+		tempPath, err := d.tempPath(filename)
+		if err != nil {
+			return err
+		}
+		targetPath, err := d.targetPath(filename)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0775); err != nil {
+			return fmt.Errorf("failed to create target dir: %w", err)
+		}
+		if err := util.MoveFile(tempPath, targetPath); err != nil {
+			return fmt.Errorf("failed to move %v to target path: %w", filename, err)
+		}
+		d.files = d.files[1:]
+		if d.fileCallback != nil {
+			d.fileCallback(targetPath)
+		}
+	}
+	d.committed = true
 	return nil
 }
 
@@ -97,15 +158,12 @@ func (d *download) Context() context.Context {
 }
 
 func (d *download) CreateFile(filename string) (io.WriteCloser, error) {
-	targetPath := d.targetPath(filename)
-	targetDir := path.Dir(targetPath)
-	if err := os.MkdirAll(targetDir, 0775); err != nil {
-		return nil, err
-	}
-	return os.Create(d.targetPath(filename))
+	return d.createFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 }
 
 func (d *download) Progress() (int, int) {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
 	return d.downloadedBytes, d.expectedBytes
 }
 
@@ -114,21 +172,26 @@ func (d *download) AppendHTTPRequest(w io.Writer, req *http.Request) error {
 		return fmt.Errorf("nil request")
 	}
 	req = req.WithContext(d.Context())
-	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := d.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("download failed: %w", err)
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("404 not found")
-	}
 	defer resp.Body.Close()
-	d.AddExpectedBytes(int(resp.ContentLength))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && req.Header.Get("Range") != "":
+		// Caller asked for part of the file, so this is what they expected
+	default:
+		return NewHTTPError(resp)
+	}
+	if resp.ContentLength >= 0 {
+		d.AddExpectedBytes(int(resp.ContentLength))
+	}
 	return d.AppendStream(w, resp.Body)
 }
 
 func (d *download) AppendStream(w io.Writer, stream io.Reader) error {
-	r := &readerContext{ctx: d.ctx, r: stream}
+	r := &readerContext{ctx: d.ctx, r: ratelimit.NewReader(d.ctx, stream, d.rateLimiters...)}
 	_, err := io.Copy(io.MultiWriter(w, d), r)
 	if err != nil {
 		return fmt.Errorf("failed to write stream: %w", err)
@@ -145,12 +208,15 @@ func (d *download) AppendURL(w io.Writer, url string) error {
 }
 
 func (d *download) SaveHTTPRequest(filename string, req *http.Request) error {
-	f, err := d.CreateFile(filename)
+	if req == nil {
+		return fmt.Errorf("nil request")
+	}
+	f, offset, err := d.openResumable(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open target file: %w", err)
 	}
 	defer f.Close()
-	return d.AppendHTTPRequest(f, req)
+	return d.resumeHTTPRequest(f, filename, offset, req)
 }
 
 func (d *download) SaveStream(filename string, stream io.Reader) error {
@@ -163,19 +229,21 @@ func (d *download) SaveStream(filename string, stream io.Reader) error {
 }
 
 func (d *download) SaveURL(filename string, url string) error {
-	f, err := d.CreateFile(filename)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("failed to open target file: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
-	defer f.Close()
-	return d.AppendURL(f, url)
+	return d.SaveHTTPRequest(filename, req)
 }
 
-//func (d *download) TempSaveStream(pattern string, stream io.Reader) (string, error) {
-//	// TODO: sanitise filename
-//	//TODO implement me
-//	panic("implement me")
-//}
+func (d *download) TempSaveStream(pattern string, stream io.Reader) (string, error) {
+	f, err := os.CreateTemp(d.tempDir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer f.Close()
+	return f.Name(), d.AppendStream(f, stream)
+}
 
 func (d *download) Write(p []byte) (n int, err error) {
 	n = len(p)
@@ -183,54 +251,260 @@ func (d *download) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func (d *download) targetPath(filename string) string {
-	// TODO: sanitise filename
-	targetPathBuilder := strings.Builder{}
-	targetPathBuilder.WriteString(d.targetPrefix)
-	targetPathBuilder.WriteString(filename)
-	return targetPathBuilder.String()
+func (d *download) createFile(filename string, flag int) (*os.File, error) {
+	tempPath, err := d.tempPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(tempPath), 0775); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tempPath, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, existing := range d.files {
+		if existing == filename {
+			return f, nil
+		}
+	}
+	d.files = append(d.files, filename)
+	return f, nil
+}
+
+// openResumable opens the named file for writing. If the file can be resumed, existing content is kept and the offset
+// to resume from is returned, otherwise the file is truncated.
+func (d *download) openResumable(filename string) (*os.File, int64, error) {
+	if info, ok := d.getResumeInfo(filename); !ok || info.ifRange() == "" {
+		f, err := d.createFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+		return f, 0, err
+	}
+	f, err := d.createFile(filename, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, offset, nil
+}
+
+// resumeHTTPRequest executes the http.Request, writing the response to f starting at offset. If offset is non-zero,
+// a Range request is made, falling back to downloading the whole file if the server doesn't honour it.
+func (d *download) resumeHTTPRequest(f *os.File, filename string, offset int64, req *http.Request) error {
+	req = req.Clone(d.Context())
+	if offset > 0 {
+		info, _ := d.getResumeInfo(filename)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", info.ifRange())
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil {
+			return err
+		} else if start != offset {
+			return fmt.Errorf("requested range from %d but got range from %d", offset, start)
+		}
+		d.AddDownloadedBytes(int(offset))
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Either we already have the whole file, or the file has changed and we should start again
+		if _, size, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && size == offset {
+			d.AddExpectedBytes(int(size))
+			d.AddDownloadedBytes(int(size))
+			d.deleteResumeInfo(filename)
+			return nil
+		}
+		if err := truncateFile(f); err != nil {
+			return err
+		}
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+		return d.resumeHTTPRequest(f, filename, 0, req)
+	case resp.StatusCode == http.StatusOK:
+		// Server ignored the Range request, or the file changed since the partial download, so start again
+		if offset > 0 {
+			if err := truncateFile(f); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	default:
+		return NewHTTPError(resp)
+	}
+
+	if resp.ContentLength >= 0 {
+		d.AddExpectedBytes(int(offset + resp.ContentLength))
+	}
+	d.setResumeInfo(ResumeInfo{
+		Filename:     filename,
+		Offset:       offset,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err := d.AppendStream(f, resp.Body); err != nil {
+		// Record how far we got, so that the download can continue from there
+		if pos, seekErr := f.Seek(0, io.SeekCurrent); seekErr == nil {
+			d.setResumeInfo(ResumeInfo{
+				Filename:     filename,
+				Offset:       pos,
+				ETag:         resp.Header.Get("ETag"),
+				LastModified: resp.Header.Get("Last-Modified"),
+			})
+		}
+		return err
+	}
+	d.deleteResumeInfo(filename)
+	return nil
+}
+
+func (d *download) getResumeInfo(filename string) (ResumeInfo, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info, ok := d.resume[filename]
+	return info, ok
 }
 
-//func (d *download) tempPath(filename string) string {
-//
-//}
+// setResumeInfo records the ResumeInfo for a file, unless the server gave us nothing that could be used to resume it.
+func (d *download) setResumeInfo(info ResumeInfo) {
+	if info.ifRange() == "" {
+		d.deleteResumeInfo(info.Filename)
+		return
+	}
+	d.updateResumeInfo(func(resume map[string]ResumeInfo) {
+		resume[info.Filename] = info
+	})
+}
+
+func (d *download) deleteResumeInfo(filename string) {
+	d.updateResumeInfo(func(resume map[string]ResumeInfo) {
+		delete(resume, filename)
+	})
+}
+
+func (d *download) updateResumeInfo(f func(map[string]ResumeInfo)) {
+	d.mu.Lock()
+	if d.resume == nil {
+		d.resume = make(map[string]ResumeInfo)
+	}
+	f(d.resume)
+	list := make([]ResumeInfo, 0, len(d.resume))
+	for _, info := range d.resume {
+		list = append(list, info)
+	}
+	d.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Filename < list[j].Filename
+	})
+	if d.resumeCallback != nil {
+		d.resumeCallback(list)
+	}
+}
+
+// targetPath sanitises the filename and appends it to the target prefix, which may include the start of a filename as
+// well as a directory.
+func (d *download) targetPath(filename string) (string, error) {
+	dir, prefix := filepath.Split(d.targetPrefix)
+	if dir == "" {
+		dir = "."
+	}
+	return util.ContainedPath(dir, util.SanitizeFilename(prefix+filename))
+}
+
+func (d *download) tempPath(filename string) (string, error) {
+	return util.ContainedPath(d.tempDir, util.SanitizeFilename(filename))
+}
 
 type DownloadBuilder interface {
 	Build() (Download, error)
 	WithContext(ctx context.Context) DownloadBuilder
+	// WithHTTPClient sets the http.Client used for all requests made by the Download, and by providers using
+	// HTTPClientFromContext(Download.Context()). Defaults to HTTPClientFromContext of the WithContext context.
+	WithHTTPClient(client *http.Client) DownloadBuilder
 	WithProgressCallback(f func(downloaded int, expected int)) DownloadBuilder
+	// WithRateLimiter adds a limit to how fast data is downloaded. Limiters can be shared between downloads, and their
+	// rate changed while in use.
+	WithRateLimiter(l *ratelimit.Limiter) DownloadBuilder
+	// WithResumeInfo supplies the state of partially downloaded files, e.g. from a previous run of the same download.
+	WithResumeInfo(info ...ResumeInfo) DownloadBuilder
+	// WithResumeCallback sets a function to receive the latest state of partially downloaded files whenever it changes.
+	WithResumeCallback(f func([]ResumeInfo)) DownloadBuilder
+	// WithFileCallback sets a function to receive the target path of each file as it is moved into place by Commit.
+	WithFileCallback(f func(path string)) DownloadBuilder
 	WithTargetPrefix(prefix string) DownloadBuilder
-	//WithTempPath(path string) DownloadBuilder
-	//WithTempDirPattern(pattern string) DownloadBuilder
+	// WithTempDir sets an exact temporary directory to use, which is created if it doesn't exist. Overrides
+	// WithTempPath and WithTempDirPattern.
+	WithTempDir(dir string) DownloadBuilder
+	// WithTempPath sets the directory in which to create a temporary directory.
+	WithTempPath(path string) DownloadBuilder
+	// WithTempDirPattern sets the pattern used to name the temporary directory (see os.MkdirTemp).
+	WithTempDirPattern(pattern string) DownloadBuilder
+	// WithKeepTempDir, if true, will prevent Close() deleting the temporary directory unless the download was
+	// committed, so that partial files can be resumed later.
+	WithKeepTempDir(keep bool) DownloadBuilder
 }
 
 type downloadBuilder struct {
 	ctx              context.Context
 	progressCallback func(int, int)
 	targetPrefix     string
-	//tempPath         string
-	//tempDirPattern   string
+	resume           []ResumeInfo
+	resumeCallback   func([]ResumeInfo)
+	fileCallback     func(string)
+	rateLimiters     []*ratelimit.Limiter
+	tempDir          string
+	tempPath         string
+	tempDirPattern   string
+	keepTempDir      bool
+	httpClient       *http.Client
 }
 
 func NewDownloadBuilder() DownloadBuilder {
 	return &downloadBuilder{
-		ctx:          context.Background(),
-		targetPrefix: "./",
-		//tempPath:       os.TempDir(),
-		//tempDirPattern: "video-archiver-*",
+		ctx:            context.Background(),
+		targetPrefix:   "./",
+		tempPath:       os.TempDir(),
+		tempDirPattern: "video-archiver-*",
 	}
 }
 
 func (b *downloadBuilder) Build() (Download, error) {
-	//var err error
+	var err error
 	d := download{}
-	d.ctx, d.cancel = context.WithCancel(b.ctx)
+	d.httpClient = b.httpClient
+	if d.httpClient == nil {
+		d.httpClient = HTTPClientFromContext(b.ctx)
+	}
+	d.ctx, d.cancel = context.WithCancel(WithHTTPClient(b.ctx, d.httpClient))
 	d.progressCallback = b.progressCallback
 	d.targetPrefix = b.targetPrefix
-	//d.tempDir, err = os.MkdirTemp(b.tempPath, b.tempDirPattern)
-	//if err != nil {
-	//	return nil, fmt.Errorf("failed to create temp dir: %w", err)
-	//}
+	d.resume = make(map[string]ResumeInfo, len(b.resume))
+	for _, info := range b.resume {
+		d.resume[info.Filename] = info
+	}
+	d.resumeCallback = b.resumeCallback
+	d.fileCallback = b.fileCallback
+	d.rateLimiters = b.rateLimiters
+	d.keepTempDir = b.keepTempDir
+	if b.tempDir != "" {
+		d.tempDir = b.tempDir
+		err = os.MkdirAll(d.tempDir, 0775)
+	} else {
+		d.tempDir, err = os.MkdirTemp(b.tempPath, b.tempDirPattern)
+	}
+	if err != nil {
+		d.cancel()
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
 	return &d, nil
 }
 
@@ -239,22 +513,57 @@ func (b *downloadBuilder) WithContext(ctx context.Context) DownloadBuilder {
 	return b
 }
 
+func (b *downloadBuilder) WithHTTPClient(client *http.Client) DownloadBuilder {
+	b.httpClient = client
+	return b
+}
+
 func (b *downloadBuilder) WithProgressCallback(f func(int, int)) DownloadBuilder {
 	b.progressCallback = f
 	return b
 }
 
+func (b *downloadBuilder) WithRateLimiter(l *ratelimit.Limiter) DownloadBuilder {
+	b.rateLimiters = append(b.rateLimiters, l)
+	return b
+}
+
+func (b *downloadBuilder) WithResumeInfo(info ...ResumeInfo) DownloadBuilder {
+	b.resume = append(b.resume, info...)
+	return b
+}
+
+func (b *downloadBuilder) WithResumeCallback(f func([]ResumeInfo)) DownloadBuilder {
+	b.resumeCallback = f
+	return b
+}
+
+func (b *downloadBuilder) WithFileCallback(f func(string)) DownloadBuilder {
+	b.fileCallback = f
+	return b
+}
+
 func (b *downloadBuilder) WithTargetPrefix(prefix string) DownloadBuilder {
 	b.targetPrefix = prefix
 	return b
 }
 
-//func (b *downloadBuilder) WithTempPath(path string) DownloadBuilder {
-//	b.tempPath = path
-//	return b
-//}
-//
-//func (b *downloadBuilder) WithTempDirPattern(pattern string) DownloadBuilder {
-//	b.tempDirPattern = pattern
-//	return b
-//}
+func (b *downloadBuilder) WithTempDir(dir string) DownloadBuilder {
+	b.tempDir = dir
+	return b
+}
+
+func (b *downloadBuilder) WithTempPath(path string) DownloadBuilder {
+	b.tempPath = path
+	return b
+}
+
+func (b *downloadBuilder) WithTempDirPattern(pattern string) DownloadBuilder {
+	b.tempDirPattern = pattern
+	return b
+}
+
+func (b *downloadBuilder) WithKeepTempDir(keep bool) DownloadBuilder {
+	b.keepTempDir = keep
+	return b
+}
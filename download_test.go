@@ -0,0 +1,135 @@
+package video_archiver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestDownloadResume(t *testing.T) {
+	assert := assert_.New(t)
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	modTime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.URL.Path == "/norange" {
+			_, _ = w.Write(content)
+		} else {
+			http.ServeContent(w, r, "video.mp4", modTime, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	tempDir := t.TempDir()
+	build := func(resume ...ResumeInfo) (Download, *[]ResumeInfo) {
+		var latest []ResumeInfo
+		d := generic.Unwrap(NewDownloadBuilder().
+			WithTargetPrefix(dir + string(os.PathSeparator)).
+			WithTempDir(tempDir).
+			WithKeepTempDir(true).
+			WithResumeInfo(resume...).
+			WithResumeCallback(func(info []ResumeInfo) { latest = info }).
+			Build())
+		return d, &latest
+	}
+
+	// Partial file with matching validator is continued from where it left off
+	generic.Unwrap_(os.WriteFile(filepath.Join(tempDir, "a.mp4"), content[:3000], 0666))
+	d, latest := build(ResumeInfo{Filename: "a.mp4", Offset: 3000, LastModified: modTime.Format(http.TimeFormat)})
+	assert.NoError(d.SaveURL("a.mp4", server.URL+"/video.mp4"))
+	assert.NoError(d.Commit())
+	assert.Equal([]string{"bytes=3000-"}, ranges)
+	assert.Equal(content, generic.Unwrap(os.ReadFile(filepath.Join(dir, "a.mp4"))))
+	downloaded, expected := d.Progress()
+	assert.Equal(len(content), downloaded)
+	assert.Equal(len(content), expected)
+	assert.Empty(*latest)
+
+	// Server that ignores Range gets the whole file again
+	ranges = nil
+	generic.Unwrap_(os.WriteFile(filepath.Join(tempDir, "b.mp4"), content[:3000], 0666))
+	d, _ = build(ResumeInfo{Filename: "b.mp4", Offset: 3000, LastModified: modTime.Format(http.TimeFormat)})
+	assert.NoError(d.SaveURL("b.mp4", server.URL+"/norange"))
+	assert.NoError(d.Commit())
+	assert.Equal([]string{"bytes=3000-"}, ranges)
+	assert.Equal(content, generic.Unwrap(os.ReadFile(filepath.Join(dir, "b.mp4"))))
+
+	// Validator mismatch means If-Range fails, so the whole file is sent
+	ranges = nil
+	generic.Unwrap_(os.WriteFile(filepath.Join(tempDir, "c.mp4"), []byte("garbage"), 0666))
+	d, _ = build(ResumeInfo{Filename: "c.mp4", Offset: 7, LastModified: modTime.Add(-time.Hour).Format(http.TimeFormat)})
+	assert.NoError(d.SaveURL("c.mp4", server.URL+"/video.mp4"))
+	assert.NoError(d.Commit())
+	assert.Equal(content, generic.Unwrap(os.ReadFile(filepath.Join(dir, "c.mp4"))))
+
+	// Without resume info, an existing file is overwritten
+	ranges = nil
+	generic.Unwrap_(os.WriteFile(filepath.Join(tempDir, "d.mp4"), content[:3000], 0666))
+	d, latest = build()
+	assert.NoError(d.SaveURL("d.mp4", server.URL+"/video.mp4"))
+	assert.NoError(d.Commit())
+	assert.Equal([]string{""}, ranges)
+	assert.Equal(content, generic.Unwrap(os.ReadFile(filepath.Join(dir, "d.mp4"))))
+	assert.Empty(*latest)
+
+	assert.NoError(d.Close())
+	assert.NoDirExists(tempDir)
+}
+
+func TestDownloadStaging(t *testing.T) {
+	assert := assert_.New(t)
+	dir := t.TempDir()
+	tempPath := t.TempDir()
+	build := func(keep bool) Download {
+		return generic.Unwrap(NewDownloadBuilder().
+			WithTargetPrefix(dir + string(os.PathSeparator)).
+			WithTempPath(tempPath).
+			WithKeepTempDir(keep).
+			Build())
+	}
+	listTemp := func() []os.DirEntry {
+		return generic.Unwrap(os.ReadDir(tempPath))
+	}
+
+	// Files only appear at the target path after Commit
+	d := build(false)
+	assert.NoError(d.SaveStream("a.mp4", bytes.NewReader([]byte("a"))))
+	scratch := generic.Unwrap(d.TempSaveStream("scratch-*", bytes.NewReader([]byte("scratch"))))
+	assert.FileExists(scratch)
+	assert.NoFileExists(filepath.Join(dir, "a.mp4"))
+	assert.NoError(d.Commit())
+	assert.FileExists(filepath.Join(dir, "a.mp4"))
+	assert.NoFileExists(filepath.Join(dir, filepath.Base(scratch)))
+	assert.NoError(d.Close())
+	assert.Empty(listTemp())
+
+	// Failed download leaves nothing behind
+	d = build(false)
+	assert.NoError(d.SaveStream("b.mp4", bytes.NewReader([]byte("b"))))
+	assert.NoError(d.Close())
+	assert.NoFileExists(filepath.Join(dir, "b.mp4"))
+	assert.Empty(listTemp())
+
+	// Unless the temp dir should be kept for resuming later
+	d = build(true)
+	assert.NoError(d.SaveStream("c.mp4", bytes.NewReader([]byte("c"))))
+	assert.NoError(d.Close())
+	assert.NoFileExists(filepath.Join(dir, "c.mp4"))
+	assert.Len(listTemp(), 1)
+
+	// Filenames are sanitised and can't escape the target directory
+	d = build(false)
+	assert.NoError(d.SaveStream("../AC/DC.mp4", bytes.NewReader([]byte("d"))))
+	assert.NoError(d.Commit())
+	assert.FileExists(filepath.Join(dir, ".._AC_DC.mp4"))
+}
@@ -0,0 +1,240 @@
+package video_archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A classifiedError knows whether it is worth retrying the operation that caused it.
+type classifiedError interface {
+	error
+	Transient() bool
+}
+
+// A retryAfterError knows how long to wait before retrying, e.g. from a Retry-After header.
+type retryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// A TransientError is a failure that might not happen if the operation is retried later, e.g. a dropped connection or
+// an overloaded server.
+type TransientError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransientError) Transient() bool {
+	return true
+}
+
+func (e *TransientError) RetryAfter() time.Duration {
+	return e.After
+}
+
+// A PermanentError is a failure that will happen again if the operation is retried, e.g. the video doesn't exist.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PermanentError) Transient() bool {
+	return false
+}
+
+// Transient marks err as worth retrying.
+func Transient(err error) error {
+	return TransientAfter(err, 0)
+}
+
+// TransientAfter marks err as worth retrying, but not until after the specified delay.
+func TransientAfter(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err, After: after}
+}
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsTransient reports whether the operation that caused err might succeed if retried. The outermost explicit
+// classification (see Transient and Permanent) wins, otherwise timeouts and connections that were dropped after they
+// were made are considered transient, and everything else is considered permanent. That includes other network errors,
+// e.g. connection refused or a failed TLS handshake, which usually mean the host is wrong or blocked.
+func IsTransient(err error) bool {
+	var classified classifiedError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &classified):
+		return classified.Transient()
+	case errors.Is(err, context.Canceled):
+		// Someone chose to stop, retrying would be rude
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ENETRESET),
+		errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	default:
+		var dnsErr *net.DNSError
+		return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+	}
+}
+
+// RetryAfter returns how long to wait before retrying, if err specifies it.
+func RetryAfter(err error) (time.Duration, bool) {
+	var retryAfter retryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.RetryAfter() > 0 {
+		return retryAfter.RetryAfter(), true
+	}
+	return 0, false
+}
+
+// Response headers that are kept in an HTTPError, because they might help explain it.
+var httpErrorHeaders = []string{
+	"Content-Range",
+	"Content-Type",
+	"Location",
+	"Retry-After",
+	"Server",
+	"WWW-Authenticate",
+}
+
+// Maximum length of response body kept in an HTTPError.
+const httpErrorBodyLength = 512
+
+// An HTTPError is an HTTP response that wasn't the expected successful response.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	// URL of the response, which may differ from the request URL after redirects.
+	URL string
+	// Header contains selected response headers.
+	Header http.Header
+	// Body is the start of the response body, if it was text.
+	Body string
+	// Time the response was received, for interpreting Retry-After.
+	Time time.Time
+}
+
+// NewHTTPError creates an HTTPError from an unexpected response, reading (but not closing) the start of the body.
+func NewHTTPError(resp *http.Response) *HTTPError {
+	e := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     make(http.Header),
+		Time:       time.Now(),
+	}
+	if e.Status == "" {
+		e.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		e.URL = resp.Request.URL.String()
+	}
+	for _, key := range httpErrorHeaders {
+		if values := resp.Header.Values(key); len(values) > 0 {
+			e.Header[key] = values
+		}
+	}
+	if resp.Body != nil && isTextContentType(resp.Header.Get("Content-Type")) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, httpErrorBodyLength))
+		e.Body = strings.ToValidUTF8(string(body), "")
+	}
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString("HTTP ")
+	sb.WriteString(e.Status)
+	if e.URL != "" {
+		// Query strings are often long and meaningless (e.g. signatures), so leave them out
+		sb.WriteString(" from ")
+		sb.WriteString(strings.SplitN(e.URL, "?", 2)[0])
+	}
+	if location := e.Header.Get("Location"); location != "" {
+		sb.WriteString(" (redirect to ")
+		sb.WriteString(location)
+		sb.WriteString(" not followed)")
+	}
+	if body := strings.Join(strings.Fields(e.Body), " "); body != "" {
+		sb.WriteString(": ")
+		sb.WriteString(body)
+	}
+	return sb.String()
+}
+
+// Transient is true for responses that mean "try again later", i.e. timeouts, rate limiting and server errors.
+func (e *HTTPError) Transient() bool {
+	return e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= 500
+}
+
+// RetryAfter returns the remaining delay from the Retry-After header, if there was one.
+func (e *HTTPError) RetryAfter() time.Duration {
+	return parseRetryAfter(e.Header.Get("Retry-After"), e.Time)
+}
+
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml")
+}
+
+// parseRetryAfter interprets a Retry-After header, which is either a number of seconds or an HTTP date. Returns 0 if
+// the header is missing or invalid.
+func parseRetryAfter(s string, now time.Time) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	} else if seconds, err := strconv.Atoi(s); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(s); err == nil && t.After(now) {
+		return t.Sub(now)
+	} else {
+		return 0
+	}
+}
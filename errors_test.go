@@ -0,0 +1,130 @@
+package video_archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestIsTransient(t *testing.T) {
+	assert := assert_.New(t)
+	base := errors.New("something failed")
+
+	assert.False(IsTransient(nil))
+	assert.False(IsTransient(base))
+	assert.True(IsTransient(Transient(base)))
+	assert.False(IsTransient(Permanent(base)))
+	// Outermost classification wins
+	assert.False(IsTransient(Permanent(Transient(base))))
+	assert.True(IsTransient(fmt.Errorf("wrapped: %w", Transient(base))))
+
+	assert.False(IsTransient(fmt.Errorf("stopped: %w", context.Canceled)))
+	assert.True(IsTransient(fmt.Errorf("timeout: %w", context.DeadlineExceeded)))
+	assert.True(IsTransient(fmt.Errorf("read: %w", io.ErrUnexpectedEOF)))
+	assert.True(IsTransient(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+
+	// Network errors depend on what went wrong
+	opError := func(op string, err error) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, err)}
+	}
+	assert.True(IsTransient(opError("read", syscall.ECONNRESET)))
+	assert.True(IsTransient(opError("dial", syscall.ETIMEDOUT)))
+	assert.False(IsTransient(opError("dial", syscall.ECONNREFUSED)))
+	assert.False(IsTransient(opError("dial", syscall.EHOSTUNREACH)))
+	assert.False(IsTransient(&net.OpError{Op: "remote error", Net: "tcp", Err: errors.New("tls: handshake failure")}))
+	assert.True(IsTransient(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}))
+	assert.False(IsTransient(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}))
+
+	after, ok := RetryAfter(TransientAfter(base, time.Minute))
+	assert.True(ok)
+	assert.Equal(time.Minute, after)
+	_, ok = RetryAfter(Transient(base))
+	assert.False(ok)
+}
+
+func TestHTTPError(t *testing.T) {
+	assert := assert_.New(t)
+	response := func(code int, header http.Header) *http.Response {
+		return &http.Response{StatusCode: code, Status: fmt.Sprintf("%d %s", code, http.StatusText(code)), Header: header}
+	}
+
+	assert.False(IsTransient(NewHTTPError(response(404, http.Header{}))))
+	assert.False(IsTransient(NewHTTPError(response(403, http.Header{}))))
+	assert.True(IsTransient(NewHTTPError(response(500, http.Header{}))))
+	assert.True(IsTransient(NewHTTPError(response(502, http.Header{}))))
+
+	err := NewHTTPError(response(429, http.Header{"Retry-After": []string{"120"}}))
+	assert.True(IsTransient(err))
+	after, ok := RetryAfter(err)
+	assert.True(ok)
+	assert.Equal(2*time.Minute, after)
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestDownloadHTTPError(t *testing.T) {
+	assert := assert_.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/forbidden":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Set-Cookie", "secret=1")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Access denied\n" + strings.Repeat("x", 1000)))
+		case "/binary":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("\x00\x01\x02"))
+		case "/partial":
+			w.Header().Set("Content-Range", "bytes 0-0/10")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("x"))
+		}
+	}))
+	defer server.Close()
+	d := generic.Unwrap(NewDownloadBuilder().WithTempPath(t.TempDir()).Build())
+	defer d.Close()
+
+	var httpErr *HTTPError
+	err := d.AppendURL(io.Discard, server.URL+"/forbidden?signature=abc")
+	assert.True(errors.As(fmt.Errorf("wrapped: %w", err), &httpErr))
+	assert.Equal(http.StatusForbidden, httpErr.StatusCode)
+	assert.Equal(server.URL+"/forbidden?signature=abc", httpErr.URL)
+	assert.Equal("", httpErr.Header.Get("Set-Cookie"))
+	assert.Len(httpErr.Body, httpErrorBodyLength)
+	assert.True(strings.HasPrefix(err.Error(), "HTTP 403 Forbidden from "+server.URL+"/forbidden: Access denied x"))
+	assert.False(IsTransient(err))
+
+	err = d.AppendURL(io.Discard, server.URL+"/binary")
+	assert.True(errors.As(err, &httpErr))
+	assert.Equal("", httpErr.Body)
+	assert.Equal("HTTP 500 Internal Server Error from "+server.URL+"/binary", err.Error())
+	assert.True(IsTransient(err))
+
+	// Partial content is only acceptable if it was asked for
+	err = d.AppendURL(io.Discard, server.URL+"/partial")
+	assert.True(errors.As(err, &httpErr))
+	assert.Equal(http.StatusPartialContent, httpErr.StatusCode)
+	req := generic.Unwrap(http.NewRequest("GET", server.URL+"/partial", nil))
+	req.Header.Set("Range", "bytes=0-0")
+	assert.NoError(d.AppendHTTPRequest(io.Discard, req))
+
+	// Redirects that aren't followed are explained
+	redirect := &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Location": []string{"/elsewhere"}}}
+	assert.Equal("HTTP 304 Not Modified (redirect to /elsewhere not followed)", NewHTTPError(redirect).Error())
+}
@@ -34,6 +34,8 @@ type application struct {
 	Window         *gtk.ApplicationWindow `glade:"main_window"`
 	Downloads      downloadManager        `glade:"download_"`
 
+	dlgSupportedSites *supportedSitesDialog
+
 	items    map[string]*session.Download
 	treeRefs map[string]*gtk.TreeRowReference
 }
@@ -74,6 +76,9 @@ func (a *application) onActivate() {
 
 	a.Downloads.onAppActivate(a)
 
+	a.dlgSupportedSites = newSupportedSitesDialog(a)
+	a.RegisterSimpleWindowAction("supported_sites", nil, a.dlgSupportedSites.run)
+
 	a.Window.Show()
 }
 
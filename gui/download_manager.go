@@ -12,6 +12,7 @@ import (
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 
+	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
 	"github.com/alanbriolat/video-archiver/internal/pubsub"
 	"github.com/alanbriolat/video-archiver/internal/session"
@@ -74,7 +75,7 @@ func (m *downloadManager) onAppActivate(app Application) {
 	m.contextActions.AddAction(m.actionOpenPath)
 	m.ContextMenu.InsertActionGroup("popup", m.contextActions)
 
-	m.dlgNew = newDownloadNewDialog()
+	m.dlgNew = newDownloadNewDialog(m.app.ProviderRegistry())
 
 	m.View.Connect("button-press-event", func(treeView *gtk.TreeView, event *gdk.Event) {
 		eventButton := gdk.EventButtonNewFromEvent(event)
@@ -131,7 +132,14 @@ func (m *downloadManager) onActionNew() {
 			v.AddError("url", "Invalid URL: %v", err)
 		}
 		if v.IsOk() {
-			options := session.AddDownloadOptions{SavePath: m.dlgNew.SavePath}
+			options := session.AddDownloadOptions{
+				SavePath:   m.dlgNew.SavePath,
+				CookieFile: m.dlgNew.CookieFile,
+				Sidecars:   m.dlgNew.Sidecars,
+			}
+			if m.dlgNew.Captions != "" {
+				options.Options = video_archiver.Options{video_archiver.OptionCaptions: m.dlgNew.Captions}
+			}
 			_, err := m.app.Session().AddDownload(m.dlgNew.URL, &options)
 			if err != nil {
 				m.dlgNew.showError(err.Error())
@@ -321,7 +329,17 @@ func getDownloadStateDisplayTooltip(ds *session.DownloadState) string {
 
 var downloadTooltipTemplate = template.Must(
 	template.New("tooltip").Funcs(template.FuncMap{"trim": strings.TrimSpace}).Parse(strings.TrimSpace(`
-{{if .Provider}}[{{ .Provider }}] {{end}}{{ .URL }}{{if .Error}}
+{{if .Provider}}[{{ .Provider }}] {{end}}{{ .URL }}{{if and .ResolvedURL (ne .ResolvedURL .URL)}}
+→ {{ .ResolvedURL }}{{end}}{{if .Metadata}}
+{{range $key, $value := .Metadata}}
+{{ $key }}: {{ $value }}{{end}}{{end}}{{if .Outputs}}
+
+Files:{{range .Outputs}}
+{{ . }}{{end}}{{end}}{{if .QueuePosition}}
+
+Queue position: {{ .QueuePosition }}{{end}}{{if .Error}}
+
+{{ trim .Error }}{{end}}{{if not .NextRetryAt.IsZero}}
 
-{{ trim .Error }}{{end}}
+Retrying at {{ .NextRetryAt.Local.Format "15:04:05" }} (attempt {{ .Attempts }} failed){{end}}
 `)))
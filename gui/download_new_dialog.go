@@ -1,31 +1,63 @@
 package gui
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 
+	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
 )
 
+// How long (in milliseconds) the URL must stop changing for before explaining which providers match it, so that
+// providers aren't tried for every keystroke.
+const explainDelay = 300
+
 type downloadNewDialog struct {
-	Dialog         *gtk.Dialog            `glade:"dialog"`
-	UrlWidget      *gtk.Entry             `glade:"url_entry"`
-	SavePathWidget *gtk.FileChooserButton `glade:"path_chooser"`
-	URL            string
-	SavePath       string
+	Dialog           *gtk.Dialog            `glade:"dialog"`
+	UrlWidget        *gtk.Entry             `glade:"url_entry"`
+	SavePathWidget   *gtk.FileChooserButton `glade:"path_chooser"`
+	CookieFileWidget *gtk.FileChooserButton `glade:"cookie_file_chooser"`
+	SidecarsWidget   *gtk.CheckButton       `glade:"sidecars_check"`
+	CaptionsWidget   *gtk.Entry             `glade:"captions_entry"`
+	MatchLabel       *gtk.Label             `glade:"match_label"`
+	URL              string
+	SavePath         string
+	CookieFile       string
+	Sidecars         bool
+	Captions         string
+
+	registry *video_archiver.ProviderRegistry
+	// Incremented for each URL change, so that an explanation for an old URL isn't shown
+	explainSeq int
+	// Waiting for explainDelay before explaining the URL, if not 0
+	explainTimer glib.SourceHandle
 }
 
-func newDownloadNewDialog() *downloadNewDialog {
-	d := &downloadNewDialog{}
+func newDownloadNewDialog(registry *video_archiver.ProviderRegistry) *downloadNewDialog {
+	d := &downloadNewDialog{registry: registry}
 
 	GladeRepository.MustBuild(d, "download_new_dialog.glade")
 	d.UrlWidget.Connect("changed", func() {
 		d.URL = generic.Unwrap(d.UrlWidget.GetText())
 		d.updateOkButton()
+		d.updateMatchLabel()
 	})
 	d.SavePathWidget.Connect("file-set", func() {
 		d.SavePath = d.SavePathWidget.GetFilename()
 		d.updateOkButton()
 	})
+	d.CookieFileWidget.Connect("file-set", func() {
+		d.CookieFile = d.CookieFileWidget.GetFilename()
+	})
+	d.SidecarsWidget.Connect("toggled", func() {
+		d.Sidecars = d.SidecarsWidget.GetActive()
+	})
+	d.CaptionsWidget.Connect("changed", func() {
+		d.Captions = generic.Unwrap(d.CaptionsWidget.GetText())
+	})
 
 	return d
 }
@@ -33,8 +65,12 @@ func newDownloadNewDialog() *downloadNewDialog {
 func (d *downloadNewDialog) run() bool {
 	d.UrlWidget.SetText("")
 	d.URL = ""
+	d.updateMatchLabel()
 	d.SavePathWidget.SelectFilename(d.SavePath)
 	d.SavePath = d.SavePathWidget.GetFilename()
+	// Cookies are likely to be for a particular site, so don't carry them over to the next download by accident
+	d.CookieFileWidget.UnselectAll()
+	d.CookieFile = ""
 	d.updateOkButton()
 
 	d.UrlWidget.GrabFocus()
@@ -56,3 +92,55 @@ func (d *downloadNewDialog) updateOkButton() {
 	enabled := d.URL != "" && d.SavePath != ""
 	generic.Unwrap(d.Dialog.GetWidgetForResponse(gtk.RESPONSE_OK)).ToWidget().SetSensitive(enabled)
 }
+
+// updateMatchLabel shows which providers match the URL, once it has stopped changing. Some providers (e.g. scripts and
+// external helpers) can be slow to match, so this happens in the background, and the result is only shown if the URL
+// hasn't changed since.
+func (d *downloadNewDialog) updateMatchLabel() {
+	d.explainSeq++
+	if d.explainTimer != 0 {
+		glib.SourceRemove(d.explainTimer)
+		d.explainTimer = 0
+	}
+	seq, url := d.explainSeq, d.URL
+	if url == "" {
+		d.MatchLabel.SetText("")
+		return
+	} else if err := ValidateURL(url); err != nil {
+		d.MatchLabel.SetText(fmt.Sprintf("Invalid URL: %v", err))
+		return
+	}
+	d.MatchLabel.SetText("Checking providers…")
+	d.explainTimer = glib.TimeoutAdd(explainDelay, func() {
+		d.explainTimer = 0
+		go func() {
+			text := explainMatch(d.registry.Explain(url))
+			glib.IdleAdd(func() {
+				if seq == d.explainSeq && url == d.URL {
+					d.MatchLabel.SetText(text)
+				}
+			})
+		}()
+	})
+}
+
+// explainMatch describes the result of trying each provider in priority order.
+func explainMatch(results []video_archiver.MatchResult) string {
+	lines := make([]string, 0, len(results)+1)
+	used := false
+	for _, r := range results {
+		switch {
+		case r.Matched() && !used:
+			used = true
+			lines = append(lines, fmt.Sprintf("✓ %v (will be used)", r.ProviderName))
+		case r.Matched():
+			lines = append(lines, fmt.Sprintf("✓ %v", r.ProviderName))
+		default:
+			lines = append(lines, fmt.Sprintf("✗ %v: %v", r.ProviderName, strings.TrimSpace(r.Err.Error())))
+		}
+	}
+	if !used {
+		lines = append([]string{"No provider matches this URL"}, lines...)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,7 +2,9 @@ package gui
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 
@@ -12,12 +14,16 @@ import (
 	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/internal/boltdb"
 	"github.com/alanbriolat/video-archiver/internal/session"
+	"github.com/alanbriolat/video-archiver/providers/external"
+	"github.com/alanbriolat/video-archiver/providers/script"
 )
 
 type Env interface {
 	Context() context.Context
 	Logger() *zap.Logger
 	ProviderRegistry() *video_archiver.ProviderRegistry
+	// SaveProviderSettings saves which providers are enabled, and their priorities, to be restored next time.
+	SaveProviderSettings() error
 	DB() boltdb.Database
 	Session() *session.Session
 	Close()
@@ -28,6 +34,8 @@ type env struct {
 	ctx              context.Context
 	log              *zap.Logger
 	providerRegistry *video_archiver.ProviderRegistry
+	// As last loaded or saved, including those for providers that aren't registered
+	providerSettings video_archiver.ProviderSettings
 	db               boltdb.Database
 	session          *session.Session
 }
@@ -44,6 +52,25 @@ func (e *env) ProviderRegistry() *video_archiver.ProviderRegistry {
 	return e.providerRegistry
 }
 
+func (e *env) providerSettingsPath() string {
+	return filepath.Join(e.configDir, "provider_settings.json")
+}
+
+func (e *env) SaveProviderSettings() error {
+	settings := e.providerRegistry.UpdateSettings(e.providerSettings)
+	if len(settings) == 0 {
+		// Don't create the file just to say nothing has changed
+		if _, err := os.Stat(e.providerSettingsPath()); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	if err := settings.Save(e.providerSettingsPath()); err != nil {
+		return err
+	}
+	e.providerSettings = settings
+	return nil
+}
+
 func (e *env) DB() boltdb.Database {
 	return e.db
 }
@@ -54,6 +81,9 @@ func (e *env) Session() *session.Session {
 
 func (e *env) Close() {
 	e.session.Close()
+	if err := e.SaveProviderSettings(); err != nil {
+		e.log.Sugar().Errorf("error saving provider settings: %v", err)
+	}
 	if err := e.db.Close(); err != nil {
 		e.log.Sugar().Errorf("error closing database: %v", err)
 	}
@@ -107,6 +137,30 @@ func (b *envBuilder) Build() (_ Env, err error) {
 		return nil, fmt.Errorf("failed to create config dir %v: %w", env.configDir, err)
 	}
 
+	// Extra providers and settings only apply to this env, not to everything using the registry it started from
+	env.providerRegistry = env.providerRegistry.Clone()
+
+	// External helper providers are optional, configured in providers.json
+	providersPath := filepath.Join(env.configDir, "providers.json")
+	if _, err := os.Stat(providersPath); err == nil {
+		if err := external.RegisterFile(env.providerRegistry, providersPath); err != nil {
+			return nil, fmt.Errorf("failed to load providers: %w", err)
+		}
+	}
+	// JavaScript extractors are optional, one per .js file in scripts/
+	scriptsDir := filepath.Join(env.configDir, "scripts")
+	if info, err := os.Stat(scriptsDir); err == nil && info.IsDir() {
+		if err := script.RegisterDir(env.providerRegistry, scriptsDir); err != nil {
+			return nil, fmt.Errorf("failed to load scripts: %w", err)
+		}
+	}
+
+	// Which providers are enabled, and their priorities, are saved in provider_settings.json
+	if env.providerSettings, err = video_archiver.LoadProviderSettings(env.providerSettingsPath()); err != nil {
+		return nil, fmt.Errorf("failed to load provider settings: %w", err)
+	}
+	env.providerRegistry.ApplySettings(env.providerSettings)
+
 	dbPath := b.makeDatabasePath(b)
 	if err = os.MkdirAll(filepath.Dir(dbPath), 0750); err != nil {
 		return nil, fmt.Errorf("failed to create database %v: %w", dbPath, err)
@@ -120,6 +174,8 @@ func (b *envBuilder) Build() (_ Env, err error) {
 	if env.session, err = session.New(sessionConfig, env.ctx); err != nil {
 		return nil, err
 	}
+	// Use the session's view of the providers, so changes to them affect its downloads
+	env.providerRegistry = env.session.ProviderRegistry()
 
 	return &env, nil
 }
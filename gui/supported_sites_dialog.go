@@ -0,0 +1,106 @@
+package gui
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/gotk3/gotk3/gtk"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+const (
+	providerColumnEnabled = iota
+	providerColumnName
+	providerColumnSites
+	providerColumnCapabilities
+	providerColumnDescription
+	providerColumnTooltip
+)
+
+// supportedSitesDialog lists the providers (from their descriptions), and allows them to be enabled and disabled.
+type supportedSitesDialog struct {
+	Dialog      *gtk.Dialog             `glade:"dialog"`
+	Store       *gtk.ListStore          `glade:"store"`
+	EnabledCell *gtk.CellRendererToggle `glade:"cell_enabled"`
+
+	app Application
+}
+
+func newSupportedSitesDialog(app Application) *supportedSitesDialog {
+	d := &supportedSitesDialog{app: app}
+
+	GladeRepository.MustBuild(d, "supported_sites_dialog.glade")
+	d.EnabledCell.Connect("toggled", func(_ *gtk.CellRendererToggle, path string) {
+		d.onToggled(path)
+	})
+
+	return d
+}
+
+func (d *supportedSitesDialog) run() {
+	d.refresh()
+	d.Dialog.Run()
+	d.Dialog.Hide()
+}
+
+func (d *supportedSitesDialog) refresh() {
+	d.Store.Clear()
+	for _, p := range d.app.ProviderRegistry().Providers() {
+		columns := []int{
+			providerColumnEnabled,
+			providerColumnName,
+			providerColumnSites,
+			providerColumnCapabilities,
+			providerColumnDescription,
+			providerColumnTooltip,
+		}
+		values := []interface{}{
+			p.Enabled,
+			p.Name,
+			getProviderDisplaySites(&p.Provider),
+			p.Capabilities.String(),
+			p.Description,
+			html.EscapeString(getProviderDisplayTooltip(&p)),
+		}
+		generic.Unwrap_(d.Store.Set(d.Store.Append(), columns, values))
+	}
+}
+
+func (d *supportedSitesDialog) onToggled(path string) {
+	iter := generic.Unwrap(d.Store.GetIterFromString(path))
+	name := generic.Unwrap(generic.Unwrap(d.Store.GetValue(iter, providerColumnName)).GetString())
+	registry := d.app.ProviderRegistry()
+	enabled := !generic.Unwrap(registry.Get(name)).Enabled
+	if enabled {
+		generic.Unwrap_(registry.Enable(name))
+	} else {
+		generic.Unwrap_(registry.Disable(name))
+	}
+	generic.Unwrap_(d.Store.SetValue(iter, providerColumnEnabled, enabled))
+	if err := d.app.SaveProviderSettings(); err != nil {
+		d.app.Logger().Sugar().Errorf("error saving provider settings: %v", err)
+	}
+}
+
+func getProviderDisplaySites(p *video_archiver.Provider) string {
+	if len(p.Hosts) > 0 {
+		return strings.Join(p.Hosts, ", ")
+	}
+	return strings.Join(p.Patterns, ", ")
+}
+
+func getProviderDisplayTooltip(p *video_archiver.ProviderState) string {
+	lines := []string{fmt.Sprintf("Priority: %v", p.Priority)}
+	if len(p.Patterns) > 0 {
+		lines = append(lines, "", "URLs like:")
+		lines = append(lines, p.Patterns...)
+	}
+	if len(p.Examples) > 0 {
+		lines = append(lines, "", "For example:")
+		lines = append(lines, p.Examples...)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,169 @@
+package video_archiver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+type httpClientKey struct{}
+
+// WithHTTPClient returns a copy of ctx carrying an http.Client, which providers should use (via HTTPClientFromContext)
+// for any HTTP requests they make during Recon or Download.
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientKey{}, client)
+}
+
+// HTTPClientFromContext returns the http.Client set by WithHTTPClient, or http.DefaultClient if there isn't one.
+func HTTPClientFromContext(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(httpClientKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// HTTPConfig describes how HTTP requests should be made, so that the same settings apply to every request made while
+// matching, fetching information about, and downloading a video.
+type HTTPConfig struct {
+	// User-Agent header to send, if not set by whoever created the request.
+	UserAgent string
+	// URL of the proxy to use, e.g. "http://proxy:3128" or "socks5://localhost:1080". If empty, the proxy is taken
+	// from the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY).
+	Proxy string
+	// Maximum time to wait for a connection to be established and for response headers to be received. Doesn't limit
+	// the time taken to read the response body, since that would limit the size of a download. 0 means no limit.
+	Timeout time.Duration
+	// Extra headers to send with every request, unless already set by whoever created the request.
+	Header http.Header
+	// Path to a PEM file of CA certificates to trust in addition to the system roots.
+	RootCAs string
+	// Path to a Netscape-format cookies.txt file to load cookies from.
+	CookieFile string
+}
+
+// AddHeader parses a header in "Name: value" form and adds it to Header.
+func (c *HTTPConfig) AddHeader(line string) error {
+	name, value, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+	}
+	if c.Header == nil {
+		c.Header = make(http.Header)
+	}
+	c.Header.Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// NewClient creates an http.Client according to the configuration.
+func (c HTTPConfig) NewClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if c.Timeout > 0 {
+		dialer := &net.Dialer{Timeout: c.Timeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = c.Timeout
+		transport.ResponseHeaderTimeout = c.Timeout
+	}
+	if c.RootCAs != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.RootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root CAs: %w", err)
+		} else if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", c.RootCAs)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	header := c.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if c.UserAgent != "" {
+		header.Set("User-Agent", c.UserAgent)
+	}
+	var rt http.RoundTripper = transport
+	if len(header) > 0 {
+		rt = &headerTransport{header: header, next: transport}
+	}
+	client := &http.Client{Transport: rt}
+	if c.CookieFile != "" {
+		jar, err := LoadCookieJar(c.CookieFile)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
+	return client, nil
+}
+
+// LoadCookieJar creates a http.CookieJar containing the cookies from a Netscape-format cookies.txt file, ignoring any
+// cookies that have already expired.
+func LoadCookieJar(filename string) (http.CookieJar, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer f.Close()
+	cookies, err := util.ParseNetscapeCookies(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie file %v: %w", filename, err)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range cookies {
+		if cookie := &cookies[i]; cookie.Expires.IsZero() || cookie.Expires.After(now) {
+			jar.SetCookies(cookie.URL(), []*http.Cookie{&cookie.Cookie})
+		}
+	}
+	return jar, nil
+}
+
+// A headerTransport adds default headers to requests before passing them on to the next http.RoundTripper.
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the request, so only copy it if there's something to add
+	var clone *http.Request
+	for key, values := range t.header {
+		if _, ok := req.Header[key]; ok {
+			continue
+		}
+		if clone == nil {
+			clone = req.Clone(req.Context())
+			if clone.Header == nil {
+				clone.Header = make(http.Header)
+			}
+		}
+		clone.Header[key] = values
+	}
+	if clone != nil {
+		req = clone
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,89 @@
+package video_archiver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestHTTPConfig(t *testing.T) {
+	assert := assert_.New(t)
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	config := HTTPConfig{UserAgent: "video-archiver/test", Timeout: time.Second}
+	assert.NoError(config.AddHeader("X-Extra: one"))
+	assert.NoError(config.AddHeader("Referer: https://example.com/"))
+	assert.Error(config.AddHeader("nonsense"))
+	client := generic.Unwrap(config.NewClient())
+
+	// Headers are added to every request made through the Download...
+	d := generic.Unwrap(NewDownloadBuilder().WithTempPath(t.TempDir()).WithHTTPClient(client).Build())
+	defer d.Close()
+	assert.NoError(d.AppendURL(io.Discard, server.URL))
+	assert.Equal("video-archiver/test", received.Get("User-Agent"))
+	assert.Equal("one", received.Get("X-Extra"))
+	// ... unless the request already has them
+	req := generic.Unwrap(http.NewRequest("GET", server.URL, nil))
+	req.Header.Set("Referer", "https://example.org/")
+	assert.NoError(d.AppendHTTPRequest(io.Discard, req))
+	assert.Equal("https://example.org/", received.Get("Referer"))
+	assert.Equal("one", received.Get("X-Extra"))
+	assert.Empty(req.Header.Get("X-Extra"))
+
+	// Providers find the same client in the Download's context
+	assert.Same(client, HTTPClientFromContext(d.Context()))
+	assert.Same(http.DefaultClient, HTTPClientFromContext(context.Background()))
+
+	// Without WithHTTPClient, the client comes from the context
+	d = generic.Unwrap(NewDownloadBuilder().WithTempPath(t.TempDir()).WithContext(WithHTTPClient(context.Background(), client)).Build())
+	defer d.Close()
+	assert.Same(client, HTTPClientFromContext(d.Context()))
+
+	_, err := HTTPConfig{Proxy: "://bad"}.NewClient()
+	assert.Error(err)
+}
+
+func TestLoadCookieJar(t *testing.T) {
+	assert := assert_.New(t)
+	var received []*http.Cookie
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Cookies()
+	}))
+	defer server.Close()
+	host := generic.Unwrap(url.Parse(server.URL)).Hostname()
+
+	cookieFile := filepath.Join(t.TempDir(), "cookies.txt")
+	generic.Unwrap_(os.WriteFile(cookieFile, []byte(strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		host + "\tFALSE\t/\tFALSE\t0\tsession\tabc",
+		host + "\tFALSE\t/\tFALSE\t1\texpired\tdef",
+		host + "\tFALSE\t/other\tFALSE\t0\tother\tghi",
+		"example.com\tTRUE\t/\tFALSE\t0\telsewhere\tjkl",
+	}, "\n")), 0600))
+	client := generic.Unwrap(HTTPConfig{CookieFile: cookieFile}.NewClient())
+	d := generic.Unwrap(NewDownloadBuilder().WithTempPath(t.TempDir()).WithHTTPClient(client).Build())
+	defer d.Close()
+	assert.NoError(d.AppendURL(io.Discard, server.URL+"/video"))
+	if assert.Len(received, 1) {
+		assert.Equal("session", received[0].Name)
+		assert.Equal("abc", received[0].Value)
+	}
+
+	_, err := HTTPConfig{CookieFile: filepath.Join(t.TempDir(), "missing.txt")}.NewClient()
+	assert.Error(err)
+}
@@ -0,0 +1,148 @@
+// Package captions converts captions (subtitles) between formats.
+package captions
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnsupported = errors.New("unsupported caption format")
+
+// A Cue is a piece of caption text and when to show it.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// ParseTimedText parses YouTube's timed-text XML, either the original format (`<transcript><text start="1.5"
+// dur="2">`, times in seconds) or format 3 (`<timedtext format="3"><body><p t="1500" d="2000">`, times in
+// milliseconds, with auto-generated captions split into `<s>` segments).
+func ParseTimedText(r io.Reader) ([]Cue, error) {
+	var doc struct {
+		XMLName xml.Name
+		Texts   []struct {
+			Start string `xml:"start,attr"`
+			Dur   string `xml:"dur,attr"`
+			Text  string `xml:",chardata"`
+		} `xml:"text"`
+		Paragraphs []struct {
+			T        string `xml:"t,attr"`
+			D        string `xml:"d,attr"`
+			Text     string `xml:",chardata"`
+			Segments []struct {
+				Text string `xml:",chardata"`
+			} `xml:"s"`
+		} `xml:"body>p"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid timed text: %w", err)
+	}
+	var cues []Cue
+	switch doc.XMLName.Local {
+	case "transcript":
+		for _, t := range doc.Texts {
+			start, err := parseSeconds(t.Start)
+			if err != nil {
+				return nil, err
+			}
+			dur, err := parseSeconds(t.Dur)
+			if err != nil {
+				return nil, err
+			}
+			// Text is HTML inside the XML, so entities are escaped twice
+			cues = append(cues, Cue{Start: start, End: start + dur, Text: html.UnescapeString(t.Text)})
+		}
+	case "timedtext":
+		for _, p := range doc.Paragraphs {
+			start, err := parseMilliseconds(p.T)
+			if err != nil {
+				return nil, err
+			}
+			dur, err := parseMilliseconds(p.D)
+			if err != nil {
+				return nil, err
+			}
+			text := p.Text
+			for _, s := range p.Segments {
+				text += s.Text
+			}
+			if text = strings.TrimSpace(text); text == "" {
+				continue
+			}
+			cues = append(cues, Cue{Start: start, End: start + dur, Text: text})
+		}
+	default:
+		return nil, fmt.Errorf("%w: <%v>", ErrUnsupported, doc.XMLName.Local)
+	}
+	return cues, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %#v", s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func parseMilliseconds(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %#v", s)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Write writes the cues in the named format, "srt" or "vtt".
+func Write(w io.Writer, format string, cues []Cue) error {
+	switch format {
+	case "srt":
+		return WriteSRT(w, cues)
+	case "vtt":
+		return WriteVTT(w, cues)
+	default:
+		return fmt.Errorf("%w: %v", ErrUnsupported, format)
+	}
+}
+
+// WriteSRT writes the cues as SubRip subtitles.
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range cues {
+		_, _ = fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", i+1, formatTime(cue.Start, ","), formatTime(cue.End, ","), cue.Text)
+	}
+	return bw.Flush()
+}
+
+// WriteVTT writes the cues as WebVTT subtitles.
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		_, _ = fmt.Fprintf(bw, "%s --> %s\n%s\n\n", formatTime(cue.Start, "."), formatTime(cue.End, "."), vttEscaper.Replace(cue.Text))
+	}
+	return bw.Flush()
+}
+
+// Characters that would otherwise be cue markup in WebVTT.
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// formatTime formats as HH:MM:SS followed by the separator and milliseconds.
+func formatTime(d time.Duration, separator string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
@@ -0,0 +1,59 @@
+package captions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestParseTimedText(t *testing.T) {
+	assert := assert_.New(t)
+
+	transcript := `<?xml version="1.0" encoding="utf-8" ?><transcript>
+<text start="0.5" dur="2.25">Hello &amp;#39;world&amp;#39;</text>
+<text start="3" dur="1">Fish &amp;amp; chips</text>
+</transcript>`
+	assert.Equal([]Cue{
+		{Start: 500 * time.Millisecond, End: 2750 * time.Millisecond, Text: "Hello 'world'"},
+		{Start: 3 * time.Second, End: 4 * time.Second, Text: "Fish & chips"},
+	}, generic.Unwrap(ParseTimedText(strings.NewReader(transcript))))
+
+	format3 := `<?xml version="1.0" encoding="utf-8" ?><timedtext format="3"><body>
+<p t="1200" d="3000">Manual caption</p>
+<p t="4200" d="1500" w="1"><s ac="0">auto</s><s t="500"> generated</s></p>
+<p t="5700" d="10" a="1">
+</p>
+</body></timedtext>`
+	assert.Equal([]Cue{
+		{Start: 1200 * time.Millisecond, End: 4200 * time.Millisecond, Text: "Manual caption"},
+		{Start: 4200 * time.Millisecond, End: 5700 * time.Millisecond, Text: "auto generated"},
+	}, generic.Unwrap(ParseTimedText(strings.NewReader(format3))))
+
+	_, err := ParseTimedText(strings.NewReader(`<tt></tt>`))
+	assert.ErrorIs(err, ErrUnsupported)
+	_, err = ParseTimedText(strings.NewReader(`<transcript><text start="soon">x</text></transcript>`))
+	assert.Error(err)
+}
+
+func TestWrite(t *testing.T) {
+	assert := assert_.New(t)
+	cues := []Cue{
+		{Start: 500 * time.Millisecond, End: 2750 * time.Millisecond, Text: "Hello"},
+		{Start: time.Hour + 2*time.Minute + 3*time.Second, End: time.Hour + 2*time.Minute + 5*time.Second, Text: "<Two>\nlines & more"},
+	}
+
+	srt := &bytes.Buffer{}
+	assert.NoError(Write(srt, "srt", cues))
+	assert.Equal("1\n00:00:00,500 --> 00:00:02,750\nHello\n\n2\n01:02:03,000 --> 01:02:05,000\n<Two>\nlines & more\n\n", srt.String())
+
+	vtt := &bytes.Buffer{}
+	assert.NoError(Write(vtt, "vtt", cues))
+	assert.Equal("WEBVTT\n\n00:00:00.500 --> 00:00:02.750\nHello\n\n01:02:03.000 --> 01:02:05.000\n&lt;Two&gt;\nlines &amp; more\n\n", vtt.String())
+
+	assert.ErrorIs(Write(&bytes.Buffer{}, "ass", cues), ErrUnsupported)
+}
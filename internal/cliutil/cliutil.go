@@ -0,0 +1,178 @@
+// Package cliutil has the flags and subcommands shared by the download-video commands.
+package cliutil
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/providers/external"
+	"github.com/alanbriolat/video-archiver/providers/script"
+)
+
+// Flags are the flags understood by RegisterProviders, ParseHTTPConfig and ParseOptions, plus the basic download
+// settings.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "target",
+			Value: ".",
+			Usage: "save downloaded video to `DIR`",
+		},
+		&cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "limit download speed to `RATE` bytes per second, e.g. 500K or 2M",
+		},
+		&cli.StringFlag{
+			Name:  "user-agent",
+			Usage: "send `UA` as the User-Agent header",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Usage: "make HTTP requests through proxy `URL` (default from HTTP_PROXY etc.)",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "give up if connecting or waiting for a response takes longer than `DURATION`",
+		},
+		&cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "add `\"NAME: VALUE\"` header to every HTTP request (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "option",
+			Usage: "set provider option `KEY=VALUE`, e.g. youtube.max-height=720 (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "cookies",
+			Usage: "load cookies from Netscape-format cookies.txt `FILE`",
+		},
+		&cli.BoolFlag{
+			Name:  "sidecars",
+			Usage: "save metadata (info.json, description, thumbnail) alongside the video",
+		},
+		&cli.StringFlag{
+			Name:  "providers",
+			Usage: "add external helper providers configured in JSON `FILE`",
+		},
+		&cli.StringFlag{
+			Name:  "scripts",
+			Usage: "add JavaScript extractors from each .js file in `DIR`",
+		},
+	}
+}
+
+// Commands are the subcommands for finding out about the providers in registry.
+func Commands(registry *video_archiver.ProviderRegistry) []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:      "explain",
+			Usage:     "show which providers match each URL, and why the others don't",
+			ArgsUsage: "URL...",
+			Action:    func(c *cli.Context) error { return Explain(c, registry) },
+		},
+		{
+			Name:   "providers",
+			Usage:  "list the providers in priority order, with the sites they support",
+			Action: func(c *cli.Context) error { return ListProviders(c, registry) },
+		},
+	}
+}
+
+// RegisterProviders adds any providers configured by flags to registry.
+func RegisterProviders(c *cli.Context, registry *video_archiver.ProviderRegistry) error {
+	if path := c.String("providers"); path != "" {
+		if err := external.RegisterFile(registry, path); err != nil {
+			return err
+		}
+	}
+	if dir := c.String("scripts"); dir != "" {
+		if err := script.RegisterDir(registry, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Explain shows, for each URL, the result of trying every provider in priority order.
+func Explain(c *cli.Context, registry *video_archiver.ProviderRegistry) error {
+	if err := RegisterProviders(c, registry); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	for i, s := range c.Args().Slice() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, s)
+		used := false
+		for _, result := range registry.Explain(s) {
+			switch {
+			case result.Matched() && !used:
+				used = true
+				fmt.Fprintf(w, "  %v\t%v\tmatch (used)\n", result.ProviderName, result.Priority)
+			case result.Matched():
+				fmt.Fprintf(w, "  %v\t%v\tmatch\n", result.ProviderName, result.Priority)
+			default:
+				fmt.Fprintf(w, "  %v\t%v\tno match: %v\n", result.ProviderName, result.Priority, strings.TrimSpace(result.Err.Error()))
+			}
+		}
+		if !used {
+			fmt.Fprintln(w, "  no provider matched")
+		}
+	}
+	return w.Flush()
+}
+
+// ListProviders describes each provider, in priority order.
+func ListProviders(c *cli.Context, registry *video_archiver.ProviderRegistry) error {
+	if err := RegisterProviders(c, registry); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	for _, p := range registry.Providers() {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", p.Name, p.Priority, p.Description)
+		for _, host := range p.Hosts {
+			fmt.Fprintf(w, "\t\tsite: %v\n", host)
+		}
+		for _, pattern := range p.Patterns {
+			fmt.Fprintf(w, "\t\tURL: %v\n", pattern)
+		}
+		if p.Capabilities != 0 {
+			fmt.Fprintf(w, "\t\tdownloads: %v\n", p.Capabilities)
+		}
+	}
+	return w.Flush()
+}
+
+// ParseOptions gets the provider options set by flags.
+func ParseOptions(c *cli.Context) (video_archiver.Options, error) {
+	options := make(video_archiver.Options)
+	for _, option := range c.StringSlice("option") {
+		key, value, err := video_archiver.ParseOption(option)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+	return options, nil
+}
+
+// ParseHTTPConfig gets the HTTP client configuration set by flags.
+func ParseHTTPConfig(c *cli.Context) (video_archiver.HTTPConfig, error) {
+	config := video_archiver.HTTPConfig{
+		UserAgent:  c.String("user-agent"),
+		Proxy:      c.String("proxy"),
+		Timeout:    c.Duration("timeout"),
+		CookieFile: c.String("cookies"),
+	}
+	for _, header := range c.StringSlice("header") {
+		if err := config.AddHeader(header); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
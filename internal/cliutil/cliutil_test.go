@@ -0,0 +1,66 @@
+package cliutil
+
+import (
+	"bytes"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+func runApp(t *testing.T, registry *video_archiver.ProviderRegistry, args ...string) string {
+	var out bytes.Buffer
+	app := &cli.App{
+		Name:     "test",
+		Flags:    Flags(),
+		Commands: Commands(registry),
+		Writer:   &out,
+	}
+	assert_.NoError(t, app.Run(append([]string{"test"}, args...)))
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	assert := assert_.New(t)
+
+	// Providers added by flags go in the registry that was passed in, and nowhere else
+	registry := &video_archiver.ProviderRegistry{}
+	out := runApp(t, registry, "--scripts", "../../providers/script/testdata/scripts", "providers")
+	assert.Contains(out, "example")
+	assert.Contains(out, "site: videos.example.com")
+	_, err := registry.Get("example")
+	assert.NoError(err)
+	_, err = video_archiver.DefaultProviderRegistry.Get("example")
+	assert.Error(err)
+
+	out = runApp(t, registry, "explain", "https://videos.example.com/abc", "https://other.example.com/")
+	assert.Regexp(`(?m)^  example +10 +match \(used\)$`, out)
+	assert.Contains(out, "https://other.example.com/\n")
+	assert.Contains(out, "no provider matched")
+}
+
+func TestParse(t *testing.T) {
+	assert := assert_.New(t)
+	var options video_archiver.Options
+	var config video_archiver.HTTPConfig
+	app := &cli.App{
+		Name:  "test",
+		Flags: Flags(),
+		Action: func(c *cli.Context) (err error) {
+			if options, err = ParseOptions(c); err != nil {
+				return err
+			}
+			config, err = ParseHTTPConfig(c)
+			return err
+		},
+	}
+	if assert.NoError(app.Run([]string{"test", "--option", "youtube.max-height=720", "--user-agent", "test/1.0", "--header", "X-Test: value"})) {
+		assert.Equal(video_archiver.Options{"youtube.max-height": "720"}, options)
+		assert.Equal("test/1.0", config.UserAgent)
+		assert.Equal("value", config.Header.Get("X-Test"))
+	}
+	assert.Error(app.Run([]string{"test", "--option", "invalid"}))
+	assert.Error(app.Run([]string{"test", "--header", "invalid"}))
+}
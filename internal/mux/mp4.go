@@ -0,0 +1,488 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// An mp4Box is the location of a box (a.k.a. atom) within its container.
+type mp4Box struct {
+	typ    string
+	offset int64
+	header int64
+	size   int64
+}
+
+// readMP4Boxes finds the boxes between start and end.
+func readMP4Boxes(r io.ReaderAt, start int64, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := start; offset < end; {
+		header, err := readAt(r, offset, 8)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read box header at %d: %w", offset, err)
+		}
+		box := mp4Box{
+			typ:    string(header[4:8]),
+			offset: offset,
+			header: 8,
+			size:   int64(binary.BigEndian.Uint32(header[0:4])),
+		}
+		switch box.size {
+		case 0:
+			// Box extends to the end of its container
+			box.size = end - offset
+		case 1:
+			largeSize, err := readAt(r, offset+8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read box header at %d: %w", offset, err)
+			}
+			box.header = 16
+			box.size = int64(binary.BigEndian.Uint64(largeSize))
+		}
+		if box.size < box.header || offset+box.size > end {
+			return nil, fmt.Errorf("invalid %q box at %d", box.typ, offset)
+		}
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	return boxes, nil
+}
+
+// parseMP4Boxes finds the boxes within data, which is usually the payload of another box.
+func parseMP4Boxes(data []byte) ([]mp4Box, error) {
+	return readMP4Boxes(bytes.NewReader(data), 0, int64(len(data)))
+}
+
+// payload returns the part of data (which contains the box) after the box header.
+func (b mp4Box) payload(data []byte) []byte {
+	return data[b.offset+b.header : b.offset+b.size]
+}
+
+// bytes returns the part of data (which contains the box) that is the whole box.
+func (b mp4Box) bytes(data []byte) []byte {
+	return data[b.offset : b.offset+b.size]
+}
+
+// findMP4Box follows the path of box types from data, returning the payload of the box at the end of the path. The
+// result is a slice of data, so can be used to modify it.
+func findMP4Box(data []byte, path ...string) ([]byte, error) {
+	for _, typ := range path {
+		boxes, err := parseMP4Boxes(data)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, box := range boxes {
+			if box.typ == typ {
+				data = box.payload(data)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("missing %q box", typ)
+		}
+	}
+	return data, nil
+}
+
+// makeMP4Box creates a box from its type and the concatenated payload.
+func makeMP4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box[0:4], uint32(size))
+	copy(box[4:8], typ)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+// Offsets of fields within "full box" payloads (after version and flags), for version 0 and version 1.
+var (
+	mvhdNextTrackIDOffset = [2]int{96, 108}
+	tkhdTrackIDOffset     = [2]int{12, 20}
+	mdhdTimescaleOffset   = [2]int{12, 20}
+)
+
+// fullBoxField returns the 4 bytes of a full box payload at the offset for its version.
+func fullBoxField(payload []byte, offsets [2]int) ([]byte, error) {
+	version := 0
+	if len(payload) > 0 && payload[0] == 1 {
+		version = 1
+	}
+	offset := offsets[version]
+	if len(payload) < offset+4 {
+		return nil, fmt.Errorf("box too short")
+	}
+	return payload[offset : offset+4], nil
+}
+
+type mp4Input struct {
+	r         io.ReaderAt
+	ftyp      []byte
+	moov      []byte
+	fragments []*mp4Fragment
+	// Track IDs in the output, keyed by track ID in the input
+	trackIDs   map[uint32]uint32
+	timescales map[uint32]uint32
+}
+
+// An mp4Fragment is a moof box and the boxes that follow it (i.e. the mdat containing its samples).
+type mp4Fragment struct {
+	input *mp4Input
+	moof  mp4Box
+	data  []mp4Box
+	time  float64
+}
+
+func (f *mp4Fragment) timestamp() float64 {
+	return f.time
+}
+
+// MuxMP4 writes a fragmented MP4 file containing all the tracks of the fragmented MP4 inputs. Fragments are
+// interleaved by time, and any segment index (sidx) is dropped because its offsets would be wrong.
+func MuxMP4(w io.Writer, inputs ...Input) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no inputs")
+	}
+	parsed := make([]*mp4Input, len(inputs))
+	fragmentLists := make([][]*mp4Fragment, len(inputs))
+	var nextTrackID uint32 = 1
+	for i, input := range inputs {
+		in, err := readMP4Input(input)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if err := in.assignTrackIDs(&nextTrackID); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if err := in.readFragmentTimes(); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		parsed[i] = in
+		fragmentLists[i] = in.fragments
+	}
+
+	moov, err := mergeMP4Moov(parsed, nextTrackID)
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(parsed[0].ftyp); err != nil {
+		return err
+	}
+	if _, err := cw.Write(moov); err != nil {
+		return err
+	}
+	for i, fragment := range interleave(fragmentLists...) {
+		if err := fragment.write(cw, uint32(i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMP4Input(input Input) (*mp4Input, error) {
+	in := &mp4Input{r: input, trackIDs: make(map[uint32]uint32), timescales: make(map[uint32]uint32)}
+	boxes, err := readMP4Boxes(input, 0, input.Size())
+	if err != nil {
+		return nil, err
+	}
+	var current *mp4Fragment
+	for _, box := range boxes {
+		switch box.typ {
+		case "ftyp":
+			if in.ftyp, err = readAt(input, box.offset, box.size); err != nil {
+				return nil, err
+			}
+		case "moov":
+			if in.moov, err = readAt(input, box.offset, box.size); err != nil {
+				return nil, err
+			}
+		case "moof":
+			current = &mp4Fragment{input: in, moof: box}
+			in.fragments = append(in.fragments, current)
+		case "sidx", "styp", "mfra", "ssix", "prft":
+			// Indexes that would be wrong in the output
+			current = nil
+		default:
+			// Keep anything else that comes after a moof (e.g. mdat, free) in the same relative position
+			if current != nil {
+				current.data = append(current.data, box)
+			}
+		}
+	}
+	if in.ftyp == nil || in.moov == nil {
+		return nil, fmt.Errorf("%w: missing ftyp or moov box", ErrUnsupported)
+	}
+	if _, err := findMP4Box(in.moov, "moov", "mvex"); err != nil || len(in.fragments) == 0 {
+		return nil, fmt.Errorf("%w: not a fragmented MP4", ErrUnsupported)
+	}
+	return in, nil
+}
+
+// assignTrackIDs gives each track in the input a new track ID, starting from *next.
+func (in *mp4Input) assignTrackIDs(next *uint32) error {
+	moov, err := findMP4Box(in.moov, "moov")
+	if err != nil {
+		return err
+	}
+	boxes, err := parseMP4Boxes(moov)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+		trak := box.payload(moov)
+		tkhd, err := findMP4Box(trak, "tkhd")
+		if err != nil {
+			return err
+		}
+		trackID, err := fullBoxField(tkhd, tkhdTrackIDOffset)
+		if err != nil {
+			return fmt.Errorf("invalid tkhd: %w", err)
+		}
+		mdhd, err := findMP4Box(trak, "mdia", "mdhd")
+		if err != nil {
+			return err
+		}
+		timescale, err := fullBoxField(mdhd, mdhdTimescaleOffset)
+		if err != nil {
+			return fmt.Errorf("invalid mdhd: %w", err)
+		}
+		id := binary.BigEndian.Uint32(trackID)
+		in.trackIDs[id] = *next
+		in.timescales[id] = binary.BigEndian.Uint32(timescale)
+		*next++
+	}
+	if len(in.trackIDs) == 0 {
+		return fmt.Errorf("%w: no tracks", ErrUnsupported)
+	}
+	return nil
+}
+
+// readFragmentTimes reads each fragment's moof to find which tracks it contains and when it starts.
+func (in *mp4Input) readFragmentTimes() error {
+	for _, fragment := range in.fragments {
+		moof, err := readAt(in.r, fragment.moof.offset, fragment.moof.size)
+		if err != nil {
+			return err
+		}
+		fragment.time = -1
+		first := true
+		err = forEachTraf(moof, func(tfhd []byte, tfdt []byte) error {
+			trackID := binary.BigEndian.Uint32(tfhd[4:8])
+			if _, ok := in.trackIDs[trackID]; !ok {
+				return fmt.Errorf("fragment for unknown track %d", trackID)
+			}
+			if first && tfdt != nil && in.timescales[trackID] > 0 {
+				var decodeTime uint64
+				if tfdt[0] == 1 && len(tfdt) >= 12 {
+					decodeTime = binary.BigEndian.Uint64(tfdt[4:12])
+				} else if len(tfdt) >= 8 {
+					decodeTime = uint64(binary.BigEndian.Uint32(tfdt[4:8]))
+				}
+				fragment.time = float64(decodeTime) / float64(in.timescales[trackID])
+			}
+			first = false
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachTraf calls f with the tfhd and tfdt (nil if missing) payloads of each traf in the moof box. The payloads are
+// slices of moof, so can be used to modify it.
+func forEachTraf(moof []byte, f func(tfhd []byte, tfdt []byte) error) error {
+	payload, err := findMP4Box(moof, "moof")
+	if err != nil {
+		return err
+	}
+	boxes, err := parseMP4Boxes(payload)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if box.typ != "traf" {
+			continue
+		}
+		traf := box.payload(payload)
+		tfhd, err := findMP4Box(traf, "tfhd")
+		if err != nil {
+			return err
+		} else if len(tfhd) < 8 {
+			return fmt.Errorf("invalid tfhd")
+		}
+		tfdt, _ := findMP4Box(traf, "tfdt")
+		if err := f(tfhd, tfdt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeMP4Moov creates a moov box containing the tracks of all the inputs, and the other boxes of the first input.
+func mergeMP4Moov(inputs []*mp4Input, nextTrackID uint32) ([]byte, error) {
+	var traks, trexs [][]byte
+	for _, in := range inputs {
+		moov, err := findMP4Box(in.moov, "moov")
+		if err != nil {
+			return nil, err
+		}
+		boxes, err := parseMP4Boxes(moov)
+		if err != nil {
+			return nil, err
+		}
+		for _, box := range boxes {
+			switch box.typ {
+			case "trak":
+				trak := append([]byte(nil), box.bytes(moov)...)
+				tkhd, err := findMP4Box(trak, "trak", "tkhd")
+				if err != nil {
+					return nil, err
+				}
+				trackID, err := fullBoxField(tkhd, tkhdTrackIDOffset)
+				if err != nil {
+					return nil, fmt.Errorf("invalid tkhd: %w", err)
+				}
+				if err := in.renumber(trackID); err != nil {
+					return nil, err
+				}
+				traks = append(traks, trak)
+			case "mvex":
+				mvex := box.payload(moov)
+				children, err := parseMP4Boxes(mvex)
+				if err != nil {
+					return nil, err
+				}
+				for _, child := range children {
+					if child.typ != "trex" {
+						continue
+					}
+					trex := append([]byte(nil), child.bytes(mvex)...)
+					if len(trex) < 16 {
+						return nil, fmt.Errorf("invalid trex")
+					}
+					if err := in.renumber(trex[12:16]); err != nil {
+						return nil, err
+					}
+					trexs = append(trexs, trex)
+				}
+			}
+		}
+	}
+
+	// Use the first input's moov as a template
+	moov, err := findMP4Box(inputs[0].moov, "moov")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := parseMP4Boxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	var children [][]byte
+	for _, box := range boxes {
+		switch box.typ {
+		case "mvhd":
+			mvhd := append([]byte(nil), box.bytes(moov)...)
+			field, err := fullBoxField(mvhd[box.header:], mvhdNextTrackIDOffset)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mvhd: %w", err)
+			}
+			binary.BigEndian.PutUint32(field, nextTrackID)
+			children = append(children, mvhd)
+		case "trak":
+			// All the tracks go where the first track was
+			children = append(children, traks...)
+			traks = nil
+		case "mvex":
+			mvex := box.payload(moov)
+			mvexChildren, err := parseMP4Boxes(mvex)
+			if err != nil {
+				return nil, err
+			}
+			var merged [][]byte
+			for _, child := range mvexChildren {
+				switch child.typ {
+				case "trex":
+					merged = append(merged, trexs...)
+					trexs = nil
+				default:
+					merged = append(merged, child.bytes(mvex))
+				}
+			}
+			children = append(children, makeMP4Box("mvex", merged...))
+		default:
+			children = append(children, box.bytes(moov))
+		}
+	}
+	return makeMP4Box("moov", children...), nil
+}
+
+// renumber replaces the 4-byte track ID in field with the corresponding output track ID.
+func (in *mp4Input) renumber(field []byte) error {
+	if len(field) < 4 {
+		return fmt.Errorf("invalid track ID")
+	}
+	old := binary.BigEndian.Uint32(field)
+	if id, ok := in.trackIDs[old]; !ok {
+		return fmt.Errorf("unknown track %d", old)
+	} else {
+		binary.BigEndian.PutUint32(field, id)
+		return nil
+	}
+}
+
+// write outputs the fragment with the new sequence number and track IDs.
+func (f *mp4Fragment) write(w *countingWriter, sequence uint32) error {
+	moof, err := readAt(f.input.r, f.moof.offset, f.moof.size)
+	if err != nil {
+		return err
+	}
+	mfhd, err := findMP4Box(moof, "moof", "mfhd")
+	if err != nil {
+		return err
+	} else if len(mfhd) < 8 {
+		return fmt.Errorf("invalid mfhd")
+	}
+	binary.BigEndian.PutUint32(mfhd[4:8], sequence)
+	// Offsets are usually relative to the moof, but if not they need to move with it
+	shift := w.n - f.moof.offset
+	err = forEachTraf(moof, func(tfhd []byte, _ []byte) error {
+		if err := f.input.renumber(tfhd[4:8]); err != nil {
+			return err
+		}
+		if flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff; flags&0x1 != 0 {
+			if len(tfhd) < 16 {
+				return fmt.Errorf("invalid tfhd")
+			}
+			base := int64(binary.BigEndian.Uint64(tfhd[8:16]))
+			binary.BigEndian.PutUint64(tfhd[8:16], uint64(base+shift))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(moof); err != nil {
+		return err
+	}
+	for _, box := range f.data {
+		if err := copySection(w, f.input.r, box.offset, box.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package mux combines separately downloaded streams (e.g. video-only and audio-only) into a single file, without
+// re-encoding. Only the container layouts used for adaptive streaming are supported: fragmented MP4 and WebM.
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrUnsupported = errors.New("unsupported input")
+
+// An Input is a complete stream to be muxed.
+type Input interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// Mux writes a file of the named container ("mp4" or "webm") containing all the tracks from the inputs.
+func Mux(w io.Writer, container string, inputs ...Input) error {
+	switch container {
+	case "mp4":
+		return MuxMP4(w, inputs...)
+	case "webm":
+		return MuxWebM(w, inputs...)
+	default:
+		return fmt.Errorf("%w: container %q", ErrUnsupported, container)
+	}
+}
+
+// MuxFiles is like Mux, but reading the inputs from the named files.
+func MuxFiles(w io.Writer, container string, filenames ...string) error {
+	inputs := make([]Input, 0, len(filenames))
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, io.NewSectionReader(f, 0, info.Size()))
+	}
+	return Mux(w, container, inputs...)
+}
+
+// A countingWriter keeps track of the current offset in the output.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// readAt reads exactly size bytes at offset.
+func readAt(r io.ReaderAt, offset int64, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if n, err := r.ReadAt(data, offset); int64(n) < size {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// copySection copies size bytes at offset from r to w.
+func copySection(w io.Writer, r io.ReaderAt, offset int64, size int64) error {
+	n, err := io.Copy(w, io.NewSectionReader(r, offset, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A timedItem is something that can be interleaved with items from other inputs by time.
+type timedItem interface {
+	// Time in seconds, or a negative value if not known.
+	timestamp() float64
+}
+
+// interleave merges lists of items that are each in time order into a single list in time order. If any item has an
+// unknown time, the lists are just concatenated.
+func interleave[T timedItem](lists ...[]T) []T {
+	var total int
+	known := true
+	for _, list := range lists {
+		total += len(list)
+		for _, item := range list {
+			if item.timestamp() < 0 {
+				known = false
+			}
+		}
+	}
+	result := make([]T, 0, total)
+	if !known {
+		for _, list := range lists {
+			result = append(result, list...)
+		}
+		return result
+	}
+	positions := make([]int, len(lists))
+	for len(result) < total {
+		next := -1
+		for i, list := range lists {
+			if positions[i] >= len(list) {
+				continue
+			}
+			// On a tie, earlier inputs go first
+			if next < 0 || list[positions[i]].timestamp() < lists[next][positions[next]].timestamp() {
+				next = i
+			}
+		}
+		result = append(result, lists[next][positions[next]])
+		positions[next]++
+	}
+	return result
+}
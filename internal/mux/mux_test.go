@@ -0,0 +1,211 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+// fullBox makes a full box payload with the field at offset set to value.
+func fullBox(size int, offset int, value uint32) []byte {
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint32(payload[offset:], value)
+	return payload
+}
+
+// makeTestMP4 creates a fragmented MP4 with a single track, with a fragment at each of the times (in the timescale).
+func makeTestMP4(name string, trackID uint32, timescale uint32, times ...uint64) []byte {
+	var file [][]byte
+	file = append(file, makeMP4Box("ftyp", []byte("iso5\x00\x00\x02\x00iso6mp41")))
+	file = append(file, makeMP4Box("moov",
+		makeMP4Box("mvhd", fullBox(100, 96, trackID+1)),
+		makeMP4Box("trak",
+			makeMP4Box("tkhd", fullBox(84, 12, trackID)),
+			makeMP4Box("mdia", makeMP4Box("mdhd", fullBox(24, 12, timescale))),
+		),
+		makeMP4Box("mvex", makeMP4Box("trex", fullBox(24, 4, trackID))),
+	))
+	file = append(file, makeMP4Box("sidx", make([]byte, 32)))
+	for i, t := range times {
+		tfhd := fullBox(8, 4, trackID)
+		tfhd[1] = 0x02 // default-base-is-moof
+		tfdt := make([]byte, 12)
+		tfdt[0] = 1
+		binary.BigEndian.PutUint64(tfdt[4:], t)
+		file = append(file,
+			makeMP4Box("moof",
+				makeMP4Box("mfhd", fullBox(8, 4, uint32(i+1))),
+				makeMP4Box("traf", makeMP4Box("tfhd", tfhd), makeMP4Box("tfdt", tfdt)),
+			),
+			makeMP4Box("mdat", []byte(fmt.Sprintf("%s%d", name, i))),
+		)
+	}
+	return bytes.Join(file, nil)
+}
+
+func TestMuxMP4(t *testing.T) {
+	assert := assert_.New(t)
+	video := makeTestMP4("video", 1, 1000, 0, 2000, 4000)
+	audio := makeTestMP4("audio", 1, 48000, 0, 48000, 3*48000)
+	out := &bytes.Buffer{}
+	if !assert.NoError(Mux(out, "mp4", bytes.NewReader(video), bytes.NewReader(audio))) {
+		return
+	}
+	data := out.Bytes()
+
+	boxes := generic.Unwrap(parseMP4Boxes(data))
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.typ)
+	}
+	assert.Equal([]string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat", "moof", "mdat"}, types)
+
+	// Both tracks are in the moov, with unique IDs
+	moov := boxes[1].payload(data)
+	mvhd := generic.Unwrap(findMP4Box(moov, "mvhd"))
+	assert.Equal(uint32(3), binary.BigEndian.Uint32(mvhd[96:]))
+	var trackIDs, trexIDs []uint32
+	for _, box := range generic.Unwrap(parseMP4Boxes(moov)) {
+		switch box.typ {
+		case "trak":
+			tkhd := generic.Unwrap(findMP4Box(box.payload(moov), "tkhd"))
+			trackIDs = append(trackIDs, binary.BigEndian.Uint32(tkhd[12:]))
+		case "mvex":
+			for _, trex := range generic.Unwrap(parseMP4Boxes(box.payload(moov))) {
+				trexIDs = append(trexIDs, binary.BigEndian.Uint32(trex.payload(box.payload(moov))[4:]))
+			}
+		}
+	}
+	assert.Equal([]uint32{1, 2}, trackIDs)
+	assert.Equal([]uint32{1, 2}, trexIDs)
+
+	// Fragments are interleaved by time, renumbered, and followed by their own data
+	var fragments []string
+	for i := 2; i < len(boxes); i += 2 {
+		moof := boxes[i].bytes(data)
+		mfhd := generic.Unwrap(findMP4Box(moof, "moof", "mfhd"))
+		tfhd := generic.Unwrap(findMP4Box(moof, "moof", "traf", "tfhd"))
+		assert.Equal(uint32(i/2), binary.BigEndian.Uint32(mfhd[4:]))
+		fragments = append(fragments, fmt.Sprintf("%d:%s", binary.BigEndian.Uint32(tfhd[4:]), boxes[i+1].payload(data)))
+	}
+	assert.Equal([]string{"1:video0", "2:audio0", "2:audio1", "1:video1", "2:audio2", "1:video2"}, fragments)
+
+	// Only fragmented MP4 is supported
+	notFragmented := bytes.Join([][]byte{
+		makeMP4Box("ftyp", []byte("isom")),
+		makeMP4Box("moov", makeMP4Box("mvhd", fullBox(100, 96, 2))),
+		makeMP4Box("mdat", []byte("data")),
+	}, nil)
+	assert.ErrorIs(MuxMP4(&bytes.Buffer{}, bytes.NewReader(video), bytes.NewReader(notFragmented)), ErrUnsupported)
+	assert.ErrorIs(Mux(&bytes.Buffer{}, "avi", bytes.NewReader(video)), ErrUnsupported)
+}
+
+// makeTestWebM creates a WebM file with a single track, with a cluster at each of the times (in milliseconds).
+func makeTestWebM(name string, codec string, times ...uint64) []byte {
+	var clusters [][]byte
+	for i, t := range times {
+		block := append([]byte{0x81, 0x00, 0x00, 0x80}, fmt.Sprintf("%s%d", name, i)...)
+		clusters = append(clusters, makeEBMLElement(ebmlIDCluster,
+			makeEBMLUint(ebmlIDTimecode, t),
+			makeEBMLUint(ebmlIDPosition, 12345),
+			makeEBMLElement(ebmlIDSimpleBlock, block),
+			makeEBMLElement(ebmlIDBlockGroup, makeEBMLElement(ebmlIDBlock, block)),
+		))
+	}
+	segment := [][]byte{
+		makeEBMLElement(0x114D9B74, []byte("seekhead")),
+		makeEBMLElement(ebmlIDInfo, makeEBMLUint(ebmlIDTimecodeScale, defaultTimecodeScale)),
+		makeEBMLElement(ebmlIDTracks, makeEBMLElement(ebmlIDTrackEntry,
+			makeEBMLUint(ebmlIDTrackNumber, 1),
+			makeEBMLUint(ebmlIDTrackUID, 1),
+			makeEBMLElement(0x86, []byte(codec)),
+		)),
+		makeEBMLElement(0x1C53BB6B, []byte("cues")),
+	}
+	segment = append(segment, clusters...)
+	return bytes.Join([][]byte{
+		makeEBMLElement(ebmlIDHeader, makeEBMLElement(0x4282, []byte("webm"))),
+		makeEBMLElement(ebmlIDSegment, segment...),
+	}, nil)
+}
+
+func TestMuxWebM(t *testing.T) {
+	assert := assert_.New(t)
+	video := makeTestWebM("video", "V_VP9", 0, 2000)
+	audio := makeTestWebM("audio", "A_OPUS", 0, 1000, 3000)
+	out := &bytes.Buffer{}
+	if !assert.NoError(Mux(out, "webm", bytes.NewReader(video), bytes.NewReader(audio))) {
+		return
+	}
+	data := out.Bytes()
+
+	top := generic.Unwrap(parseEBMLElements(data))
+	if !assert.Len(top, 2) {
+		return
+	}
+	assert.Equal(uint32(ebmlIDHeader), top[0].id)
+	assert.Equal(uint32(ebmlIDSegment), top[1].id)
+	assert.Equal(int64(-1), top[1].size)
+
+	segment := data[top[1].offset+top[1].header:]
+	children := generic.Unwrap(parseEBMLElements(segment))
+	var ids []uint32
+	for _, child := range children {
+		ids = append(ids, child.id)
+	}
+	assert.Equal([]uint32{ebmlIDInfo, ebmlIDTracks, ebmlIDCluster, ebmlIDCluster, ebmlIDCluster, ebmlIDCluster, ebmlIDCluster}, ids)
+
+	// Tracks are renumbered
+	tracks := children[1].data(segment)
+	var numbers, uids []uint64
+	for _, entry := range generic.Unwrap(parseEBMLElements(tracks)) {
+		for _, field := range generic.Unwrap(parseEBMLElements(entry.data(tracks))) {
+			switch field.id {
+			case ebmlIDTrackNumber:
+				numbers = append(numbers, readEBMLUint(field.data(entry.data(tracks))))
+			case ebmlIDTrackUID:
+				uids = append(uids, readEBMLUint(field.data(entry.data(tracks))))
+			}
+		}
+	}
+	assert.Equal([]uint64{1, 2}, numbers)
+	assert.Equal([]uint64{1, 2}, uids)
+
+	// Clusters are interleaved by time, and blocks refer to the new track numbers
+	var blocks []string
+	for _, cluster := range children[2:] {
+		data := cluster.data(segment)
+		var track byte
+		for _, child := range generic.Unwrap(parseEBMLElements(data)) {
+			assert.NotEqual(uint32(ebmlIDPosition), child.id)
+			block := child.data(data)
+			switch child.id {
+			case ebmlIDSimpleBlock:
+				track = block[0] & 0x7f
+				blocks = append(blocks, fmt.Sprintf("%d:%s", track, block[4:]))
+			case ebmlIDBlockGroup:
+				inner := generic.Unwrap(parseEBMLElements(block))[0].data(block)
+				assert.Equal(track, inner[0]&0x7f)
+			}
+		}
+	}
+	assert.Equal([]string{"1:video0", "2:audio0", "2:audio1", "1:video1", "2:audio2"}, blocks)
+}
+
+func TestVint(t *testing.T) {
+	assert := assert_.New(t)
+	for _, value := range []uint64{0, 1, 126, 127, 128, 16382, 16383, 1 << 40} {
+		encoded := appendVint(nil, value)
+		assert.Equal(len(encoded), vintLength(encoded), "value: %d", value)
+		decoded, unknown := readVint(encoded)
+		assert.Equal(value, decoded)
+		assert.False(unknown)
+	}
+	_, unknown := readVint(ebmlUnknownSize)
+	assert.True(unknown)
+}
@@ -0,0 +1,462 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// EBML element IDs used by WebM (see https://www.matroska.org/technical/elements.html).
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackNumber   = 0xD7
+	ebmlIDTrackUID      = 0x73C5
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDPosition      = 0xA7
+	ebmlIDPrevSize      = 0xAB
+	ebmlIDSimpleBlock   = 0xA3
+	ebmlIDBlockGroup    = 0xA0
+	ebmlIDBlock         = 0xA1
+)
+
+const defaultTimecodeScale = 1000000
+
+// Size of an EBML element whose size is unknown, e.g. a Segment that is still being written.
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// An ebmlElement is the location of an element within its parent.
+type ebmlElement struct {
+	id     uint32
+	offset int64
+	header int64
+	// Size of the element data, or -1 if unknown
+	size int64
+}
+
+// readEBMLElement reads the header of the element at offset.
+func readEBMLElement(r io.ReaderAt, offset int64, end int64) (ebmlElement, error) {
+	e := ebmlElement{offset: offset}
+	header := make([]byte, 12)
+	n, _ := r.ReadAt(header, offset)
+	header = header[:n]
+
+	idLength := vintLength(header)
+	if idLength == 0 || idLength > 4 || idLength > len(header) {
+		return e, fmt.Errorf("invalid element ID at %d", offset)
+	}
+	for _, b := range header[:idLength] {
+		e.id = e.id<<8 | uint32(b)
+	}
+	sizeLength := vintLength(header[idLength:])
+	if sizeLength == 0 || idLength+sizeLength > len(header) {
+		return e, fmt.Errorf("invalid element size at %d", offset)
+	}
+	size, unknown := readVint(header[idLength : idLength+sizeLength])
+	e.header = int64(idLength + sizeLength)
+	if unknown {
+		e.size = -1
+	} else {
+		e.size = int64(size)
+		if offset+e.header+e.size > end {
+			return e, fmt.Errorf("element %X at %d extends beyond its parent", e.id, offset)
+		}
+	}
+	return e, nil
+}
+
+// readEBMLElements finds the elements between start and end. An element of unknown size is assumed to extend to end.
+func readEBMLElements(r io.ReaderAt, start int64, end int64) ([]ebmlElement, error) {
+	var elements []ebmlElement
+	for offset := start; offset < end; {
+		e, err := readEBMLElement(r, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+		if e.size < 0 {
+			break
+		}
+		offset += e.header + e.size
+	}
+	return elements, nil
+}
+
+func parseEBMLElements(data []byte) ([]ebmlElement, error) {
+	return readEBMLElements(bytes.NewReader(data), 0, int64(len(data)))
+}
+
+// data returns the element data from buf (which contains the element).
+func (e ebmlElement) data(buf []byte) []byte {
+	return buf[e.offset+e.header : e.offset+e.header+e.size]
+}
+
+// bytes returns the whole element from buf (which contains the element).
+func (e ebmlElement) bytes(buf []byte) []byte {
+	return buf[e.offset : e.offset+e.header+e.size]
+}
+
+// vintLength returns the length of the variable-length integer at the start of b, from its leading zero bits.
+func vintLength(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	for i := 0; i < 8; i++ {
+		if b[0]&(0x80>>i) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// readVint decodes a variable-length integer (without its length marker), and whether it is the reserved "unknown"
+// value of all ones.
+func readVint(b []byte) (value uint64, unknown bool) {
+	length := len(b)
+	value = uint64(b[0] & (0xFF >> length))
+	for _, c := range b[1:] {
+		value = value<<8 | uint64(c)
+	}
+	return value, value == (1<<(7*length))-1
+}
+
+// appendVint encodes a variable-length integer using as few bytes as possible.
+func appendVint(b []byte, value uint64) []byte {
+	length := 1
+	for length < 8 && value >= (1<<(7*length))-1 {
+		length++
+	}
+	for i := length - 1; i >= 0; i-- {
+		c := byte(value >> (8 * i))
+		if i == length-1 {
+			c |= 0x80 >> (length - 1)
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// makeEBMLElement creates an element from its ID and the concatenated data.
+func makeEBMLElement(id uint32, data ...[]byte) []byte {
+	var size int
+	for _, d := range data {
+		size += len(d)
+	}
+	element := appendEBMLID(nil, id)
+	element = appendVint(element, uint64(size))
+	for _, d := range data {
+		element = append(element, d...)
+	}
+	return element
+}
+
+func appendEBMLID(b []byte, id uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], id)
+	i := 0
+	for i < 3 && buf[i] == 0 {
+		i++
+	}
+	return append(b, buf[i:]...)
+}
+
+func readEBMLUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func makeEBMLUint(id uint32, value uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return makeEBMLElement(id, buf[i:])
+}
+
+type webmInput struct {
+	r             io.ReaderAt
+	header        []byte
+	info          []byte
+	tracks        []byte
+	timecodeScale uint64
+	clusters      []*webmCluster
+	// Track numbers in the output, keyed by track number in the input
+	trackNumbers map[uint64]uint64
+}
+
+type webmCluster struct {
+	input   *webmInput
+	element ebmlElement
+	time    float64
+}
+
+func (c *webmCluster) timestamp() float64 {
+	return c.time
+}
+
+// MuxWebM writes a WebM file containing all the tracks of the WebM inputs. Clusters are interleaved by time. The
+// Segment is written with unknown size, and seeking information (SeekHead, Cues) is dropped because its offsets would
+// be wrong.
+func MuxWebM(w io.Writer, inputs ...Input) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no inputs")
+	}
+	parsed := make([]*webmInput, len(inputs))
+	clusterLists := make([][]*webmCluster, len(inputs))
+	var nextTrackNumber uint64 = 1
+	var entries [][]byte
+	for i, input := range inputs {
+		in, err := readWebMInput(input)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if i > 0 && in.timecodeScale != parsed[0].timecodeScale {
+			return fmt.Errorf("%w: inputs have different timecode scales", ErrUnsupported)
+		}
+		inputEntries, err := in.renumberTracks(&nextTrackNumber)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		entries = append(entries, inputEntries...)
+		parsed[i] = in
+		clusterLists[i] = in.clusters
+	}
+
+	if _, err := w.Write(parsed[0].header); err != nil {
+		return err
+	}
+	segmentHeader := append(appendEBMLID(nil, ebmlIDSegment), ebmlUnknownSize...)
+	if _, err := w.Write(segmentHeader); err != nil {
+		return err
+	}
+	if _, err := w.Write(parsed[0].info); err != nil {
+		return err
+	}
+	if _, err := w.Write(makeEBMLElement(ebmlIDTracks, entries...)); err != nil {
+		return err
+	}
+	for _, cluster := range interleave(clusterLists...) {
+		if err := cluster.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readWebMInput(input Input) (*webmInput, error) {
+	in := &webmInput{r: input, timecodeScale: defaultTimecodeScale, trackNumbers: make(map[uint64]uint64)}
+	top, err := readEBMLElements(input, 0, input.Size())
+	if err != nil {
+		return nil, err
+	}
+	if len(top) < 2 || top[0].id != ebmlIDHeader || top[1].id != ebmlIDSegment {
+		return nil, fmt.Errorf("%w: not a WebM file", ErrUnsupported)
+	}
+	if in.header, err = readAt(input, top[0].offset, top[0].header+top[0].size); err != nil {
+		return nil, err
+	}
+	segment := top[1]
+	segmentEnd := input.Size()
+	if segment.size >= 0 {
+		segmentEnd = segment.offset + segment.header + segment.size
+	}
+	children, err := readEBMLElements(input, segment.offset+segment.header, segmentEnd)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.size < 0 {
+			return nil, fmt.Errorf("%w: element %X of unknown size", ErrUnsupported, child.id)
+		}
+		switch child.id {
+		case ebmlIDInfo:
+			if in.info, err = readAt(input, child.offset, child.header+child.size); err != nil {
+				return nil, err
+			}
+			if err := in.readTimecodeScale(); err != nil {
+				return nil, err
+			}
+		case ebmlIDTracks:
+			if in.tracks, err = readAt(input, child.offset, child.header+child.size); err != nil {
+				return nil, err
+			}
+		case ebmlIDCluster:
+			in.clusters = append(in.clusters, &webmCluster{input: in, element: child, time: -1})
+		}
+	}
+	if in.info == nil || in.tracks == nil {
+		return nil, fmt.Errorf("%w: missing Info or Tracks", ErrUnsupported)
+	}
+	for _, cluster := range in.clusters {
+		if err := cluster.readTime(); err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+func (in *webmInput) readTimecodeScale() error {
+	elements, err := parseEBMLElements(in.info)
+	if err != nil {
+		return err
+	}
+	info := elements[0].data(in.info)
+	children, err := parseEBMLElements(info)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.id == ebmlIDTimecodeScale {
+			in.timecodeScale = readEBMLUint(child.data(info))
+		}
+	}
+	return nil
+}
+
+// renumberTracks gives each track a new track number, starting from *next, returning the modified TrackEntry elements.
+// TrackUID is also changed to the track number, to make sure it is unique.
+func (in *webmInput) renumberTracks(next *uint64) ([][]byte, error) {
+	elements, err := parseEBMLElements(in.tracks)
+	if err != nil {
+		return nil, err
+	}
+	tracks := elements[0].data(in.tracks)
+	entries, err := parseEBMLElements(tracks)
+	if err != nil {
+		return nil, err
+	}
+	var result [][]byte
+	for _, entry := range entries {
+		if entry.id != ebmlIDTrackEntry {
+			continue
+		}
+		data := entry.data(tracks)
+		fields, err := parseEBMLElements(data)
+		if err != nil {
+			return nil, err
+		}
+		number := *next
+		var newFields [][]byte
+		found := false
+		for _, field := range fields {
+			switch field.id {
+			case ebmlIDTrackNumber:
+				in.trackNumbers[readEBMLUint(field.data(data))] = number
+				newFields = append(newFields, makeEBMLUint(ebmlIDTrackNumber, number))
+				found = true
+			case ebmlIDTrackUID:
+				newFields = append(newFields, makeEBMLUint(ebmlIDTrackUID, number))
+			default:
+				newFields = append(newFields, field.bytes(data))
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("track without TrackNumber")
+		}
+		// Block headers have room for track numbers that fit in a single byte without rewriting everything
+		if number > 126 {
+			return nil, fmt.Errorf("%w: too many tracks", ErrUnsupported)
+		}
+		result = append(result, makeEBMLElement(ebmlIDTrackEntry, newFields...))
+		*next++
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: no tracks", ErrUnsupported)
+	}
+	return result, nil
+}
+
+func (c *webmCluster) read() ([]byte, error) {
+	return readAt(c.input.r, c.element.offset+c.element.header, c.element.size)
+}
+
+func (c *webmCluster) readTime() error {
+	data, err := c.read()
+	if err != nil {
+		return err
+	}
+	children, err := parseEBMLElements(data)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.id == ebmlIDTimecode {
+			c.time = float64(readEBMLUint(child.data(data))) * float64(c.input.timecodeScale) / 1e9
+			break
+		}
+	}
+	return nil
+}
+
+// write outputs the cluster with its blocks changed to use the new track numbers.
+func (c *webmCluster) write(w io.Writer) error {
+	data, err := c.read()
+	if err != nil {
+		return err
+	}
+	children, err := parseEBMLElements(data)
+	if err != nil {
+		return err
+	}
+	var newChildren [][]byte
+	for _, child := range children {
+		switch child.id {
+		case ebmlIDPosition, ebmlIDPrevSize:
+			// These would be wrong in the output, and are optional
+		case ebmlIDSimpleBlock:
+			block, err := c.input.renumberBlock(child.data(data))
+			if err != nil {
+				return err
+			}
+			newChildren = append(newChildren, makeEBMLElement(ebmlIDSimpleBlock, block))
+		case ebmlIDBlockGroup:
+			group := child.data(data)
+			groupChildren, err := parseEBMLElements(group)
+			if err != nil {
+				return err
+			}
+			var newGroup [][]byte
+			for _, groupChild := range groupChildren {
+				if groupChild.id == ebmlIDBlock {
+					block, err := c.input.renumberBlock(groupChild.data(group))
+					if err != nil {
+						return err
+					}
+					newGroup = append(newGroup, makeEBMLElement(ebmlIDBlock, block))
+				} else {
+					newGroup = append(newGroup, groupChild.bytes(group))
+				}
+			}
+			newChildren = append(newChildren, makeEBMLElement(ebmlIDBlockGroup, newGroup...))
+		default:
+			newChildren = append(newChildren, child.bytes(data))
+		}
+	}
+	_, err = w.Write(makeEBMLElement(ebmlIDCluster, newChildren...))
+	return err
+}
+
+// renumberBlock replaces the track number at the start of the block.
+func (in *webmInput) renumberBlock(block []byte) ([]byte, error) {
+	length := vintLength(block)
+	if length == 0 || length > len(block) {
+		return nil, fmt.Errorf("invalid block")
+	}
+	old, _ := readVint(block[:length])
+	number, ok := in.trackNumbers[old]
+	if !ok {
+		return nil, fmt.Errorf("block for unknown track %d", old)
+	}
+	return append(appendVint(nil, number), block[length:]...), nil
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
 	"github.com/alanbriolat/video-archiver/internal/pubsub"
 	"github.com/alanbriolat/video-archiver/internal/sync_"
+	"github.com/alanbriolat/video-archiver/ratelimit"
 )
 
 var (
@@ -34,6 +38,7 @@ const (
 	DownloadStatusMatched     DownloadStatus = "matched"
 	DownloadStatusFetching    DownloadStatus = "fetching"
 	DownloadStatusReady       DownloadStatus = "ready"
+	DownloadStatusQueued      DownloadStatus = "queued"
 	DownloadStatusDownloading DownloadStatus = "downloading"
 	DownloadStatusComplete    DownloadStatus = "complete"
 	DownloadStatusError       DownloadStatus = "error"
@@ -42,6 +47,7 @@ const (
 var runningStatuses = generic.NewSet(
 	DownloadStatusMatching,
 	DownloadStatusFetching,
+	DownloadStatusQueued,
 	DownloadStatusDownloading,
 )
 
@@ -58,7 +64,7 @@ func (s DownloadStatus) NonRunning() DownloadStatus {
 		return DownloadStatusNew
 	case DownloadStatusFetching:
 		return DownloadStatusMatched
-	case DownloadStatusDownloading:
+	case DownloadStatusQueued, DownloadStatusDownloading:
 		return DownloadStatusReady
 	default:
 		return s
@@ -72,16 +78,48 @@ type DownloadPersistentState struct {
 	AddedAt  time.Time
 	Status   DownloadStatus
 	Error    string
+	// Lower priority downloads are taken from the queue first.
+	Priority int
+	// When the download was started, if it should be downloaded (or queued) whenever the session is running.
+	QueuedAt time.Time
+	// Maximum download rate in bytes per second, 0 for unlimited.
+	RateLimit int64
+	// Cookies to use for this download, instead of the session's cookies, if not empty.
+	CookieFile string
+	// Provider options, overriding the session's options.
+	Options video_archiver.Options
+	// Save metadata files alongside the download, in addition to Config.Sidecars.
+	Sidecars bool
+	// The download this one was added by, e.g. a playlist, if any.
+	ParentID DownloadID
+	// Number of consecutive failed attempts, and when the next automatic retry will happen (if it will).
+	Attempts    int
+	NextRetryAt time.Time
 
 	// Data from "match" stage
 	Provider string
+	// The URL that was matched, which is different from URL if following redirects and canonical links from URL led
+	// somewhere a better provider could match (see Config.MaxResolveHops).
+	ResolvedURL string
+	// How the provider writes the matched URL (see video_archiver.Source.URL), so that e.g. "https://youtu.be/X" and
+	// "https://www.youtube.com/watch?v=X" are known to be the same video.
+	SourceURL string
 
 	// Data from "fetch" stage
 	Name string
+	// Details of what will be downloaded, e.g. the chosen format, if the provider supplies them.
+	Metadata map[string]string
+
+	// Data from "download" stage, allowing partially downloaded files to be resumed
+	Resume []video_archiver.ResumeInfo
+	// Files saved by the download stage, e.g. the video and any captions or metadata files
+	Outputs []string
 }
 
 type DownloadEphemeralState struct {
 	Progress int
+	// Position in the download queue, starting from 1, or 0 if not queued.
+	QueuePosition int
 }
 
 type DownloadState struct {
@@ -120,6 +158,11 @@ type Download struct {
 	active         sync.WaitGroup
 	activeCancel   context.CancelFunc
 	activeFinished chan error
+
+	rateLimiter *ratelimit.Limiter
+
+	retryTimer *time.Timer
+	retryStage downloadStage
 }
 
 func newDownload(session *Session, state DownloadState) (*Download, error) {
@@ -141,8 +184,18 @@ func newDownload(session *Session, state DownloadState) (*Download, error) {
 
 		// Should only be one active background process, so channel buffer of 1 means it should never wait to exit
 		activeFinished: make(chan error, 1),
+
+		rateLimiter: ratelimit.New(state.RateLimit),
 	}
 	// TODO: do some additional state manipulation, e.g. setting Progress and "complete" event if status is complete
+	if !state.NextRetryAt.IsZero() {
+		// Retry whatever was happening before the session was closed
+		if state.QueuedAt.IsZero() {
+			d.scheduleRetry(state.NextRetryAt, downloadStageResolved)
+		} else {
+			d.scheduleRetry(state.NextRetryAt, downloadStageDownloaded)
+		}
+	}
 	go d.run()
 	return d, nil
 }
@@ -155,6 +208,23 @@ func (d *Download) String() string {
 	return fmt.Sprintf("Download{ID:\"%s\"}", d.state.ID)
 }
 
+// tempDir is the staging directory for the download's incomplete files, which is kept between runs of the download so
+// that they can be resumed.
+func (d *Download) tempDir() string {
+	return filepath.Join(d.session.config.TempPath, fmt.Sprintf("video-archiver-%v", d.state.ID))
+}
+
+// discardTempDir deletes the staging directory, e.g. because the download won't be resumed, so its partially downloaded
+// files (and the information needed to resume them) are no longer needed.
+func (d *Download) discardTempDir() {
+	if err := os.RemoveAll(d.tempDir()); err != nil {
+		d.log().Warnf("failed to delete temp dir: %v", err)
+	}
+	d.updateState(func(ds *DownloadState) {
+		ds.Resume = nil
+	})
+}
+
 func (d *Download) log() *zap.SugaredLogger {
 	return zap.S().Named(fmt.Sprintf("download/%v", d.state.ID))
 }
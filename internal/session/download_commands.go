@@ -45,6 +45,15 @@ func (d *Download) Stop() {
 	}
 }
 
+// SetRateLimit changes the maximum download rate in bytes per second (0 for unlimited), taking effect immediately if
+// the download is in progress.
+func (d *Download) SetRateLimit(rate int64) {
+	d.updateState(func(ds *DownloadState) {
+		ds.RateLimit = rate
+	})
+	d.rateLimiter.SetRate(rate)
+}
+
 func (d *Download) Running() <-chan struct{} {
 	return d.running.Wait()
 }
@@ -3,7 +3,9 @@ package session
 import (
 	"context"
 	"math/rand"
+	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
@@ -29,10 +31,19 @@ func (d *Download) run() {
 			}
 		// Download.Start()
 		case stage := <-d.startCommand:
+			d.cancelRetry()
 			d.start(stage)
 		// Download.Stop()
 		case <-d.stopCommand:
+			d.cancelRetry()
+			d.dequeue()
 			d.stop(nil)
+			// Explicitly stopped, so it won't be resumed
+			d.discardTempDir()
+		// Automatic retry after failure
+		case <-d.retryChannel():
+			d.retryTimer = nil
+			d.start(d.retryStage)
 		// Active download goroutine exiting
 		case err := <-d.activeFinished:
 			d.stop(err)
@@ -41,12 +52,22 @@ func (d *Download) run() {
 }
 
 func (d *Download) close() {
+	if d.retryTimer != nil {
+		d.retryTimer.Stop()
+	}
 	d.stop(nil)
 	d.events.Close()
 }
 
 func (d *Download) start(stage downloadStage) {
 	d.setTargetStage(stage)
+	if stage == downloadStageDownloaded {
+		d.updateState(func(ds *DownloadState) {
+			if ds.QueuedAt.IsZero() {
+				ds.QueuedAt = time.Now()
+			}
+		})
+	}
 	if !d.stopped.Clear() {
 		// Already running (or being started) so nothing to do
 		return
@@ -69,7 +90,7 @@ func (d *Download) start(stage downloadStage) {
 }
 
 func (d *Download) stop(err error) {
-	d.setTargetStage(downloadStageUndefined)
+	stage := d.setTargetStage(downloadStageUndefined)
 	if !d.running.Clear() {
 		// Not running (or already stopping) so nothing to do
 		return
@@ -86,7 +107,21 @@ func (d *Download) stop(err error) {
 		d.updateState(func(ds *DownloadState) {
 			ds.Error = err.Error()
 			ds.Status = DownloadStatusError
+			ds.Attempts++
+			if delay, ok := d.session.config.RetryPolicy.NextDelay(err, ds.Attempts); ok {
+				ds.NextRetryAt = time.Now().Add(delay)
+			} else {
+				ds.NextRetryAt = time.Time{}
+				ds.QueuedAt = time.Time{}
+			}
 		})
+		if state := d.getState(); !state.NextRetryAt.IsZero() {
+			d.log().Infof("retrying at %v after %d attempt(s)", state.NextRetryAt, state.Attempts)
+			d.scheduleRetry(state.NextRetryAt, stage)
+		} else {
+			// Failed permanently, so it won't be resumed
+			d.discardTempDir()
+		}
 	} else {
 		d.updateState(func(ds *DownloadState) {
 			ds.Status = ds.Status.NonRunning()
@@ -99,6 +134,78 @@ func (d *Download) stop(err error) {
 	d.events.Send(DownloadStopped{downloadEvent{d}, err})
 }
 
+// scheduleRetry arranges for the download to be automatically started at the specified time, replacing any previously
+// scheduled retry.
+func (d *Download) scheduleRetry(at time.Time, stage downloadStage) {
+	if d.retryTimer != nil {
+		d.retryTimer.Stop()
+	}
+	d.retryTimer = time.NewTimer(time.Until(at))
+	d.retryStage = stage
+}
+
+// cancelRetry stops any scheduled retry, e.g. because the download was explicitly started or stopped, and resets the
+// count of failed attempts.
+func (d *Download) cancelRetry() {
+	if d.retryTimer != nil {
+		d.retryTimer.Stop()
+		d.retryTimer = nil
+	}
+	d.updateState(func(ds *DownloadState) {
+		ds.Attempts = 0
+		ds.NextRetryAt = time.Time{}
+	})
+}
+
+func (d *Download) retryChannel() <-chan time.Time {
+	if d.retryTimer == nil {
+		return nil
+	}
+	return d.retryTimer.C
+}
+
+// dequeue forgets that the download was started, so it won't be queued again when the session restarts.
+func (d *Download) dequeue() {
+	d.updateState(func(ds *DownloadState) {
+		ds.QueuedAt = time.Time{}
+	})
+}
+
+// waitForSlot waits in the queue until the download is allowed to continue, returning a function to release the slot.
+// If the download has to wait and setQueued is true, the status is changed to DownloadStatusQueued.
+func (d *Download) waitForSlot(ctx context.Context, q *queue, setQueued bool) (func(), error) {
+	state := d.getState()
+	priority, queuedAt := state.Priority, state.QueuedAt
+	if queuedAt.IsZero() {
+		queuedAt = time.Now()
+	}
+	defer d.updateState(func(ds *DownloadState) {
+		ds.QueuePosition = 0
+	})
+	return q.acquire(ctx, priority, queuedAt, func(position int) {
+		d.updateState(func(ds *DownloadState) {
+			if setQueued {
+				ds.Status = DownloadStatusQueued
+			}
+			ds.QueuePosition = position
+		})
+	})
+}
+
+// httpClient returns the session's http.Client, or a copy of it with different cookies if cookieFile is set.
+func (d *Download) httpClient(cookieFile string) (*http.Client, error) {
+	if cookieFile == "" {
+		return d.session.httpClient, nil
+	}
+	jar, err := video_archiver.LoadCookieJar(cookieFile)
+	if err != nil {
+		return nil, err
+	}
+	client := *d.session.httpClient
+	client.Jar = jar
+	return &client, nil
+}
+
 func (d *Download) getState() DownloadState {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -108,14 +215,15 @@ func (d *Download) getState() DownloadState {
 func (d *Download) updateState(f func(ds *DownloadState)) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	// Note: f must replace rather than modify any slices in the state, otherwise changes won't be detected
 	old := d.state
 	f(&d.state)
 	if d.state.Status == DownloadStatusComplete {
 		d.state.Progress = 100
 		d.complete.Set()
 	}
-	if d.state != old {
-		if d.state.DownloadPersistentState != old.DownloadPersistentState {
+	if !reflect.DeepEqual(d.state, old) {
+		if !reflect.DeepEqual(d.state.DownloadPersistentState, old.DownloadPersistentState) {
 			generic.Unwrap_(d.session.config.Database.WriteDownload(&d.state.DownloadPersistentState))
 		}
 		d.events.Send(DownloadUpdated{
@@ -126,10 +234,13 @@ func (d *Download) updateState(f func(ds *DownloadState)) {
 	}
 }
 
-func (d *Download) setTargetStage(stage downloadStage) {
+// setTargetStage changes the stage the download should stop at, returning the previous target stage.
+func (d *Download) setTargetStage(stage downloadStage) downloadStage {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	old := d.targetStage
 	d.targetStage = stage
+	return old
 }
 
 func (d *Download) shouldRunStage(stage downloadStage) bool {
@@ -138,16 +249,78 @@ func (d *Download) shouldRunStage(stage downloadStage) bool {
 	return stage <= d.targetStage
 }
 
+// match finds the provider for the download, returning the match and the URL that was matched. Once the provider is
+// known it is used again, with the URL it matched. Otherwise the URL is also resolved (see Config.MaxResolveHops), and
+// whichever of the original and resolved URLs matches the higher priority provider is used, so that e.g. a shortened
+// link to a video isn't just saved as a web page.
+func (d *Download) match(ctx context.Context, provider string, url string, resolvedURL string, cookieFile string) (*video_archiver.Match, string, error) {
+	logger := d.log()
+	registry := d.session.config.ProviderRegistry
+	if provider != "" {
+		if resolvedURL != "" {
+			url = resolvedURL
+		}
+		logger.Debugf("matching using provider: '%v'", provider)
+		match, err := registry.MatchWith(provider, url)
+		return match, url, err
+	}
+
+	logger.Debug("matching with any provider")
+	match, err := registry.Match(url)
+	if d.session.config.MaxResolveHops <= 0 {
+		return match, url, err
+	}
+	httpClient, clientErr := d.httpClient(cookieFile)
+	if clientErr != nil {
+		return nil, "", video_archiver.Permanent(clientErr)
+	}
+	resolved, resolveErr := video_archiver.ResolveURL(video_archiver.WithHTTPClient(ctx, httpClient), url, d.session.config.MaxResolveHops)
+	if resolveErr != nil {
+		if err != nil {
+			return nil, "", resolveErr
+		}
+		// The URL might still work with the provider that matched it
+		logger.Warnf("failed to resolve URL: %v", resolveErr)
+		return match, url, nil
+	}
+	if resolved == url {
+		return match, url, err
+	}
+	logger.Debugf("resolved URL to %v", resolved)
+	resolvedMatch, resolvedErr := registry.Match(resolved)
+	if resolvedErr != nil {
+		return match, url, err
+	}
+	if err == nil {
+		priority, _ := registry.GetPriority(match.ProviderName)
+		resolvedPriority, _ := registry.GetPriority(resolvedMatch.ProviderName)
+		if priority < resolvedPriority {
+			return match, url, nil
+		}
+	}
+	return resolvedMatch, resolved, nil
+}
+
 func (d *Download) runInBackground(ctx context.Context) error {
 	logger := d.log()
 
 	var provider string
 	var url string
+	var resolvedURL string
 	var savePath string
+	var resume []video_archiver.ResumeInfo
+	var cookieFile string
+	var options video_archiver.Options
+	var sidecars bool
 	d.updateState(func(ds *DownloadState) {
 		provider = ds.Provider
 		url = ds.URL
+		resolvedURL = ds.ResolvedURL
 		savePath = ds.SavePath
+		resume = ds.Resume
+		cookieFile = ds.CookieFile
+		options = ds.Options
+		sidecars = ds.Sidecars || d.session.config.Sidecars
 		ds.Status = DownloadStatusNew
 		ds.Error = ""
 	})
@@ -158,20 +331,14 @@ func (d *Download) runInBackground(ctx context.Context) error {
 	d.updateState(func(ds *DownloadState) {
 		ds.Status = DownloadStatusMatching
 	})
-	var match *video_archiver.Match
-	var err error
-	if provider != "" {
-		logger.Debugf("matching using provider: '%v'", provider)
-		match, err = d.session.config.ProviderRegistry.MatchWith(provider, url)
-	} else {
-		logger.Debug("matching with any provider")
-		match, err = d.session.config.ProviderRegistry.Match(url)
-	}
+	match, matchedURL, err := d.match(ctx, provider, url, resolvedURL, cookieFile)
 	if err == nil {
 		logger.Debugf("match successful with provider: '%v'", match.ProviderName)
 		d.updateState(func(ds *DownloadState) {
 			ds.Status = DownloadStatusMatched
 			ds.Provider = match.ProviderName
+			ds.ResolvedURL = matchedURL
+			ds.SourceURL = match.Source.URL()
 		})
 	} else {
 		logger.Errorf("failed to match: %v", err)
@@ -181,6 +348,20 @@ func (d *Download) runInBackground(ctx context.Context) error {
 	if !d.shouldRunStage(downloadStageResolved) {
 		return nil
 	}
+	httpClient, err := d.httpClient(cookieFile)
+	if err != nil {
+		logger.Errorf("failed to create HTTP client: %v", err)
+		return video_archiver.Permanent(err)
+	}
+	ctx = video_archiver.WithOptions(video_archiver.WithHTTPClient(ctx, httpClient), options)
+	if sidecars {
+		ctx = video_archiver.WithOptions(ctx, video_archiver.Options{video_archiver.OptionSidecars: "true"})
+	}
+	releaseRecon, err := d.waitForSlot(ctx, d.session.reconQueue, false)
+	if err != nil {
+		return err
+	}
+	defer releaseRecon()
 	d.updateState(func(ds *DownloadState) {
 		ds.Status = DownloadStatusFetching
 	})
@@ -191,21 +372,77 @@ func (d *Download) runInBackground(ctx context.Context) error {
 		d.updateState(func(ds *DownloadState) {
 			ds.Status = DownloadStatusReady
 			ds.Name = resolved.String()
+			if m, ok := resolved.(video_archiver.MetadataSource); ok {
+				ds.Metadata = m.Metadata()
+			}
 		})
 	} else {
 		logger.Errorf("failed to recon: %v", err)
 		return err
 	}
+	collection, isCollection := resolved.(video_archiver.CollectionSource)
+	if isCollection {
+		added, err := d.session.addChildDownloads(d.getState().DownloadPersistentState, collection.Children())
+		if err != nil {
+			logger.Errorf("failed to add child downloads: %v", err)
+			return err
+		}
+		logger.Debugf("added %d new child download(s)", len(added))
+	}
+	releaseRecon()
 
 	if !d.shouldRunStage(downloadStageDownloaded) {
 		return nil
 	}
+	if isCollection {
+		// Nothing to download, just start all of the children that aren't already complete
+		for _, child := range d.session.childDownloads(d.ID()) {
+			if !child.IsComplete() {
+				child.Start()
+			}
+		}
+		d.updateState(func(ds *DownloadState) {
+			ds.Status = DownloadStatusComplete
+			ds.QueuedAt = time.Time{}
+			ds.Attempts = 0
+			ds.NextRetryAt = time.Time{}
+		})
+		return nil
+	}
+	releaseDownload, err := d.waitForSlot(ctx, d.session.downloadQueue, true)
+	if err != nil {
+		return err
+	}
+	defer releaseDownload()
 	prefix := strings.TrimRight(savePath, string(os.PathSeparator)) + string(os.PathSeparator)
 	// Prevent stampede from a lot of downloads starting at the same time always updating at the same time
 	nextUpdate := time.Now().Add(time.Duration(rand.Int63n(int64(d.session.config.ProgressUpdateInterval))))
 	builder := video_archiver.NewDownloadBuilder().
 		WithTargetPrefix(prefix).
+		WithTempDir(d.tempDir()).
+		WithKeepTempDir(true).
+		WithHTTPClient(httpClient).
+		WithRateLimiter(d.session.rateLimiter).
+		WithRateLimiter(d.rateLimiter).
 		WithContext(ctx).
+		WithResumeInfo(resume...).
+		WithResumeCallback(func(info []video_archiver.ResumeInfo) {
+			d.updateState(func(ds *DownloadState) {
+				ds.Resume = info
+			})
+		}).
+		WithFileCallback(func(path string) {
+			d.updateState(func(ds *DownloadState) {
+				outputs := make([]string, 0, len(ds.Outputs)+1)
+				for _, output := range ds.Outputs {
+					if output != path {
+						outputs = append(outputs, output)
+					}
+				}
+				ds.Outputs = append(outputs, path)
+			})
+			d.events.Send(DownloadFileComplete{downloadEvent{d}, path})
+		}).
 		WithProgressCallback(func(downloaded int, expected int) {
 			now := time.Now()
 			if now.Before(nextUpdate) {
@@ -224,29 +461,46 @@ func (d *Download) runInBackground(ctx context.Context) error {
 		})
 	d.updateState(func(ds *DownloadState) {
 		ds.Status = DownloadStatusDownloading
+		ds.Outputs = nil
 	})
 	logger.Debug("starting download")
 	err = func() error {
-		if download, err := builder.Build(); err != nil {
+		download, err := builder.Build()
+		if err != nil {
 			logger.Errorf("failed to create download: %v", err)
 			return err
-		} else if err = resolved.Download(download); err != nil {
+		}
+		defer func() {
+			if err := download.Close(); err != nil {
+				logger.Warnf("failed to clean up download: %v", err)
+			}
+		}()
+		if err = resolved.Download(download); err != nil {
 			logger.Errorf("failed to download: %v", err)
 			return err
-		} else {
-			logger.Debug("download successful")
-			return nil
+		} else if info, ok := resolved.(video_archiver.InfoSource); ok && sidecars {
+			if err = video_archiver.WriteSidecars(download, info.Info()); err != nil {
+				logger.Errorf("failed to write metadata files: %v", err)
+				return err
+			}
+		}
+		if err = download.Commit(); err != nil {
+			logger.Errorf("failed to move downloaded files into place: %v", err)
+			return err
 		}
+		return nil
 	}()
-	if err == nil {
-		logger.Debug("download successful")
-		d.updateState(func(ds *DownloadState) {
-			ds.Status = DownloadStatusComplete
-		})
-	} else {
-		logger.Errorf("failed to download: %v", err)
+	if err != nil {
+		// Already logged by whichever step failed
 		return err
 	}
+	logger.Debug("download successful")
+	d.updateState(func(ds *DownloadState) {
+		ds.Status = DownloadStatusComplete
+		ds.QueuedAt = time.Time{}
+		ds.Attempts = 0
+		ds.NextRetryAt = time.Time{}
+	})
 
 	return nil
 }
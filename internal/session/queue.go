@@ -0,0 +1,199 @@
+package session
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A queue limits how many downloads can be in a particular stage at the same time. Downloads wait for a slot in
+// priority order (lower first), and then in the order they were queued.
+type queue struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	seq     uint64
+	waiting []*queueEntry
+	// Entries whose position has changed, to be notified once the lock is released (see unlock)
+	changed []*queueEntry
+	// Signalled when an entry stops notifying
+	notified *sync.Cond
+}
+
+type queueEntry struct {
+	priority   int
+	queuedAt   time.Time
+	seq        uint64
+	position   int
+	onPosition func(int)
+	ready      chan struct{}
+	// The last position passed to onPosition, and whether onPosition is being called
+	lastPosition int
+	notifying    bool
+}
+
+// newQueue creates a queue allowing limit concurrent slots, or unlimited if limit <= 0.
+func newQueue(limit int) *queue {
+	q := &queue{limit: limit}
+	q.notified = sync.NewCond(&q.mu)
+	return q
+}
+
+// acquire waits until there is a free slot, returning a function that must be called to release it. While waiting,
+// onPosition is called with the 1-based position in the queue every time it changes.
+func (q *queue) acquire(ctx context.Context, priority int, queuedAt time.Time, onPosition func(int)) (func(), error) {
+	q.mu.Lock()
+	if q.hasFreeSlot() && len(q.waiting) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	}
+	q.seq++
+	e := &queueEntry{
+		priority:   priority,
+		queuedAt:   queuedAt,
+		seq:        q.seq,
+		onPosition: onPosition,
+		ready:      make(chan struct{}),
+	}
+	q.waiting = append(q.waiting, e)
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		return q.waiting[i].before(q.waiting[j])
+	})
+	q.updatePositions()
+	q.unlock()
+
+	select {
+	case <-e.ready:
+		q.mu.Lock()
+		q.waitNotified(e)
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		select {
+		case <-e.ready:
+			// Got a slot at the same time as being cancelled, so give it back
+			q.release()
+		default:
+			q.remove(e)
+		}
+		q.waitNotified(e)
+		q.unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// len returns the number of downloads waiting for a slot.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func (q *queue) hasFreeSlot() bool {
+	return q.limit <= 0 || q.active < q.limit
+}
+
+func (q *queue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.release()
+			q.unlock()
+		})
+	}
+}
+
+// release gives up a slot, handing out free slots to waiting downloads. Must be called with the lock held.
+func (q *queue) release() {
+	q.active--
+	if len(q.waiting) == 0 || !q.hasFreeSlot() {
+		return
+	}
+	for len(q.waiting) > 0 && q.hasFreeSlot() {
+		e := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		e.position = 0
+		close(e.ready)
+	}
+	q.updatePositions()
+}
+
+// remove takes a download out of the queue without giving it a slot. Must be called with the lock held.
+func (q *queue) remove(e *queueEntry) {
+	for i, other := range q.waiting {
+		if other == e {
+			q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+			e.position = 0
+			q.updatePositions()
+			return
+		}
+	}
+}
+
+// updatePositions records the new position of each waiting download, to be notified by unlock. Must be called with
+// the lock held.
+func (q *queue) updatePositions() {
+	for i, e := range q.waiting {
+		if position := i + 1; position != e.position {
+			e.position = position
+			if e.onPosition != nil {
+				q.changed = append(q.changed, e)
+			}
+		}
+	}
+}
+
+// unlock releases the lock and then notifies waiting downloads whose position has changed, so that onPosition can
+// take as long as it likes (or use the queue) without holding up the queue.
+func (q *queue) unlock() {
+	changed := q.changed
+	q.changed = nil
+	q.mu.Unlock()
+	for _, e := range changed {
+		q.notify(e)
+	}
+}
+
+// notify calls onPosition until it has been given the entry's current position. If onPosition is already being
+// called for the entry (by another goroutine, or further up the stack), that call picks up the change instead, so the
+// last position given is always the current one.
+func (q *queue) notify(e *queueEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e.notifying {
+		return
+	}
+	e.notifying = true
+	for e.position > 0 && e.position != e.lastPosition {
+		position := e.position
+		e.lastPosition = position
+		q.mu.Unlock()
+		e.onPosition(position)
+		q.mu.Lock()
+	}
+	e.notifying = false
+	q.notified.Broadcast()
+}
+
+// waitNotified waits until onPosition isn't being called for an entry that has left the queue, so that it won't be
+// called again after acquire returns. Must be called with the lock held.
+func (q *queue) waitNotified(e *queueEntry) {
+	for e.notifying {
+		q.notified.Wait()
+	}
+}
+
+func (e *queueEntry) before(other *queueEntry) bool {
+	if e.priority != other.priority {
+		return e.priority < other.priority
+	} else if !e.queuedAt.Equal(other.queuedAt) {
+		return e.queuedAt.Before(other.queuedAt)
+	} else {
+		return e.seq < other.seq
+	}
+}
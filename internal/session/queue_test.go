@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestQueue(t *testing.T) {
+	assert := assert_.New(t)
+	ctx := context.Background()
+	q := newQueue(2)
+	now := time.Now()
+
+	// Slots are handed out immediately while available
+	release1 := generic.Unwrap(q.acquire(ctx, 0, now, nil))
+	release2 := generic.Unwrap(q.acquire(ctx, 0, now, nil))
+	assert.Equal(0, q.len())
+
+	// Further downloads wait, ordered by priority then queue time
+	var mu sync.Mutex
+	positions := make(map[string][]int)
+	type granted struct {
+		name    string
+		release func()
+	}
+	order := make(chan granted, 4)
+	wait := func(ctx context.Context, name string, priority int, queuedAt time.Time) {
+		go func() {
+			release, err := q.acquire(ctx, priority, queuedAt, func(position int) {
+				mu.Lock()
+				defer mu.Unlock()
+				positions[name] = append(positions[name], position)
+			})
+			if err == nil {
+				order <- granted{name, release}
+			} else {
+				order <- granted{"cancelled " + name, nil}
+			}
+		}()
+		assert.Eventually(func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(positions[name]) > 0
+		}, time.Second, time.Millisecond)
+	}
+	wait(ctx, "late", 0, now.Add(2*time.Second))
+	wait(ctx, "early", 0, now.Add(time.Second))
+	wait(ctx, "urgent", -1, now.Add(3*time.Second))
+	cancelCtx, cancel := context.WithCancel(ctx)
+	wait(cancelCtx, "impatient", 0, now.Add(4*time.Second))
+	assert.Equal(4, q.len())
+
+	cancel()
+	assert.Equal("cancelled impatient", (<-order).name)
+	assert.Equal(3, q.len())
+
+	release1()
+	urgent := <-order
+	assert.Equal("urgent", urgent.name)
+	release2()
+	early := <-order
+	assert.Equal("early", early.name)
+	urgent.release()
+	late := <-order
+	assert.Equal("late", late.name)
+	assert.Equal(0, q.len())
+	early.release()
+	late.release()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal([]int{1}, positions["urgent"])
+	assert.Equal([]int{1, 2, 1}, positions["early"])
+	assert.Equal([]int{1, 2, 3, 2, 1}, positions["late"])
+	assert.Equal([]int{4}, positions["impatient"])
+}
+
+func TestQueueUnlimited(t *testing.T) {
+	assert := assert_.New(t)
+	q := newQueue(0)
+	for i := 0; i < 100; i++ {
+		_, err := q.acquire(context.Background(), 0, time.Now(), nil)
+		assert.NoError(err)
+	}
+	assert.Equal(0, q.len())
+}
+
+func TestQueueCallback(t *testing.T) {
+	assert := assert_.New(t)
+	q := newQueue(1)
+	release := generic.Unwrap(q.acquire(context.Background(), 0, time.Now(), nil))
+
+	// The callback is called without the queue locked, so it can use the queue
+	var lengths []int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		release := generic.Unwrap(q.acquire(context.Background(), 0, time.Now(), func(int) {
+			lengths = append(lengths, q.len())
+		}))
+		release()
+	}()
+	assert.Eventually(func() bool { return q.len() == 1 }, time.Second, time.Millisecond)
+	release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for slot")
+	}
+	assert.Equal([]int{1}, lengths)
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// A RetryPolicy decides whether and when a download that failed should be automatically retried.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first, before giving up. 1 or less means never retry.
+	MaxAttempts int
+	// Delay before the first retry.
+	InitialDelay time.Duration
+	// Maximum delay between attempts, unless the server asks for longer (e.g. HTTP 429 with Retry-After).
+	MaxDelay time.Duration
+	// Delay is multiplied by this after each attempt.
+	Multiplier float64
+	// Randomise delays by up to this fraction either way, e.g. 0.2 for ±20%, so that downloads that failed at the same
+	// time don't all retry at the same time.
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 10 * time.Second,
+	MaxDelay:     10 * time.Minute,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// NextDelay returns how long to wait before the next attempt, given the error from the latest of a number of failed
+// attempts, or false if the download shouldn't be retried.
+func (p RetryPolicy) NextDelay(err error, attempts int) (time.Duration, bool) {
+	if attempts >= p.MaxAttempts || !video_archiver.IsTransient(err) {
+		return 0, false
+	}
+	delay := float64(p.InitialDelay) * math.Pow(math.Max(p.Multiplier, 1), float64(attempts-1))
+	if p.MaxDelay > 0 {
+		delay = math.Min(delay, float64(p.MaxDelay))
+	}
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	if retryAfter, ok := video_archiver.RetryAfter(err); ok && float64(retryAfter) > delay {
+		return retryAfter, true
+	}
+	return time.Duration(delay), true
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	assert := assert_.New(t)
+	policy := RetryPolicy{
+		MaxAttempts:  4,
+		InitialDelay: time.Second,
+		MaxDelay:     3 * time.Second,
+		Multiplier:   2,
+	}
+	transient := video_archiver.Transient(errors.New("connection reset"))
+
+	delays := make([]time.Duration, 0)
+	for attempts := 1; ; attempts++ {
+		delay, ok := policy.NextDelay(transient, attempts)
+		if !ok {
+			break
+		}
+		delays = append(delays, delay)
+	}
+	assert.Equal([]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, delays)
+
+	_, ok := policy.NextDelay(video_archiver.Permanent(errors.New("not found")), 1)
+	assert.False(ok)
+
+	// Server can ask for longer than the policy would wait
+	delay, ok := policy.NextDelay(video_archiver.TransientAfter(errors.New("slow down"), time.Hour), 1)
+	assert.True(ok)
+	assert.Equal(time.Hour, delay)
+
+	// Jitter stays within bounds
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay, _ := policy.NextDelay(transient, 1)
+		assert.GreaterOrEqual(delay, 500*time.Millisecond)
+		assert.LessOrEqual(delay, 1500*time.Millisecond)
+	}
+}
@@ -2,6 +2,9 @@ package session
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -11,21 +14,47 @@ import (
 	"github.com/alanbriolat/video-archiver/generic"
 	"github.com/alanbriolat/video-archiver/internal/pubsub"
 	"github.com/alanbriolat/video-archiver/internal/sync_"
+	"github.com/alanbriolat/video-archiver/ratelimit"
 )
 
 type Config struct {
-	DefaultSavePath  string
-	Database         Database
+	DefaultSavePath string
+	// Directory in which each download gets a staging directory for incomplete files.
+	TempPath string
+	Database Database
+	// Providers used to match downloads. The session uses its own clone of it, see Session.ProviderRegistry.
 	ProviderRegistry *video_archiver.ProviderRegistry
+	// How many HTTP redirects and canonical links to follow to find where a URL really points before matching it (e.g.
+	// for a link shortener), see video_archiver.ResolveURL. This costs an extra request for every new download, so is
+	// off by default: 0 means URLs are matched as they are.
+	MaxResolveHops int
 	// Minimum interval between DownloadUpdated events from progress updates.
 	ProgressUpdateInterval time.Duration
+	// Maximum number of downloads actively downloading at the same time; others will be "queued". 0 means unlimited.
+	MaxConcurrentDownloads int
+	// Maximum number of downloads fetching information at the same time. 0 means unlimited.
+	MaxConcurrentRecon int
+	// Maximum total download rate in bytes per second. 0 means unlimited.
+	RateLimit int64
+	// How to automatically retry downloads that failed for reasons that might be temporary.
+	RetryPolicy RetryPolicy
+	// How HTTP requests are made, both by providers and while downloading.
+	HTTP video_archiver.HTTPConfig
+	// Provider options (e.g. "youtube.max-height") for all downloads, which can be overridden per download.
+	Options video_archiver.Options
+	// Save metadata files (info.json, description, thumbnail) alongside every download, if the provider supports it.
+	Sidecars bool
 }
 
 var DefaultConfig = Config{
 	DefaultSavePath:        ".",
+	TempPath:               os.TempDir(),
 	Database:               NilDatabase{},
 	ProviderRegistry:       &video_archiver.DefaultProviderRegistry,
 	ProgressUpdateInterval: 500 * time.Millisecond,
+	MaxConcurrentDownloads: 3,
+	MaxConcurrentRecon:     5,
+	RetryPolicy:            DefaultRetryPolicy,
 }
 
 type downloadsByID = map[DownloadID]*Download
@@ -38,9 +67,24 @@ type Session struct {
 
 	downloads *sync_.RWMutexed[downloadsByID]
 	events    pubsub.Publisher[Event]
+	// Held while adding child downloads, so the same URL can't be added twice
+	childrenMu sync.Mutex
+
+	downloadQueue *queue
+	reconQueue    *queue
+	rateLimiter   *ratelimit.Limiter
+	httpClient    *http.Client
 }
 
 func New(config Config, ctx context.Context) (*Session, error) {
+	httpClient, err := config.HTTP.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP config: %w", err)
+	}
+	config.ProviderRegistry = config.ProviderRegistry.Clone()
+	// Everything derived from the session context, i.e. every download, uses the same http.Client, options and providers
+	ctx = video_archiver.WithOptions(video_archiver.WithHTTPClient(ctx, httpClient), config.Options)
+	ctx = video_archiver.WithProviderRegistry(ctx, config.ProviderRegistry)
 	ctx, cancel := context.WithCancel(ctx)
 	s := &Session{
 		config:    config,
@@ -49,6 +93,11 @@ func New(config Config, ctx context.Context) (*Session, error) {
 		log:       zap.S().Named("session"),
 
 		downloads: sync_.NewRWMutexed(make(downloadsByID)),
+
+		downloadQueue: newQueue(config.MaxConcurrentDownloads),
+		reconQueue:    newQueue(config.MaxConcurrentRecon),
+		rateLimiter:   ratelimit.New(config.RateLimit),
+		httpClient:    httpClient,
 	}
 	s.events = pubsub.NewPublisher[Event]()
 	// Asynchronously load existing downloads from the database; as long as client code does Subscribe before
@@ -56,8 +105,14 @@ func New(config Config, ctx context.Context) (*Session, error) {
 	go func() {
 		for _, state := range generic.Unwrap(s.config.Database.ListDownloads()) {
 			ds := DownloadState{DownloadPersistentState: state}
+			// Nothing can be running yet, regardless of what was saved
+			ds.Status = ds.Status.NonRunning()
 			// TODO: eliminate the unnecessary write-back to the database this causes?
-			_ = generic.Unwrap(s.insertDownload(ds))
+			d := generic.Unwrap(s.insertDownload(ds))
+			// Restore the download queue from before the session was closed, unless it's waiting to be retried
+			if !ds.QueuedAt.IsZero() && ds.NextRetryAt.IsZero() {
+				d.Start()
+			}
 		}
 	}()
 	return s, nil
@@ -87,6 +142,18 @@ func (s *Session) GetDownload(id DownloadID) (d *Download) {
 	return d
 }
 
+// SetRateLimit changes the maximum total download rate in bytes per second (0 for unlimited), including for downloads
+// that are already in progress.
+func (s *Session) SetRateLimit(rate int64) {
+	s.rateLimiter.SetRate(rate)
+}
+
+// ProviderRegistry is the session's own view of the providers it was configured with, which can be changed (e.g. to
+// disable a provider) without affecting any other session.
+func (s *Session) ProviderRegistry() *video_archiver.ProviderRegistry {
+	return s.config.ProviderRegistry
+}
+
 func (s *Session) Close() {
 	s.ctxCancel()
 	downloads := s.downloads.Swap(nil)
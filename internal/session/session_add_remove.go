@@ -2,14 +2,28 @@ package session
 
 import (
 	"errors"
+	"os"
+	"sort"
 	"time"
 
+	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
 )
 
 type AddDownloadOptions struct {
 	// Override download save path; if not set (empty), will use the Session's save path.
 	SavePath string
+	// Priority in the download queue, lower first.
+	Priority int
+	// Maximum download rate in bytes per second, in addition to the session-wide limit. 0 means unlimited.
+	RateLimit int64
+	// Netscape-format cookies.txt file to use instead of the session's cookies, e.g. for a site that needs to be
+	// logged in to.
+	CookieFile string
+	// Provider options (e.g. "youtube.max-height"), overriding the session's options.
+	Options video_archiver.Options
+	// Save metadata files alongside this download, even if not enabled for the whole session (see Config.Sidecars).
+	Sidecars bool
 }
 
 func (s *Session) AddDownload(url string, opt *AddDownloadOptions) (*Download, error) {
@@ -25,10 +39,70 @@ func (s *Session) AddDownload(url string, opt *AddDownloadOptions) (*Download, e
 	} else {
 		ds.SavePath = s.config.DefaultSavePath
 	}
+	ds.Priority = opt.Priority
+	ds.RateLimit = opt.RateLimit
+	ds.CookieFile = opt.CookieFile
+	ds.Options = opt.Options.Clone()
+	ds.Sidecars = opt.Sidecars
 	ds.AddedAt = time.Now()
 	return s.insertDownload(ds)
 }
 
+// addChildDownloads adds a download for each child of a collection (e.g. each video in a playlist), with the same
+// settings as the parent, unless there is already a download for the same item, i.e. one that was added with, resolved
+// to or matched as the child's URL. Returns the new downloads.
+func (s *Session) addChildDownloads(parent DownloadPersistentState, children []video_archiver.Source) ([]*Download, error) {
+	s.childrenMu.Lock()
+	defer s.childrenMu.Unlock()
+	existing := generic.NewSet[string]()
+	for _, d := range s.ListDownloads() {
+		state := d.getState()
+		for _, url := range []string{state.URL, state.ResolvedURL, state.SourceURL} {
+			if url != "" {
+				existing.Add(url)
+			}
+		}
+	}
+	var added []*Download
+	for _, child := range children {
+		if !existing.Add(child.URL()) {
+			continue
+		}
+		ds := DownloadState{}
+		ds.ID = NewDownloadID()
+		ds.URL = child.URL()
+		ds.Status = DownloadStatusNew
+		ds.SavePath = parent.SavePath
+		ds.Priority = parent.Priority
+		ds.RateLimit = parent.RateLimit
+		ds.CookieFile = parent.CookieFile
+		ds.Options = parent.Options.Clone()
+		ds.Sidecars = parent.Sidecars
+		ds.ParentID = parent.ID
+		ds.AddedAt = time.Now()
+		d, err := s.insertDownload(ds)
+		if err != nil {
+			return added, err
+		}
+		added = append(added, d)
+	}
+	return added, nil
+}
+
+// childDownloads gets the downloads that were added by the parent download, in the order they were added.
+func (s *Session) childDownloads(parentID DownloadID) []*Download {
+	var children []*Download
+	for _, d := range s.ListDownloads() {
+		if d.getState().ParentID == parentID {
+			children = append(children, d)
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].getState().AddedAt.Before(children[j].getState().AddedAt)
+	})
+	return children
+}
+
 func (s *Session) insertDownload(ds DownloadState) (*Download, error) {
 	id := ds.ID
 	d, err := newDownload(s, ds)
@@ -61,6 +135,10 @@ func (s *Session) RemoveDownload(id DownloadID) error {
 			if err := d.session.config.Database.DeleteDownload(&d.state.DownloadPersistentState); err != nil {
 				return err
 			}
+			// Discard any partially downloaded files
+			if err := os.RemoveAll(d.tempDir()); err != nil {
+				s.log.Warnf("failed to delete temp dir for %v: %v", d, err)
+			}
 			s.events.Send(DownloadRemoved{downloadEvent{d}})
 		}
 		return nil
@@ -0,0 +1,278 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+// testVideo is a source for "video:<name>", which downloads a file called <name>.
+type testVideo struct {
+	url string
+}
+
+func (s *testVideo) URL() string {
+	return s.url
+}
+
+func (s *testVideo) String() string {
+	return s.url
+}
+
+func (s *testVideo) Recon(context.Context) (video_archiver.ResolvedSource, error) {
+	return s, nil
+}
+
+func (s *testVideo) Download(d video_archiver.Download) error {
+	f, err := d.CreateFile(strings.TrimPrefix(s.url, "video:"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(s.url)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// testPlaylist is a source for "playlist:<name>,<name>,...", a collection of "video:<name>" sources.
+type testPlaylist struct {
+	testVideo
+}
+
+func (s *testPlaylist) Recon(context.Context) (video_archiver.ResolvedSource, error) {
+	return s, nil
+}
+
+func (s *testPlaylist) Download(video_archiver.Download) error {
+	return errors.New("playlist should not be downloaded")
+}
+
+func (s *testPlaylist) Children() []video_archiver.Source {
+	var children []video_archiver.Source
+	for _, name := range strings.Split(strings.TrimPrefix(s.url, "playlist:"), ",") {
+		children = append(children, &testVideo{url: "video:" + name})
+	}
+	return children
+}
+
+func newTestSession(t *testing.T) *Session {
+	registry := &video_archiver.ProviderRegistry{}
+	registry.MustCreate("test", func(s string) (video_archiver.Source, error) {
+		switch {
+		case strings.HasPrefix(s, "video:"):
+			return &testVideo{url: s}, nil
+		case strings.HasPrefix(s, "short:"):
+			// Another way of writing "video:<name>"
+			return &testVideo{url: "video:" + strings.TrimPrefix(s, "short:")}, nil
+		case strings.HasPrefix(s, "playlist:"):
+			return &testPlaylist{testVideo{url: s}}, nil
+		default:
+			return nil, video_archiver.ErrNoMatch
+		}
+	})
+	config := DefaultConfig
+	config.DefaultSavePath = t.TempDir()
+	config.TempPath = t.TempDir()
+	config.ProviderRegistry = registry
+	s := generic.Unwrap(New(config, context.Background()))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func waitForComplete(t *testing.T, d *Download) {
+	select {
+	case <-d.Complete():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %v to complete", d)
+	}
+}
+
+func TestSessionCollection(t *testing.T) {
+	assert := assert_.New(t)
+	s := newTestSession(t)
+
+	existing := generic.Unwrap(s.AddDownload("video:b", nil))
+	parent := generic.Unwrap(s.AddDownload("playlist:a,b,c", &AddDownloadOptions{
+		Priority: 5,
+		Options:  video_archiver.Options{"test.option": "value"},
+	}))
+	parent.Start()
+	waitForComplete(t, parent)
+
+	// A download is added for each child that didn't already have one, with the same settings as the parent
+	children := s.childDownloads(parent.ID())
+	var urls []string
+	for _, child := range children {
+		state := child.getState()
+		urls = append(urls, state.URL)
+		assert.Equal(parent.ID(), state.ParentID)
+		assert.Equal(5, state.Priority)
+		assert.Equal(video_archiver.Options{"test.option": "value"}, state.Options)
+	}
+	assert.Equal([]string{"video:a", "video:c"}, urls)
+
+	// Starting the parent starts the children, but not the download that was already there
+	for _, child := range children {
+		waitForComplete(t, child)
+	}
+	savePath := s.config.DefaultSavePath
+	assert.FileExists(filepath.Join(savePath, "a"))
+	assert.FileExists(filepath.Join(savePath, "c"))
+	assert.Equal([]string{filepath.Join(savePath, "a")}, children[0].getState().Outputs)
+	assert.NoFileExists(filepath.Join(savePath, "b"))
+	assert.False(existing.IsComplete())
+
+	// Expanding the collection again doesn't add duplicates
+	collection := &testPlaylist{testVideo{url: "playlist:a,b,c,d"}}
+	added := generic.Unwrap(s.addChildDownloads(parent.getState().DownloadPersistentState, collection.Children()))
+	if assert.Len(added, 1) {
+		assert.Equal("video:d", added[0].getState().URL)
+	}
+	assert.Len(s.childDownloads(parent.ID()), 3)
+
+	// Downloads for the same item written differently, or that resolved to it, are also duplicates
+	short := generic.Unwrap(s.AddDownload("short:e", nil))
+	short.Start()
+	waitForComplete(t, short)
+	assert.Equal("video:e", short.getState().SourceURL)
+	resolved := generic.Unwrap(s.AddDownload("https://example.com/f", nil))
+	resolved.updateState(func(ds *DownloadState) {
+		ds.ResolvedURL = "video:f"
+	})
+	collection = &testPlaylist{testVideo{url: "playlist:e,f,g"}}
+	added = generic.Unwrap(s.addChildDownloads(parent.getState().DownloadPersistentState, collection.Children()))
+	if assert.Len(added, 1) {
+		assert.Equal("video:g", added[0].getState().URL)
+	}
+}
+
+func TestSessionResolveURL(t *testing.T) {
+	assert := assert_.New(t)
+	mux := http.NewServeMux()
+	mux.Handle("/short", http.RedirectHandler("/video/a", http.StatusMovedPermanently))
+	mux.Handle("/video/b", http.RedirectHandler("/consent", http.StatusFound))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s := newTestSession(t)
+	s.config.MaxResolveHops = video_archiver.DefaultMaxHops
+	// "site" matches the server's video URLs, anything else on the server is just a web page
+	s.config.ProviderRegistry.MustCreate("site", func(u string) (video_archiver.Source, error) {
+		if !strings.HasPrefix(u, server.URL+"/video/") {
+			return nil, video_archiver.ErrNoMatch
+		}
+		return &testVideo{url: "video:" + strings.TrimPrefix(u, server.URL+"/video/")}, nil
+	})
+	s.config.ProviderRegistry.MustCreatePriority("page", func(u string) (video_archiver.Source, error) {
+		if !strings.HasPrefix(u, server.URL+"/") {
+			return nil, video_archiver.ErrNoMatch
+		}
+		return &testVideo{url: "video:page"}, nil
+	}, video_archiver.PriorityLowest)
+
+	// Following the redirect gives a better match
+	d := generic.Unwrap(s.AddDownload(server.URL+"/short", nil))
+	d.Start()
+	waitForComplete(t, d)
+	state := d.getState()
+	assert.Equal(server.URL+"/short", state.URL)
+	assert.Equal(server.URL+"/video/a", state.ResolvedURL)
+	assert.Equal("site", state.Provider)
+	assert.FileExists(filepath.Join(s.config.DefaultSavePath, "a"))
+
+	// Following the redirect gives a worse match, so the original URL is used
+	d = generic.Unwrap(s.AddDownload(server.URL+"/video/b", nil))
+	d.Start()
+	waitForComplete(t, d)
+	state = d.getState()
+	assert.Equal(server.URL+"/video/b", state.ResolvedURL)
+	assert.Equal("site", state.Provider)
+	assert.FileExists(filepath.Join(s.config.DefaultSavePath, "b"))
+}
+
+// testPartial is a source for "partial:<how>", which leaves a partially downloaded file and then fails in some way.
+type testPartial struct {
+	testVideo
+}
+
+func (s *testPartial) Recon(context.Context) (video_archiver.ResolvedSource, error) {
+	return s, nil
+}
+
+func (s *testPartial) Download(d video_archiver.Download) error {
+	f, err := d.CreateFile("partial")
+	if err != nil {
+		return err
+	}
+	_, _ = f.Write([]byte("incomplete"))
+	_ = f.Close()
+	switch strings.TrimPrefix(s.url, "partial:") {
+	case "transient":
+		return video_archiver.Transient(errors.New("try again"))
+	case "wait":
+		<-d.Context().Done()
+		return d.Context().Err()
+	default:
+		return video_archiver.Permanent(errors.New("never going to work"))
+	}
+}
+
+func TestSessionTempDir(t *testing.T) {
+	assert := assert_.New(t)
+	s := newTestSession(t)
+	s.config.RetryPolicy = RetryPolicy{MaxAttempts: 2, InitialDelay: time.Hour, MaxDelay: time.Hour, Multiplier: 1}
+	s.config.ProviderRegistry.MustCreate("partial", func(u string) (video_archiver.Source, error) {
+		if !strings.HasPrefix(u, "partial:") {
+			return nil, video_archiver.ErrNoMatch
+		}
+		return &testPartial{testVideo{url: u}}, nil
+	})
+	failed := func(d *Download) func() bool {
+		return func() bool { return d.getState().Status == DownloadStatusError }
+	}
+
+	// Partially downloaded files are kept while there's going to be a retry
+	transient := generic.Unwrap(s.AddDownload("partial:transient", nil))
+	transient.Start()
+	if assert.Eventually(failed(transient), 5*time.Second, 10*time.Millisecond) {
+		assert.False(transient.getState().NextRetryAt.IsZero())
+		assert.FileExists(filepath.Join(transient.tempDir(), "partial"))
+	}
+
+	// But not after a permanent failure
+	permanent := generic.Unwrap(s.AddDownload("partial:permanent", nil))
+	permanent.Start()
+	if assert.Eventually(failed(permanent), 5*time.Second, 10*time.Millisecond) {
+		assert.NoDirExists(permanent.tempDir())
+	}
+
+	// Or after being stopped
+	stopped := generic.Unwrap(s.AddDownload("partial:wait", nil))
+	stopped.Start()
+	assert.Eventually(func() bool {
+		_, err := os.Stat(filepath.Join(stopped.tempDir(), "partial"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	stopped.Stop()
+	assert.Eventually(func() bool {
+		_, err := os.Stat(stopped.tempDir())
+		return errors.Is(err, os.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+	transient.Stop()
+	assert.Eventually(func() bool {
+		_, err := os.Stat(transient.tempDir())
+		return errors.Is(err, os.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package video_archiver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Options are settings that change how providers behave, keyed by "<provider>.<option>", e.g. "youtube.max-height",
+// apart from the few that apply to every provider, e.g. OptionSidecars.
+// Options are carried in a context.Context, so that a provider can find them during Recon (from its argument) and
+// Download (from Download.Context()).
+type Options map[string]string
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx carrying options, which take precedence over any options already carried by ctx.
+func WithOptions(ctx context.Context, options Options) context.Context {
+	if len(options) == 0 {
+		return ctx
+	}
+	merged := OptionsFromContext(ctx).Clone()
+	if merged == nil {
+		merged = make(Options, len(options))
+	}
+	for key, value := range options {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, optionsKey{}, merged)
+}
+
+// OptionsFromContext returns the options carried by ctx, which may be nil. The result must not be modified.
+func OptionsFromContext(ctx context.Context) Options {
+	options, _ := ctx.Value(optionsKey{}).(Options)
+	return options
+}
+
+// ParseOption parses an option in "key=value" form.
+func ParseOption(s string) (key string, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid option %q, expected \"key=value\"", s)
+	}
+	return key, strings.TrimSpace(value), nil
+}
+
+func (o Options) Clone() Options {
+	if o == nil {
+		return nil
+	}
+	clone := make(Options, len(o))
+	for key, value := range o {
+		clone[key] = value
+	}
+	return clone
+}
+
+// Get returns the value of an option, or "" if it isn't set.
+func (o Options) Get(key string) string {
+	return o[key]
+}
+
+// Bool returns the value of a boolean option, or false if it isn't set.
+func (o Options) Bool(key string) (bool, error) {
+	if value, ok := o[key]; !ok || value == "" {
+		return false, nil
+	} else if b, err := strconv.ParseBool(value); err != nil {
+		return false, fmt.Errorf("invalid value for %v: %q", key, value)
+	} else {
+		return b, nil
+	}
+}
+
+// Int returns the value of an integer option, or 0 if it isn't set.
+func (o Options) Int(key string) (int, error) {
+	if value, ok := o[key]; !ok || value == "" {
+		return 0, nil
+	} else if i, err := strconv.Atoi(value); err != nil {
+		return 0, fmt.Errorf("invalid value for %v: %q", key, value)
+	} else {
+		return i, nil
+	}
+}
+
+// List returns the value of an option as a comma-separated list, or nil if it isn't set.
+func (o Options) List(key string) []string {
+	var list []string
+	for _, item := range strings.Split(o[key], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,41 @@
+package video_archiver
+
+import (
+	"context"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestOptions(t *testing.T) {
+	assert := assert_.New(t)
+
+	session := Options{"youtube.max-height": "720", "youtube.container": "mp4"}
+	ctx := WithOptions(context.Background(), session)
+	ctx = WithOptions(ctx, Options{"youtube.max-height": "1080"})
+	options := OptionsFromContext(ctx)
+	assert.Equal("1080", options.Get("youtube.max-height"))
+	assert.Equal("mp4", options.Get("youtube.container"))
+	// The original options aren't modified
+	assert.Equal("720", session.Get("youtube.max-height"))
+	assert.Nil(OptionsFromContext(context.Background()))
+
+	options = Options{"n": "42", "b": "yes", "list": " a, b,,c "}
+	assert.Equal(42, generic.Unwrap(options.Int("n")))
+	assert.Equal(0, generic.Unwrap(options.Int("missing")))
+	_, err := options.Bool("b")
+	assert.Error(err)
+	_, err = options.Int("b")
+	assert.Error(err)
+	assert.Equal([]string{"a", "b", "c"}, options.List("list"))
+	assert.Nil(options.List("missing"))
+
+	key, value, err := ParseOption("youtube.codecs = avc1,vp9")
+	assert.NoError(err)
+	assert.Equal("youtube.codecs", key)
+	assert.Equal("avc1,vp9", value)
+	_, _, err = ParseOption("novalue")
+	assert.Error(err)
+}
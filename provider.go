@@ -1,12 +1,13 @@
 package video_archiver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"sort"
-
-	"github.com/hashicorp/go-multierror"
+	"strings"
+	"sync"
 
 	"github.com/alanbriolat/video-archiver/generic"
 )
@@ -14,9 +15,10 @@ import (
 var (
 	ErrDuplicateProvider = errors.New("duplicate provider name")
 	ErrInvalidProvider   = errors.New("invalid provider")
-	// TODO: ErrNoMatch should wrap an inner error, so we can show why a match failed
-	ErrNoMatch         = errors.New("no provider matched the input")
-	ErrUnknownProvider = errors.New("unknown provider")
+	// ErrNoMatch is returned (as a *NoMatchError, to show why) if no provider matched.
+	ErrNoMatch          = errors.New("no provider matched the input")
+	ErrProviderDisabled = errors.New("provider is disabled")
+	ErrUnknownProvider  = errors.New("unknown provider")
 )
 
 var (
@@ -27,12 +29,86 @@ var (
 
 type MatchFunc = func(string) (Source, error)
 
+// A Capability is something that a Provider's sources can produce.
+type Capability uint
+
+const (
+	CapabilityVideo Capability = 1 << iota
+	CapabilityAudio
+	CapabilitySubtitles
+	// Collections of other sources, e.g. playlists and feeds (see CollectionSource).
+	CapabilityPlaylists
+	// Extra information about the video (see MetadataSource and InfoSource).
+	CapabilityMetadata
+)
+
+var capabilityNames = []struct {
+	Capability Capability
+	Name       string
+}{
+	{CapabilityVideo, "video"},
+	{CapabilityAudio, "audio"},
+	{CapabilitySubtitles, "subtitles"},
+	{CapabilityPlaylists, "playlists"},
+	{CapabilityMetadata, "metadata"},
+}
+
+// ParseCapabilities combines capabilities by name, e.g. []string{"video", "subtitles"}.
+func ParseCapabilities(names []string) (Capability, error) {
+	var c Capability
+names:
+	for _, name := range names {
+		for _, n := range capabilityNames {
+			if strings.EqualFold(name, n.Name) {
+				c |= n.Capability
+				continue names
+			}
+		}
+		return c, fmt.Errorf("unknown capability %#v", name)
+	}
+	return c, nil
+}
+
+// Has checks if c includes all of other.
+func (c Capability) Has(other Capability) bool {
+	return c&other == other
+}
+
+// Names of the capabilities included in c, e.g. []string{"video", "subtitles"}.
+func (c Capability) Names() []string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.Capability) {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+func (c Capability) String() string {
+	return strings.Join(c.Names(), ", ")
+}
+
 // A Provider matches any URL it knows how to handle, giving a Source that can be used to download the video.
 type Provider struct {
 	Name  string
 	Match MatchFunc
 	// Priority of the matcher, lower (including negative) means matching earlier.
 	Priority int16
+
+	// The rest describes the Provider to users, e.g. as a list of supported sites.
+
+	// What the Provider handles, in a sentence.
+	Description string
+	// Hosts of the sites the Provider handles, e.g. "www.youtube.com". Empty if it isn't specific to any site, e.g. it
+	// handles a type of file wherever it is.
+	Hosts []string
+	// What the URLs the Provider handles look like, e.g. "https://youtu.be/{id}" or "*.m3u8".
+	Patterns []string
+	// URLs that the Provider should match, ahead of any other Provider (see ProviderRegistry.CheckExamples).
+	Examples []string
+	// What the Provider's sources can produce.
+	Capabilities Capability
 }
 
 func (p Provider) WithName(name string) Provider {
@@ -51,28 +127,112 @@ type Match struct {
 	Source       Source
 }
 
-// A ProviderRegistry is a collection of Provider instances which can be used to try to match URLs.
+// A MatchResult is the result of trying to match a URL with one Provider.
+type MatchResult struct {
+	ProviderName string
+	Priority     int16
+	// The Source if the Provider matched, otherwise nil.
+	Source Source
+	// Why the Provider didn't match, if it didn't.
+	Err error
+}
+
+func (r MatchResult) Matched() bool {
+	return r.Source != nil
+}
+
+// A NoMatchError explains why each provider that was tried didn't match.
+type NoMatchError struct {
+	Results []MatchResult
+}
+
+func (e *NoMatchError) Error() string {
+	if len(e.Results) == 0 {
+		return ErrNoMatch.Error() + ": no providers"
+	}
+	reasons := make([]string, 0, len(e.Results))
+	for _, r := range e.Results {
+		reasons = append(reasons, fmt.Sprintf("[%v] %v", r.ProviderName, r.Err))
+	}
+	return ErrNoMatch.Error() + ": " + strings.Join(reasons, "; ")
+}
+
+func (e *NoMatchError) Is(target error) bool {
+	return target == ErrNoMatch
+}
+
+// A ProviderState is a Provider as registered with a ProviderRegistry, with its current priority (see SetPriority) and
+// whether it is enabled.
+type ProviderState struct {
+	Provider
+	// Disabled providers are skipped by Match, and can't be used by MatchWith.
+	Enabled bool
+	// The priority the Provider was registered with.
+	DefaultPriority int16
+}
+
+// A ProviderRegistry is a collection of Provider instances which can be used to try to match URLs. It is safe for
+// concurrent use: matching uses a snapshot of the providers, so is never blocked by (or blocks) changes to them.
 type ProviderRegistry struct {
-	providers   []*Provider
-	providerMap map[string]*Provider
+	mu sync.RWMutex
+	// Sorted by priority. Never modified once set, only replaced, so a snapshot can be used without holding mu.
+	providers []ProviderState
 }
 
-// Add registers a Provider with the ProviderRegistry. Provider.Name and Provider.Match must be set, and
+// snapshot gets the current providers, which must not be modified.
+func (r *ProviderRegistry) snapshot() []ProviderState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.providers
+}
+
+// update replaces the providers with the result of f, which gets a copy it can modify.
+func (r *ProviderRegistry) update(f func(providers []ProviderState) ([]ProviderState, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	providers, err := f(append([]ProviderState(nil), r.providers...))
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(providers, func(i, j int) bool {
+		return providers[i].Priority < providers[j].Priority
+	})
+	r.providers = providers
+	return nil
+}
+
+// updateProvider replaces the providers with a copy where f has changed the named Provider.
+func (r *ProviderRegistry) updateProvider(name string, f func(p *ProviderState)) error {
+	return r.update(func(providers []ProviderState) ([]ProviderState, error) {
+		if i := indexOfProvider(providers, name); i >= 0 {
+			f(&providers[i])
+			return providers, nil
+		}
+		return nil, ErrUnknownProvider
+	})
+}
+
+func indexOfProvider(providers []ProviderState, name string) int {
+	for i := range providers {
+		if providers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add registers a Provider with the ProviderRegistry, enabled. Provider.Name and Provider.Match must be set, and
 // Provider.Name must be unique within the ProviderRegistry.
 func (r *ProviderRegistry) Add(p Provider) error {
-	if r.providerMap == nil {
-		r.providerMap = make(map[string]*Provider)
-	}
 	if p.Name == "" || p.Match == nil {
 		return ErrInvalidProvider
 	}
-	if _, ok := r.providerMap[p.Name]; ok {
-		return ErrDuplicateProvider
-	}
-	r.providerMap[p.Name] = &p
-	r.providers = append(r.providers, r.providerMap[p.Name])
-	r.sortByPriority()
-	return nil
+	return r.update(func(providers []ProviderState) ([]ProviderState, error) {
+		if indexOfProvider(providers, p.Name) >= 0 {
+			return nil, ErrDuplicateProvider
+		}
+		return append(providers, ProviderState{Provider: p, Enabled: true, DefaultPriority: p.Priority}), nil
+	})
 }
 
 // Create is a shortcut for Add(Provider{Name: ..., Match: ...}).
@@ -92,57 +252,160 @@ func (r *ProviderRegistry) CreatePriority(name string, f MatchFunc, priority int
 	})
 }
 
+// Remove unregisters the named Provider.
+func (r *ProviderRegistry) Remove(name string) error {
+	return r.update(func(providers []ProviderState) ([]ProviderState, error) {
+		if i := indexOfProvider(providers, name); i >= 0 {
+			return append(providers[:i], providers[i+1:]...), nil
+		}
+		return nil, ErrUnknownProvider
+	})
+}
+
+// Enable the named Provider, so it is used again by Match.
+func (r *ProviderRegistry) Enable(name string) error {
+	return r.updateProvider(name, func(p *ProviderState) { p.Enabled = true })
+}
+
+// Disable the named Provider, so it is skipped by Match (and refused by MatchWith), but is still registered.
+func (r *ProviderRegistry) Disable(name string) error {
+	return r.updateProvider(name, func(p *ProviderState) { p.Enabled = false })
+}
+
+// Clone makes a new ProviderRegistry with the same providers, which can then be changed independently of this one,
+// e.g. to give each session its own view of DefaultProviderRegistry.
+func (r *ProviderRegistry) Clone() *ProviderRegistry {
+	// The snapshot is never modified, so it can be shared until one of the registries is changed
+	return &ProviderRegistry{providers: r.snapshot()}
+}
+
+// Get the state of the named Provider.
+func (r *ProviderRegistry) Get(name string) (ProviderState, error) {
+	providers := r.snapshot()
+	if i := indexOfProvider(providers, name); i >= 0 {
+		return providers[i], nil
+	}
+	return ProviderState{}, ErrUnknownProvider
+}
+
 // GetPriority gets the priority of the named Provider. If ErrUnknownProvider is returned, the returned priority is the
 // default priority.
 func (r *ProviderRegistry) GetPriority(name string) (int16, error) {
-	if p, ok := r.providerMap[name]; ok {
+	if p, err := r.Get(name); err == nil {
 		return p.Priority, nil
 	} else {
-		return 0, ErrUnknownProvider
+		return 0, err
 	}
 }
 
-// List returns the names of registered providers in priority order.
+// List returns the names of registered providers (including disabled ones) in priority order.
 func (r *ProviderRegistry) List() []string {
-	names := make([]string, 0, len(r.providers))
-	for _, p := range r.providers {
+	providers := r.snapshot()
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
 		names = append(names, p.Name)
 	}
 	return names
 }
 
-// Match a string against each Provider in priority order, or return ErrNoMatch.
+// Providers returns the state of every registered Provider in priority order.
+func (r *ProviderRegistry) Providers() []ProviderState {
+	return append([]ProviderState(nil), r.snapshot()...)
+}
+
+// Match a string against each enabled Provider in priority order, or return a *NoMatchError (see ErrNoMatch).
 func (r *ProviderRegistry) Match(s string) (*Match, error) {
-	var result error
-	for _, p := range r.providers {
-		if source, err := p.Match(s); source != nil && err == nil {
-			match := &Match{
-				ProviderName: p.Name,
-				Source:       source,
-			}
-			return match, nil
-		} else {
-			result = multierror.Append(result, multierror.Prefix(err, fmt.Sprintf("[%v]", p.Name)))
+	return matchFirst(r.snapshot(), s)
+}
+
+// MatchAfter is like Match, but only tries the providers after the named one in priority order, e.g. for a Provider to
+// hand over a URL that turned out to be something it can't download.
+func (r *ProviderRegistry) MatchAfter(name string, s string) (*Match, error) {
+	providers := r.snapshot()
+	i := indexOfProvider(providers, name)
+	if i < 0 {
+		return nil, ErrUnknownProvider
+	}
+	return matchFirst(providers[i+1:], s)
+}
+
+func matchFirst(providers []ProviderState, s string) (*Match, error) {
+	var results []MatchResult
+	for _, p := range providers {
+		if !p.Enabled {
+			continue
+		}
+		result := p.try(s)
+		if result.Matched() {
+			return &Match{ProviderName: p.Name, Source: result.Source}, nil
 		}
+		results = append(results, result)
 	}
-	return nil, result
+	return nil, &NoMatchError{Results: results}
 }
 
-// MatchWith will attempt to match a string against a specific provider.
+// MatchWith will attempt to match a string against a specific provider, which must be enabled.
 func (r *ProviderRegistry) MatchWith(name string, s string) (*Match, error) {
-	if p, ok := r.providerMap[name]; ok {
-		if source, err := p.Match(s); source != nil && err == nil {
-			match := &Match{
-				ProviderName: p.Name,
-				Source:       source,
-			}
-			return match, nil
+	if p, err := r.Get(name); err != nil {
+		return nil, err
+	} else if !p.Enabled {
+		return nil, fmt.Errorf("%w: %v", ErrProviderDisabled, name)
+	} else if result := p.try(s); result.Matched() {
+		return &Match{ProviderName: p.Name, Source: result.Source}, nil
+	} else {
+		return nil, &NoMatchError{Results: []MatchResult{result}}
+	}
+}
+
+// Explain tries to match a string against every Provider in priority order (not stopping at the first match, unlike
+// Match), to show which would match and why the others don't. Disabled providers aren't tried, and have
+// ErrProviderDisabled as the reason.
+func (r *ProviderRegistry) Explain(s string) []MatchResult {
+	providers := r.snapshot()
+	results := make([]MatchResult, 0, len(providers))
+	for _, p := range providers {
+		if p.Enabled {
+			results = append(results, p.try(s))
 		} else {
-			return nil, ErrNoMatch
+			results = append(results, MatchResult{ProviderName: p.Name, Priority: p.Priority, Err: ErrProviderDisabled})
 		}
-	} else {
-		return nil, ErrUnknownProvider
 	}
+	return results
+}
+
+func (p *Provider) try(s string) MatchResult {
+	result := MatchResult{ProviderName: p.Name, Priority: p.Priority}
+	source, err := p.Match(s)
+	switch {
+	case err != nil:
+		result.Err = err
+	case source == nil:
+		result.Err = errors.New("no source")
+	default:
+		result.Source = source
+	}
+	return result
+}
+
+// CheckExamples matches the example URLs of every enabled Provider, giving an error for each one that isn't matched by
+// that Provider, or that is matched by a different Provider first.
+func (r *ProviderRegistry) CheckExamples() []error {
+	var errs []error
+	for _, p := range r.snapshot() {
+		if !p.Enabled {
+			continue
+		}
+		for _, example := range p.Examples {
+			if _, err := r.MatchWith(p.Name, example); err != nil {
+				errs = append(errs, fmt.Errorf("%v: example %v: %w", p.Name, example, err))
+			} else if match, err := r.Match(example); err != nil {
+				errs = append(errs, fmt.Errorf("%v: example %v: %w", p.Name, example, err))
+			} else if match.ProviderName != p.Name {
+				errs = append(errs, fmt.Errorf("%v: example %v: matched by %v first", p.Name, example, match.ProviderName))
+			}
+		}
+	}
+	return errs
 }
 
 // MustAdd wraps Add but panics if there is an error.
@@ -162,19 +425,24 @@ func (r *ProviderRegistry) MustCreatePriority(name string, f MatchFunc, priority
 
 // SetPriority adjust the priority of a named Provider.
 func (r *ProviderRegistry) SetPriority(name string, priority int16) error {
-	if p, ok := r.providerMap[name]; ok {
-		p.Priority = priority
-		r.sortByPriority()
-		return nil
-	} else {
-		return ErrUnknownProvider
-	}
+	return r.updateProvider(name, func(p *ProviderState) { p.Priority = priority })
 }
 
-func (r *ProviderRegistry) sortByPriority() {
-	sort.Slice(r.providers, func(i, j int) bool {
-		return r.providers[i].Priority < r.providers[j].Priority
-	})
+var DefaultProviderRegistry ProviderRegistry
+
+type providerRegistryKey struct{}
+
+// WithProviderRegistry returns a copy of ctx carrying a ProviderRegistry, which providers that find media elsewhere
+// (e.g. embedded in a web page) should use (via ProviderRegistryFromContext) to match it.
+func WithProviderRegistry(ctx context.Context, r *ProviderRegistry) context.Context {
+	return context.WithValue(ctx, providerRegistryKey{}, r)
 }
 
-var DefaultProviderRegistry ProviderRegistry
+// ProviderRegistryFromContext returns the ProviderRegistry set by WithProviderRegistry, or DefaultProviderRegistry if
+// there isn't one.
+func ProviderRegistryFromContext(ctx context.Context) *ProviderRegistry {
+	if r, ok := ctx.Value(providerRegistryKey{}).(*ProviderRegistry); ok && r != nil {
+		return r
+	}
+	return &DefaultProviderRegistry
+}
@@ -0,0 +1,107 @@
+package video_archiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// ProviderSettings are changes to the providers of a ProviderRegistry, by provider name, so that they can be saved in
+// user config (see LoadProviderSettings and ProviderSettings.Save) and applied again later.
+type ProviderSettings map[string]ProviderSetting
+
+// A ProviderSetting changes a Provider from how it was registered. Unset fields leave it as it was.
+type ProviderSetting struct {
+	Enabled  *bool  `json:"enabled,omitempty"`
+	Priority *int16 `json:"priority,omitempty"`
+}
+
+// LoadProviderSettings reads ProviderSettings from a JSON file. If the file doesn't exist, there are no settings.
+func LoadProviderSettings(path string) (ProviderSettings, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ProviderSettings{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	settings := ProviderSettings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("invalid provider settings %v: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Save writes the ProviderSettings to a JSON file, replacing it.
+func (s ProviderSettings) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, append(data, '\n'), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Settings gets how the providers have been changed since they were registered, i.e. which are disabled and which
+// have a different priority.
+func (r *ProviderRegistry) Settings() ProviderSettings {
+	return settingsOf(r.snapshot())
+}
+
+// UpdateSettings gets the settings to save in place of previously loaded ones: how the providers are now (see
+// Settings), plus the loaded settings for any providers that aren't registered, which ApplySettings ignored but which
+// shouldn't be forgotten just because e.g. a script wasn't available this time.
+func (r *ProviderRegistry) UpdateSettings(loaded ProviderSettings) ProviderSettings {
+	providers := r.snapshot()
+	settings := settingsOf(providers)
+	for name, setting := range loaded {
+		if indexOfProvider(providers, name) < 0 {
+			settings[name] = setting
+		}
+	}
+	return settings
+}
+
+func settingsOf(providers []ProviderState) ProviderSettings {
+	settings := ProviderSettings{}
+	for _, p := range providers {
+		var setting ProviderSetting
+		if !p.Enabled {
+			enabled := false
+			setting.Enabled = &enabled
+		}
+		if p.Priority != p.DefaultPriority {
+			priority := p.Priority
+			setting.Priority = &priority
+		}
+		if setting.Enabled != nil || setting.Priority != nil {
+			settings[p.Name] = setting
+		}
+	}
+	return settings
+}
+
+// ApplySettings changes the providers according to ProviderSettings, all at once. Settings for providers that aren't
+// registered are ignored, because they may come from somewhere that isn't always available (e.g. a script).
+func (r *ProviderRegistry) ApplySettings(settings ProviderSettings) {
+	_ = r.update(func(providers []ProviderState) ([]ProviderState, error) {
+		for i := range providers {
+			p := &providers[i]
+			setting, ok := settings[p.Name]
+			if !ok {
+				continue
+			}
+			if setting.Enabled != nil {
+				p.Enabled = *setting.Enabled
+			}
+			if setting.Priority != nil {
+				p.Priority = *setting.Priority
+			}
+		}
+		return providers, nil
+	})
+}
@@ -0,0 +1,245 @@
+package video_archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+type testSource struct {
+	url string
+}
+
+func (s *testSource) URL() string {
+	return s.url
+}
+
+func (s *testSource) String() string {
+	return s.url
+}
+
+func (s *testSource) Recon(context.Context) (ResolvedSource, error) {
+	return nil, errors.New("not implemented")
+}
+
+func newTestRegistry() *ProviderRegistry {
+	prefixMatcher := func(prefix string) MatchFunc {
+		return func(s string) (Source, error) {
+			if !strings.HasPrefix(s, prefix) {
+				return nil, errors.New("wrong prefix")
+			}
+			return &testSource{url: s}, nil
+		}
+	}
+	r := &ProviderRegistry{}
+	r.MustCreatePriority("any", prefixMatcher(""), PriorityLowest)
+	r.MustCreate("video", prefixMatcher("video:"))
+	r.MustCreatePriority("nothing", func(string) (Source, error) { return nil, nil }, 10)
+	return r
+}
+
+func TestProviderRegistryMatch(t *testing.T) {
+	assert := assert_.New(t)
+	r := newTestRegistry()
+	assert.Equal([]string{"video", "nothing", "any"}, r.List())
+
+	match, err := r.Match("video:a")
+	if assert.NoError(err) {
+		assert.Equal("video", match.ProviderName)
+	}
+	match, err = r.Match("other:a")
+	if assert.NoError(err) {
+		assert.Equal("any", match.ProviderName)
+	}
+
+	// Errors explain why each provider didn't match
+	_, err = r.MatchWith("video", "other:a")
+	assert.ErrorIs(err, ErrNoMatch)
+	assert.EqualError(err, "no provider matched the input: [video] wrong prefix")
+	_, err = r.MatchWith("missing", "video:a")
+	assert.ErrorIs(err, ErrUnknownProvider)
+
+	// Only providers after the named one
+	match, err = r.MatchAfter("video", "video:a")
+	if assert.NoError(err) {
+		assert.Equal("any", match.ProviderName)
+	}
+	_, err = r.MatchAfter("any", "video:a")
+	assert.ErrorIs(err, ErrNoMatch)
+	_, err = r.MatchAfter("missing", "video:a")
+	assert.ErrorIs(err, ErrUnknownProvider)
+	_, err = (&ProviderRegistry{}).Match("video:a")
+	assert.ErrorIs(err, ErrNoMatch)
+}
+
+func TestProviderRegistryExplain(t *testing.T) {
+	assert := assert_.New(t)
+	r := newTestRegistry()
+
+	// Every provider is tried, in priority order
+	results := r.Explain("video:a")
+	if assert.Len(results, 3) {
+		assert.Equal("video", results[0].ProviderName)
+		assert.True(results[0].Matched())
+		assert.NoError(results[0].Err)
+		assert.Equal("nothing", results[1].ProviderName)
+		assert.Equal(int16(10), results[1].Priority)
+		assert.False(results[1].Matched())
+		assert.EqualError(results[1].Err, "no source")
+		assert.Equal("any", results[2].ProviderName)
+		assert.True(results[2].Matched())
+	}
+	results = r.Explain("other:a")
+	if assert.Len(results, 3) {
+		assert.False(results[0].Matched())
+		assert.EqualError(results[0].Err, "wrong prefix")
+	}
+}
+
+func TestCapability(t *testing.T) {
+	assert := assert_.New(t)
+	c := generic.Unwrap(ParseCapabilities([]string{"Subtitles", "video"}))
+	assert.Equal(CapabilityVideo|CapabilitySubtitles, c)
+	assert.True(c.Has(CapabilityVideo))
+	assert.False(c.Has(CapabilityVideo | CapabilityAudio))
+	assert.Equal("video, subtitles", c.String())
+	_, err := ParseCapabilities([]string{"video", "smell"})
+	assert.Error(err)
+}
+
+func TestProviderRegistryCheckExamples(t *testing.T) {
+	assert := assert_.New(t)
+	r := newTestRegistry()
+	assert.Empty(r.CheckExamples())
+	r.MustAdd(Provider{
+		Name:     "examples",
+		Match:    func(s string) (Source, error) { return &testSource{url: s}, nil },
+		Priority: 5,
+		Examples: []string{"other:a", "video:a"},
+	})
+	// Examples must be matched by their own provider, ahead of the others
+	errs := r.CheckExamples()
+	if assert.Len(errs, 1) {
+		assert.EqualError(errs[0], "examples: example video:a: matched by video first")
+	}
+	generic.Unwrap_(r.Disable("examples"))
+	assert.Empty(r.CheckExamples())
+}
+
+func TestProviderRegistryEnableDisable(t *testing.T) {
+	assert := assert_.New(t)
+	r := newTestRegistry()
+
+	// Disabled providers are skipped, but still registered
+	assert.NoError(r.Disable("video"))
+	match := generic.Unwrap(r.Match("video:a"))
+	assert.Equal("any", match.ProviderName)
+	_, err := r.MatchWith("video", "video:a")
+	assert.ErrorIs(err, ErrProviderDisabled)
+	assert.Equal([]string{"video", "nothing", "any"}, r.List())
+	assert.ErrorIs(r.Explain("video:a")[0].Err, ErrProviderDisabled)
+	assert.NoError(r.Enable("video"))
+	assert.Equal("video", generic.Unwrap(r.Match("video:a")).ProviderName)
+
+	assert.NoError(r.Remove("video"))
+	assert.Equal([]string{"nothing", "any"}, r.List())
+	assert.ErrorIs(r.Remove("video"), ErrUnknownProvider)
+	assert.ErrorIs(r.Disable("video"), ErrUnknownProvider)
+}
+
+func TestProviderRegistryClone(t *testing.T) {
+	assert := assert_.New(t)
+	r := newTestRegistry()
+	clone := r.Clone()
+
+	// Changes to either don't affect the other
+	assert.NoError(clone.Disable("any"))
+	assert.NoError(clone.SetPriority("nothing", -1))
+	assert.NoError(r.Remove("video"))
+	assert.Equal([]string{"nothing", "any"}, r.List())
+	assert.Equal([]string{"nothing", "video", "any"}, clone.List())
+	assert.True(generic.Unwrap(r.Get("any")).Enabled)
+	assert.Equal(int16(10), generic.Unwrap(r.GetPriority("nothing")))
+	_, err := clone.Match("other:a")
+	assert.ErrorIs(err, ErrNoMatch)
+}
+
+func TestProviderSettings(t *testing.T) {
+	assert := assert_.New(t)
+	path := filepath.Join(t.TempDir(), "settings.json")
+	assert.Equal(ProviderSettings{}, generic.Unwrap(LoadProviderSettings(path)))
+
+	// Only changes from how providers were registered are saved
+	r := newTestRegistry()
+	assert.Empty(r.Settings())
+	generic.Unwrap_(r.Disable("any"))
+	generic.Unwrap_(r.SetPriority("nothing", -1))
+	generic.Unwrap_(r.SetPriority("video", PriorityDefault))
+	generic.Unwrap_(r.Settings().Save(path))
+
+	settings := generic.Unwrap(LoadProviderSettings(path))
+	assert.Len(settings, 2)
+	r = newTestRegistry()
+	r.ApplySettings(settings)
+	assert.Equal([]string{"nothing", "video", "any"}, r.List())
+	assert.False(generic.Unwrap(r.Get("any")).Enabled)
+	assert.Equal(settings, r.Settings())
+
+	// Settings for providers that aren't registered are ignored, but kept when saving again
+	enabled := false
+	settings["missing"] = ProviderSetting{Enabled: &enabled}
+	generic.Unwrap_(settings.Save(path))
+	settings = generic.Unwrap(LoadProviderSettings(path))
+	r = newTestRegistry()
+	r.ApplySettings(settings)
+	assert.Len(r.Providers(), 3)
+	generic.Unwrap_(r.Enable("any"))
+	generic.Unwrap_(r.UpdateSettings(settings).Save(path))
+	settings = generic.Unwrap(LoadProviderSettings(path))
+	assert.Len(settings, 2)
+	assert.Contains(settings, "nothing")
+	assert.False(*settings["missing"].Enabled)
+}
+
+// TestProviderRegistryConcurrency changes a registry while it's being used, which should be run with -race.
+func TestProviderRegistryConcurrency(t *testing.T) {
+	r := newTestRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_, _ = r.Match("video:a")
+				_, _ = r.MatchWith("video", "video:a")
+				_ = r.Explain("video:a")
+				_ = r.Clone().List()
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				name := fmt.Sprintf("extra-%d-%d", i, j)
+				_ = r.Create(name, func(string) (Source, error) { return nil, ErrNoMatch })
+				_ = r.SetPriority("video", int16(j))
+				_ = r.Disable("video")
+				_ = r.Enable("video")
+				r.ApplySettings(r.Settings())
+				_ = r.Remove(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert_.Equal(t, []string{"nothing", "video", "any"}, r.List())
+}
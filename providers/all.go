@@ -1,6 +1,10 @@
 package providers
 
 import (
+	_ "github.com/alanbriolat/video-archiver/providers/dash"
+	_ "github.com/alanbriolat/video-archiver/providers/feed"
+	_ "github.com/alanbriolat/video-archiver/providers/hls"
+	_ "github.com/alanbriolat/video-archiver/providers/html"
 	_ "github.com/alanbriolat/video-archiver/providers/raw"
 	_ "github.com/alanbriolat/video-archiver/providers/youtube"
 )
@@ -0,0 +1,21 @@
+package providers
+
+import (
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// TestExamples checks that every provider describes itself, and matches its own example URLs.
+func TestExamples(t *testing.T) {
+	assert := assert_.New(t)
+	for _, p := range video_archiver.DefaultProviderRegistry.Providers() {
+		assert.NotEmpty(p.Description, p.Name)
+		assert.NotZero(p.Capabilities, p.Name)
+	}
+	for _, err := range video_archiver.DefaultProviderRegistry.CheckExamples() {
+		assert.NoError(err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/oembed"
 )
 
 var protocols = generic.NewSet("http", "https")
@@ -48,5 +49,14 @@ func (s *source) Download(d video_archiver.Download) error {
 }
 
 func init() {
-	video_archiver.DefaultProviderRegistry.MustCreatePriority("bin", Match, video_archiver.PriorityLowest)
+	video_archiver.DefaultProviderRegistry.MustAdd(
+		// No examples, because html matches any URL first, and only hands over to bin what isn't a web page
+		oembed.Wrap(video_archiver.Provider{
+			Name:         "bin",
+			Match:        Match,
+			Description:  "Any URL, saved as a file named after it, if chosen instead of another provider",
+			Patterns:     []string{"https://{anything}"},
+			Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityMetadata,
+		}).WithPriority(video_archiver.PriorityLowest),
+	)
 }
@@ -0,0 +1,342 @@
+package dash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/internal/mux"
+	"github.com/alanbriolat/video-archiver/providers/internal/segmented"
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+// Options understood by the dash provider.
+const (
+	// Maximum video height, e.g. "720".
+	OptionMaxHeight = "dash.max-height"
+	// How many times to retry each segment after a transient error, default segmented.DefaultRetries.
+	OptionSegmentRetries = "dash.segment-retries"
+)
+
+var (
+	ErrNoRepresentation = errors.New("no representation matches the representation policy")
+	ErrLiveStream       = errors.New("live streams are not supported")
+	ErrMultiplePeriods  = errors.New("manifests with more than one period are not supported")
+)
+
+var protocols = generic.NewSet("http", "https")
+
+// A RepresentationPolicy chooses which representations of a presentation to download. The zero value chooses the
+// highest bandwidth.
+type RepresentationPolicy struct {
+	MaxHeight int
+}
+
+// RepresentationPolicyFromOptions creates a RepresentationPolicy from provider options (see OptionMaxHeight).
+func RepresentationPolicyFromOptions(options video_archiver.Options) (p RepresentationPolicy, err error) {
+	p.MaxHeight, err = options.Int(OptionMaxHeight)
+	return p, err
+}
+
+// Select chooses the highest bandwidth video representation within the limits (videos of unknown height are
+// allowed), and the highest bandwidth audio representation in the same container. The result is either video and
+// audio to be muxed together, or a single representation if there is only video (which might already include audio)
+// or only audio.
+func (p RepresentationPolicy) Select(sets []AdaptationSet) ([]*Representation, error) {
+	var video, audio *Representation
+	for i := range sets {
+		for j := range sets[i].Representations {
+			rep := &sets[i].Representations[j]
+			if rep.Kind() != "video" || (p.MaxHeight > 0 && rep.Height > p.MaxHeight) {
+				continue
+			}
+			if video == nil || rep.Bandwidth > video.Bandwidth {
+				video = rep
+			}
+		}
+	}
+	for i := range sets {
+		for j := range sets[i].Representations {
+			rep := &sets[i].Representations[j]
+			if rep.Kind() != "audio" || (video != nil && rep.Container() != video.Container()) {
+				continue
+			}
+			if audio == nil || rep.Bandwidth > audio.Bandwidth {
+				audio = rep
+			}
+		}
+	}
+	switch {
+	case video != nil && audio != nil:
+		return []*Representation{video, audio}, nil
+	case video != nil:
+		return []*Representation{video}, nil
+	case audio != nil:
+		return []*Representation{audio}, nil
+	default:
+		return nil, ErrNoRepresentation
+	}
+}
+
+func Match(s string) (video_archiver.Source, error) {
+	parsedURL, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !protocols.Contains(parsedURL.Scheme) {
+		return nil, fmt.Errorf("unknown URL scheme %v", parsedURL.Scheme)
+	}
+	filename, err := util.FilenameFromURL(parsedURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(path.Ext(filename)) != ".mpd" {
+		return nil, fmt.Errorf("not an .mpd URL")
+	}
+	return &source{url: s, name: strings.TrimSuffix(filename, path.Ext(filename))}, nil
+}
+
+func New() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:         "dash",
+		Match:        Match,
+		Description:  "MPEG-DASH manifests, saved as a single file",
+		Patterns:     []string{"*.mpd"},
+		Examples:     []string{"https://example.com/vod/manifest.mpd"},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityAudio | video_archiver.CapabilityMetadata,
+	}
+}
+
+type source struct {
+	url  string
+	name string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	options := video_archiver.OptionsFromContext(ctx)
+	policy, err := RepresentationPolicyFromOptions(options)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	retries, err := segmented.RetriesFromOptions(options, OptionSegmentRetries)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+
+	mpd, base, err := fetchManifest(ctx, s.url)
+	if err != nil {
+		return nil, err
+	}
+	if mpd.Type == "dynamic" {
+		return nil, video_archiver.Permanent(ErrLiveStream)
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: no periods", ErrInvalidManifest))
+	} else if len(mpd.Periods) > 1 {
+		// Each period can have different representations, which would have to be chosen and joined up separately
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: found %d", ErrMultiplePeriods, len(mpd.Periods)))
+	}
+	period := &mpd.Periods[0]
+	resolved := &resolvedSource{source: *s, retries: retries}
+	for _, d := range []string{period.Duration, mpd.MediaPresentationDuration} {
+		if d != "" {
+			if resolved.duration, err = parseDuration(d); err != nil {
+				return nil, video_archiver.Permanent(err)
+			}
+			break
+		}
+	}
+	if base, err = resolveBaseURL(base, mpd.BaseURL); err == nil {
+		base, err = resolveBaseURL(base, period.BaseURL)
+	}
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	if resolved.representations, err = policy.Select(period.AdaptationSets); err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	fetchIndex := func(seg segment) ([]byte, error) {
+		return segmented.Get(ctx, seg)
+	}
+	for _, rep := range resolved.representations {
+		segments, err := rep.segments(base, resolved.duration, fetchIndex)
+		if errors.Is(err, ErrInvalidManifest) {
+			return nil, video_archiver.Permanent(err)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get segment index: %w", err)
+		}
+		resolved.segments = append(resolved.segments, segments)
+	}
+	return resolved, nil
+}
+
+// fetchManifest gets and parses the manifest, also returning the URL it ended up at after any redirects, which
+// relative URLs are resolved against.
+func fetchManifest(ctx context.Context, manifestURL string) (*MPD, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, nil, video_archiver.Permanent(err)
+	}
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to get manifest: %w", video_archiver.NewHTTPError(resp))
+	}
+	mpd, err := ParseMPD(resp.Body)
+	if err != nil {
+		return nil, nil, video_archiver.Permanent(err)
+	}
+	return mpd, resp.Request.URL, nil
+}
+
+type resolvedSource struct {
+	source
+	duration time.Duration
+	// Either a single representation, or separate video and audio representations to be muxed together
+	representations []*Representation
+	// Segments of each representation
+	segments [][]segment
+	retries  int
+}
+
+func (s *resolvedSource) String() string {
+	return s.name
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	var segments int
+	var bandwidth int64
+	var codecs []string
+	for i, rep := range s.representations {
+		segments += len(s.segments[i])
+		bandwidth += rep.Bandwidth
+		if rep.Codecs != "" {
+			codecs = append(codecs, rep.Codecs)
+		}
+	}
+	metadata := map[string]string{
+		"dash.segments":  fmt.Sprint(segments),
+		"dash.duration":  s.duration.Round(time.Second).String(),
+		"dash.bandwidth": fmt.Sprint(bandwidth),
+	}
+	if len(codecs) > 0 {
+		metadata["dash.codecs"] = strings.Join(codecs, ",")
+	}
+	if rep := s.representations[0]; rep.Width > 0 && rep.Height > 0 {
+		metadata["dash.resolution"] = fmt.Sprintf("%dx%d", rep.Width, rep.Height)
+	}
+	return metadata
+}
+
+// getFilename is named after the manifest, with an extension for the container, or ".m4a" for MP4 audio.
+func (s *resolvedSource) getFilename() string {
+	rep := s.representations[0]
+	ext := rep.Container()
+	if ext == "mp4" && rep.Kind() == "audio" {
+		ext = "m4a"
+	}
+	return s.name + "." + ext
+}
+
+// Download fetches the segments of each representation in turn. A single representation is saved directly, otherwise
+// each is saved to a temporary file and then they are muxed together.
+func (s *resolvedSource) Download(d video_archiver.Download) error {
+	var total int
+	for _, segments := range s.segments {
+		total += len(segments)
+	}
+	progress := segmented.NewProgress(d, total)
+	if len(s.representations) == 1 {
+		return s.saveRepresentation(d, progress, 0, func(r io.Reader) error {
+			return d.SaveStream(s.getFilename(), r)
+		})
+	}
+
+	paths := make([]string, len(s.representations))
+	for i, rep := range s.representations {
+		err := s.saveRepresentation(d, progress, i, func(r io.Reader) (err error) {
+			paths[i], err = d.TempSaveStream(fmt.Sprintf("%s-*.%s", rep.Kind(), rep.Container()), r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	f, err := d.CreateFile(s.getFilename())
+	if err != nil {
+		return fmt.Errorf("failed to open target file: %w", err)
+	}
+	defer f.Close()
+	if err := mux.MuxFiles(f, s.representations[0].Container(), paths...); err != nil {
+		return video_archiver.Permanent(fmt.Errorf("failed to mux streams: %w", err))
+	}
+	return f.Close()
+}
+
+// saveRepresentation calls save with a reader of the concatenated segments of the i'th representation.
+func (s *resolvedSource) saveRepresentation(d video_archiver.Download, progress *segmented.Progress, i int, save func(io.Reader) error) error {
+	r := &segmentReader{source: s, d: d, progress: progress, segments: s.segments[i]}
+	if err := save(r); err != nil {
+		if r.err != nil {
+			// Report the original error, rather than however the save wrapped it
+			return r.err
+		}
+		return err
+	}
+	return nil
+}
+
+// A segmentReader reads the segments of a representation, fetching each one as it is needed.
+type segmentReader struct {
+	source   *resolvedSource
+	d        video_archiver.Download
+	progress *segmented.Progress
+	segments []segment
+	next     int
+	buf      []byte
+	err      error
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.next >= len(r.segments) {
+			return 0, io.EOF
+		}
+		if r.buf, r.err = segmented.Fetch(r.d.Context(), r.source.retries, r.segments[r.next]); r.err != nil {
+			r.err = fmt.Errorf("failed to get segment %d: %w", r.next, r.err)
+			return 0, r.err
+		}
+		r.next++
+		r.progress.Add(len(r.buf))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func init() {
+	// Only matches .mpd URLs, so only needs to be ahead of the catch-all providers
+	video_archiver.DefaultProviderRegistry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 5))
+}
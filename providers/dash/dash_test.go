@@ -0,0 +1,263 @@
+package dash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/internal/segmented"
+)
+
+func makeBox(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], typ)
+	return append(box, payload...)
+}
+
+// fullBox makes a full box payload with the field at offset set to value.
+func fullBox(size int, offset int, value uint32) []byte {
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint32(payload[offset:], value)
+	return payload
+}
+
+// makeTestInit creates the initialisation segment of a fragmented MP4 with a single track.
+func makeTestInit(timescale uint32) []byte {
+	return bytes.Join([][]byte{
+		makeBox("ftyp", []byte("iso5\x00\x00\x02\x00iso6mp41")),
+		makeBox("moov",
+			makeBox("mvhd", fullBox(100, 96, 2)),
+			makeBox("trak",
+				makeBox("tkhd", fullBox(84, 12, 1)),
+				makeBox("mdia", makeBox("mdhd", fullBox(24, 12, timescale))),
+			),
+			makeBox("mvex", makeBox("trex", fullBox(24, 4, 1))),
+		),
+	}, nil)
+}
+
+// makeTestFragment creates a fragmented MP4 media segment starting at time t (in the track's timescale).
+func makeTestFragment(sequence uint32, t uint64, data string) []byte {
+	tfhd := fullBox(8, 4, 1)
+	tfhd[1] = 0x02 // default-base-is-moof
+	tfdt := make([]byte, 12)
+	tfdt[0] = 1
+	binary.BigEndian.PutUint64(tfdt[4:], t)
+	return bytes.Join([][]byte{
+		makeBox("moof",
+			makeBox("mfhd", fullBox(8, 4, sequence)),
+			makeBox("traf", makeBox("tfhd", tfhd), makeBox("tfdt", tfdt)),
+		),
+		makeBox("mdat", []byte(data)),
+	}, nil)
+}
+
+// makeTestSidx creates a version 0 segment index box referencing media of the given sizes.
+func makeTestSidx(sizes ...uint32) []byte {
+	payload := make([]byte, 24+12*len(sizes))
+	binary.BigEndian.PutUint16(payload[22:], uint16(len(sizes)))
+	for i, size := range sizes {
+		binary.BigEndian.PutUint32(payload[24+12*i:], size)
+	}
+	return makeBox("sidx", payload)
+}
+
+var testBaseFile = bytes.Join([][]byte{[]byte("INIT"), makeTestSidx(4, 5), []byte("seg1seg22")}, nil)
+
+// newTestServer serves the manifests in testdata, and the segments they refer to.
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	failures := 1
+	var requests []string
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	mux.HandleFunc("/v720/init.mp4", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(makeTestInit(1000))
+	})
+	mux.HandleFunc("/a128/init.mp4", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(makeTestInit(48000))
+	})
+	for i := 0; i < 3; i++ {
+		video := makeTestFragment(uint32(i+1), uint64(i*2000), fmt.Sprintf("video%d", i))
+		audio := makeTestFragment(uint32(i+1), uint64(i*96000), fmt.Sprintf("audio%d", i))
+		mux.HandleFunc(fmt.Sprintf("/v720/seg-%03d.m4s", i+1), func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(video)
+		})
+		mux.HandleFunc(fmt.Sprintf("/a128/seg-%d.m4s", i*96000), func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(audio)
+		})
+	}
+	mux.HandleFunc("/media/list.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "list.bin", time.Time{}, strings.NewReader("INITaaaaabbbbxx"))
+	})
+	mux.HandleFunc("/base.m4a", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=64-68" && failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "base.m4a", time.Time{}, bytes.NewReader(testBaseFile))
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.URL.Path
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			request += " " + byteRange
+		}
+		requests = append(requests, request)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func download(t *testing.T, ctx context.Context, s string) (string, video_archiver.ResolvedSource, error) {
+	source, err := Match(s)
+	if err != nil {
+		return "", nil, err
+	}
+	resolved, err := source.Recon(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := t.TempDir()
+	d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+		WithContext(ctx).
+		WithTargetPrefix(dir + string(os.PathSeparator)).
+		WithTempPath(t.TempDir()).
+		Build())
+	defer d.Close()
+	if err := resolved.Download(d); err != nil {
+		return "", resolved, err
+	}
+	generic.Unwrap_(d.Commit())
+	return dir, resolved, nil
+}
+
+// mdatPayloads gets the contents of each top-level mdat box of an MP4 file.
+func mdatPayloads(data []byte) []string {
+	var payloads []string
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data)
+		if string(data[4:8]) == "mdat" {
+			payloads = append(payloads, string(data[8:size]))
+		}
+		data = data[size:]
+	}
+	return payloads
+}
+
+func TestDownload(t *testing.T) {
+	assert := assert_.New(t)
+	segmented.RetryDelay = time.Millisecond
+	server, requests := newTestServer(t)
+	ctx := context.Background()
+
+	// SegmentTemplate: highest bandwidth video, and audio in the same container, muxed together
+	dir, resolved, err := download(t, ctx, server.URL+"/template.mpd")
+	if assert.NoError(err) {
+		data := generic.Unwrap(os.ReadFile(filepath.Join(dir, "template.mp4")))
+		assert.Equal("ftyp", string(data[4:8]))
+		assert.Equal([]string{"video0", "audio0", "video1", "audio1", "video2", "audio2"}, mdatPayloads(data))
+		assert.Equal(map[string]string{
+			"dash.segments":   "8",
+			"dash.duration":   "6s",
+			"dash.bandwidth":  "2128000",
+			"dash.codecs":     "avc1.4d401f,mp4a.40.2",
+			"dash.resolution": "1280x720",
+		}, resolved.(video_archiver.MetadataSource).Metadata())
+		assert.Equal([]string{
+			"/template.mpd",
+			"/v720/init.mp4", "/v720/seg-001.m4s", "/v720/seg-002.m4s", "/v720/seg-003.m4s",
+			"/a128/init.mp4", "/a128/seg-0.m4s", "/a128/seg-96000.m4s", "/a128/seg-192000.m4s",
+		}, *requests)
+	}
+
+	// SegmentList with byte ranges, relative to the manifest's BaseURL
+	dir, _, err = download(t, ctx, server.URL+"/list.mpd")
+	if assert.NoError(err) {
+		assert.Equal("INITaaaaabbbb", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "list.mp4")))))
+	}
+
+	// SegmentBase: the index is fetched to find the segments, and a failed segment is retried
+	*requests = nil
+	dir, _, err = download(t, ctx, server.URL+"/base.mpd")
+	if assert.NoError(err) {
+		assert.Equal(testBaseFile, generic.Unwrap(os.ReadFile(filepath.Join(dir, "base.m4a"))))
+		assert.Equal([]string{
+			"/base.mpd", "/base.m4a bytes=4-59",
+			"/base.m4a bytes=0-59", "/base.m4a bytes=60-63", "/base.m4a bytes=64-68", "/base.m4a bytes=64-68",
+		}, *requests)
+	}
+
+	_, _, err = download(t, ctx, server.URL+"/live.mpd")
+	assert.ErrorIs(err, ErrLiveStream)
+	assert.False(video_archiver.IsTransient(err))
+	_, _, err = download(t, ctx, server.URL+"/periods.mpd")
+	assert.ErrorIs(err, ErrMultiplePeriods)
+	assert.False(video_archiver.IsTransient(err))
+	_, _, err = download(t, video_archiver.WithOptions(ctx, video_archiver.Options{OptionMaxHeight: "240"}), server.URL+"/list.mpd")
+	assert.ErrorIs(err, ErrNoRepresentation)
+	_, err = Match(server.URL + "/video.m3u8")
+	assert.Error(err)
+}
+
+func TestSegments(t *testing.T) {
+	assert := assert_.New(t)
+	base := generic.Unwrap(url.Parse("https://example.com/video/manifest.mpd"))
+	urls := func(segments []segment) []string {
+		var urls []string
+		for _, s := range segments {
+			urls = append(urls, s.URL)
+		}
+		return urls
+	}
+
+	mpd := generic.Unwrap(ParseMPD(strings.NewReader(`<MPD><Period><AdaptationSet mimeType="video/webm">
+		<BaseURL>https://cdn.example.com/</BaseURL>
+		<SegmentTemplate media="$RepresentationID$/$Bandwidth$/$Time%08d$-$Number$$$.webm" startNumber="0">
+			<SegmentTimeline><S t="100" d="10" r="1"/><S d="5"/><S t="200" d="50" r="-1"/></SegmentTimeline>
+		</SegmentTemplate>
+		<Representation id="r1" bandwidth="1000"/>
+	</AdaptationSet></Period></MPD>`)))
+	rep := &mpd.Periods[0].AdaptationSets[0].Representations[0]
+	assert.Equal("video", rep.Kind())
+	assert.Equal("webm", rep.Container())
+	assert.Equal([]string{
+		"https://cdn.example.com/r1/1000/00000100-0$.webm",
+		"https://cdn.example.com/r1/1000/00000110-1$.webm",
+		"https://cdn.example.com/r1/1000/00000120-2$.webm",
+		"https://cdn.example.com/r1/1000/00000200-3$.webm",
+		"https://cdn.example.com/r1/1000/00000250-4$.webm",
+	}, urls(generic.Unwrap(rep.segments(base, 300*time.Second, nil))))
+
+	for s, expected := range map[string]time.Duration{
+		"PT1H2M3.5S": time.Hour + 2*time.Minute + 3500*time.Millisecond,
+		"P1DT1S":     24*time.Hour + time.Second,
+		"PT0.25S":    250 * time.Millisecond,
+	} {
+		assert.Equal(expected, generic.Unwrap(parseDuration(s)), s)
+	}
+	for _, s := range []string{"", "P", "PT", "1H", "PT1X"} {
+		_, err := parseDuration(s)
+		assert.ErrorIs(err, ErrInvalidManifest, s)
+	}
+
+	_, _, err := parseSidx(makeBox("moof"))
+	assert.ErrorIs(err, ErrInvalidManifest)
+	_, err = ParseMPD(strings.NewReader("not xml"))
+	assert.ErrorIs(err, ErrInvalidManifest)
+}
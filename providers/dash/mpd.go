@@ -0,0 +1,418 @@
+package dash
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alanbriolat/video-archiver/providers/internal/segmented"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// MPD is the subset of a DASH media presentation description needed to download it.
+type MPD struct {
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string   `xml:"BaseURL"`
+	Periods                   []Period `xml:"Period"`
+}
+
+type Period struct {
+	Duration       string          `xml:"duration,attr"`
+	BaseURL        string          `xml:"BaseURL"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+// An AdaptationSet is a set of interchangeable representations, e.g. the same video at different resolutions.
+// Attributes and segment information are inherited by its representations.
+type AdaptationSet struct {
+	ContentType     string           `xml:"contentType,attr"`
+	MimeType        string           `xml:"mimeType,attr"`
+	Codecs          string           `xml:"codecs,attr"`
+	BaseURL         string           `xml:"BaseURL"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	Representations []Representation `xml:"Representation"`
+}
+
+type Representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       int64            `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr"`
+	Height          int              `xml:"height,attr"`
+	MimeType        string           `xml:"mimeType,attr"`
+	Codecs          string           `xml:"codecs,attr"`
+	BaseURL         string           `xml:"BaseURL"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	adaptationSet   *AdaptationSet
+}
+
+// A SegmentTemplate generates segment URLs from a pattern, e.g. "video-$Number%05d$.m4s".
+type SegmentTemplate struct {
+	Media          string `xml:"media,attr"`
+	Initialization string `xml:"initialization,attr"`
+	// Pointer so that it defaults to 1 rather than 0
+	StartNumber     *int64           `xml:"startNumber,attr"`
+	Timescale       int64            `xml:"timescale,attr"`
+	Duration        int64            `xml:"duration,attr"`
+	SegmentTimeline *SegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type SegmentTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+// A SegmentList lists the URL (and optionally byte range) of each segment.
+type SegmentList struct {
+	Initialization *URLType `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// A SegmentBase is a single file, with an index (a "sidx" box) of its segments.
+type SegmentBase struct {
+	IndexRange     string   `xml:"indexRange,attr"`
+	Initialization *URLType `xml:"Initialization"`
+}
+
+type URLType struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// ParseMPD parses a DASH manifest. Attributes and segment information of each AdaptationSet are copied to its
+// representations unless they override them.
+func ParseMPD(r io.Reader) (*MPD, error) {
+	mpd := &MPD{}
+	if err := xml.NewDecoder(r).Decode(mpd); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	for i := range mpd.Periods {
+		for j := range mpd.Periods[i].AdaptationSets {
+			as := &mpd.Periods[i].AdaptationSets[j]
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				rep.adaptationSet = as
+				if rep.MimeType == "" {
+					rep.MimeType = as.MimeType
+				}
+				if rep.Codecs == "" {
+					rep.Codecs = as.Codecs
+				}
+				if rep.SegmentTemplate == nil && rep.SegmentList == nil && rep.SegmentBase == nil {
+					rep.SegmentTemplate, rep.SegmentList, rep.SegmentBase = as.SegmentTemplate, as.SegmentList, as.SegmentBase
+				}
+			}
+		}
+	}
+	return mpd, nil
+}
+
+// Kind is "video", "audio", or something else (e.g. "text") that can't be downloaded.
+func (rep *Representation) Kind() string {
+	if kind, _, ok := strings.Cut(rep.MimeType, "/"); ok {
+		return kind
+	}
+	return rep.adaptationSet.ContentType
+}
+
+// Container is the file format of the representation, e.g. "mp4" or "webm".
+func (rep *Representation) Container() string {
+	_, container, _ := strings.Cut(rep.MimeType, "/")
+	return container
+}
+
+// A segment is part of a representation to download, either the whole resource or a byte range of it.
+type segment = segmented.Request
+
+// A segmentIndexFetcher gets the "sidx" box from a SegmentBase representation, so the segments can be found.
+type segmentIndexFetcher func(s segment) ([]byte, error)
+
+// segments lists everything to download for the representation, in order: the initialisation segment (if separate)
+// followed by the media segments. The base is the period's base URL.
+func (rep *Representation) segments(base *url.URL, duration time.Duration, fetchIndex segmentIndexFetcher) ([]segment, error) {
+	base, err := resolveBaseURL(base, rep.adaptationSet.BaseURL)
+	if err == nil {
+		base, err = resolveBaseURL(base, rep.BaseURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rep.SegmentTemplate != nil:
+		return rep.templateSegments(base, rep.SegmentTemplate, duration)
+	case rep.SegmentList != nil:
+		return listSegments(base, rep.SegmentList)
+	case rep.SegmentBase != nil && rep.SegmentBase.IndexRange != "":
+		return indexedSegments(base.String(), rep.SegmentBase, fetchIndex)
+	default:
+		// Just a single file
+		return []segment{{URL: base.String()}}, nil
+	}
+}
+
+func (rep *Representation) templateSegments(base *url.URL, t *SegmentTemplate, duration time.Duration) ([]segment, error) {
+	var segments []segment
+	if t.Initialization != "" {
+		u, err := resolveURL(base, rep.expandTemplate(t.Initialization, 0, 0))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{URL: u})
+	}
+	number := int64(1)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+	timescale := t.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	end := int64(math.Ceil(duration.Seconds() * float64(timescale)))
+	add := func(time int64) error {
+		u, err := resolveURL(base, rep.expandTemplate(t.Media, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, segment{URL: u})
+		number++
+		return nil
+	}
+	if t.SegmentTimeline != nil {
+		var time int64
+		for i, s := range t.SegmentTimeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, fmt.Errorf("%w: invalid segment duration", ErrInvalidManifest)
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Repeat until the next S element, or the end of the period
+				until := end
+				if i+1 < len(t.SegmentTimeline.S) && t.SegmentTimeline.S[i+1].T != nil {
+					until = *t.SegmentTimeline.S[i+1].T
+				}
+				repeat = (until-time+s.D-1)/s.D - 1
+			}
+			for j := int64(0); j <= repeat; j++ {
+				if err := add(time); err != nil {
+					return nil, err
+				}
+				time += s.D
+			}
+		}
+	} else if t.Duration > 0 {
+		if end <= 0 {
+			return nil, fmt.Errorf("%w: unknown duration", ErrInvalidManifest)
+		}
+		for time := int64(0); time < end; time += t.Duration {
+			if err := add(time); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("%w: segment template without duration or timeline", ErrInvalidManifest)
+	}
+	return segments, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time|)(%0(\d+)d)?\$`)
+
+// expandTemplate substitutes the identifiers in a SegmentTemplate pattern, e.g. "$Number%05d$" becomes "00042".
+func (rep *Representation) expandTemplate(pattern string, number int64, time int64) string {
+	return templateIdentifier.ReplaceAllStringFunc(pattern, func(match string) string {
+		parts := templateIdentifier.FindStringSubmatch(match)
+		var value int64
+		switch parts[1] {
+		case "":
+			return "$"
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Bandwidth":
+			value = rep.Bandwidth
+		case "Time":
+			value = time
+		}
+		width, _ := strconv.Atoi(parts[3])
+		return fmt.Sprintf("%0*d", width, value)
+	})
+}
+
+func listSegments(base *url.URL, list *SegmentList) ([]segment, error) {
+	var segments []segment
+	if list.Initialization != nil {
+		s, err := urlSegment(base, list.Initialization.SourceURL, list.Initialization.Range)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	for _, u := range list.SegmentURLs {
+		s, err := urlSegment(base, u.Media, u.MediaRange)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// indexedSegments gets the segments of a single file from its segment index: the first segment is everything up to
+// the end of the index (including the initialisation), followed by each of the indexed subsegments.
+func indexedSegments(u string, segmentBase *SegmentBase, fetchIndex segmentIndexFetcher) ([]segment, error) {
+	indexOffset, indexLength, err := parseRange(segmentBase.IndexRange)
+	if err != nil {
+		return nil, err
+	}
+	index, err := fetchIndex(segment{URL: u, Offset: indexOffset, Length: indexLength})
+	if err != nil {
+		return nil, err
+	}
+	sizes, firstOffset, err := parseSidx(index)
+	if err != nil {
+		return nil, err
+	}
+	offset := indexOffset + int64(len(index)) + firstOffset
+	segments := []segment{{URL: u, Offset: 0, Length: offset}}
+	for _, size := range sizes {
+		segments = append(segments, segment{URL: u, Offset: offset, Length: size})
+		offset += size
+	}
+	return segments, nil
+}
+
+// parseSidx parses a segment index box, returning the size of each subsegment and the offset of the first
+// subsegment from the end of the box.
+func parseSidx(box []byte) (sizes []int64, firstOffset int64, err error) {
+	invalid := fmt.Errorf("%w: invalid segment index", ErrInvalidManifest)
+	if len(box) < 12 || string(box[4:8]) != "sidx" || int(binary.BigEndian.Uint32(box)) != len(box) {
+		return nil, 0, invalid
+	}
+	version := box[8]
+	pos := 20 // size, type, version & flags, reference_ID, timescale
+	if version == 0 {
+		pos += 4
+		if len(box) < pos+4 {
+			return nil, 0, invalid
+		}
+		firstOffset = int64(binary.BigEndian.Uint32(box[pos:]))
+		pos += 4
+	} else {
+		pos += 8
+		if len(box) < pos+8 {
+			return nil, 0, invalid
+		}
+		firstOffset = int64(binary.BigEndian.Uint64(box[pos:]))
+		pos += 8
+	}
+	if len(box) < pos+4 {
+		return nil, 0, invalid
+	}
+	count := int(binary.BigEndian.Uint16(box[pos+2:]))
+	pos += 4
+	if len(box) < pos+count*12 {
+		return nil, 0, invalid
+	}
+	for i := 0; i < count; i++ {
+		reference := binary.BigEndian.Uint32(box[pos:])
+		if reference&0x80000000 != 0 {
+			// Reference to another index, rather than media
+			return nil, 0, fmt.Errorf("%w: hierarchical segment index", ErrInvalidManifest)
+		}
+		sizes = append(sizes, int64(reference&0x7fffffff))
+		pos += 12
+	}
+	return sizes, firstOffset, nil
+}
+
+func urlSegment(base *url.URL, sourceURL string, byteRange string) (segment, error) {
+	s := segment{URL: base.String()}
+	if sourceURL != "" {
+		u, err := resolveURL(base, sourceURL)
+		if err != nil {
+			return s, err
+		}
+		s.URL = u
+	}
+	if byteRange != "" {
+		var err error
+		if s.Offset, s.Length, err = parseRange(byteRange); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// parseRange parses an inclusive byte range, e.g. "0-499".
+func parseRange(s string) (offset int64, length int64, err error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: invalid byte range %#v", ErrInvalidManifest, s)
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return 0, 0, fmt.Errorf("%w: invalid byte range %#v", ErrInvalidManifest, s)
+	}
+	return start, end - start + 1, nil
+}
+
+func resolveBaseURL(base *url.URL, s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return base, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	return base.ResolveReference(u), nil
+}
+
+func resolveURL(base *url.URL, s string) (string, error) {
+	u, err := resolveBaseURL(base, s)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+var durationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration parses an ISO 8601 duration as used by DASH, e.g. "PT1H2M3.5S".
+func parseDuration(s string) (time.Duration, error) {
+	parts := durationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if parts == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("%w: invalid duration %#v", ErrInvalidManifest, s)
+	}
+	var total float64
+	for i, unit := range []float64{24 * 3600, 3600, 60, 1} {
+		if parts[i+1] != "" {
+			value, _ := strconv.ParseFloat(parts[i+1], 64)
+			total += value * unit
+		}
+	}
+	return time.Duration(total * float64(time.Second)), nil
+}
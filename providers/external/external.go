@@ -0,0 +1,301 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// How long a helper gets to respond to a match or recon request, unless configured otherwise.
+const DefaultTimeout = 30 * time.Second
+
+// Config describes a helper (see the package documentation for the protocol it must speak).
+type Config struct {
+	// Name of the provider.
+	Name string `json:"name"`
+	// Command to run the helper: the executable followed by any arguments.
+	Command []string `json:"command"`
+	// Priority of the provider, lower means matching earlier (see video_archiver.Provider).
+	Priority int16 `json:"priority"`
+	// Regular expressions for the URLs the helper handles. If set, they are used instead of asking the helper.
+	Patterns []string `json:"patterns,omitempty"`
+	// Extra environment variables for the helper.
+	Env map[string]string `json:"env,omitempty"`
+	// Time limit for match and recon requests, e.g. "10s". Downloads take as long as they take.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// The rest describes the provider to users (see video_archiver.Provider).
+
+	Description string   `json:"description,omitempty"`
+	Hosts       []string `json:"hosts,omitempty"`
+	// URLs the helper should match, which are checked by video_archiver.ProviderRegistry.CheckExamples.
+	Examples []string `json:"examples,omitempty"`
+	// What the helper can produce, e.g. ["video", "subtitles"] (see video_archiver.ParseCapabilities).
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	patterns     []*regexp.Regexp
+	capabilities video_archiver.Capability
+}
+
+// ConfigFile is the format of a file of helper configurations, e.g.
+//
+//	{"providers": [{"name": "example", "command": ["/usr/local/bin/example-helper"], "priority": 100}]}
+type ConfigFile struct {
+	Providers []Config `json:"providers"`
+}
+
+// A Duration is a time.Duration that is written as a string in JSON, e.g. "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Duration gets the time.Duration, or DefaultTimeout if not set.
+func (d Duration) Duration() time.Duration {
+	if d <= 0 {
+		return DefaultTimeout
+	}
+	return time.Duration(d)
+}
+
+// Validate checks the configuration is complete, and prepares it for use.
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing provider name")
+	}
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("provider %v: missing command", c.Name)
+	}
+	c.patterns = nil
+	for _, pattern := range c.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("provider %v: invalid pattern: %w", c.Name, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	capabilities, err := video_archiver.ParseCapabilities(c.Capabilities)
+	if err != nil {
+		return fmt.Errorf("provider %v: %w", c.Name, err)
+	}
+	c.capabilities = capabilities
+	return nil
+}
+
+// LoadConfigFile reads and validates the helper configurations in a ConfigFile.
+func LoadConfigFile(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file ConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid provider config %v: %w", path, err)
+	}
+	for i := range file.Providers {
+		if err := file.Providers[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid provider config %v: %w", path, err)
+		}
+	}
+	return file.Providers, nil
+}
+
+// RegisterFile adds a provider to the registry for each helper configured in a ConfigFile.
+func RegisterFile(r *video_archiver.ProviderRegistry, path string) error {
+	configs, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, c := range configs {
+		if err := r.Add(c.Provider()); err != nil {
+			return fmt.Errorf("failed to add provider %v: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// Provider creates the provider for the helper. The Config must have been validated.
+func (c Config) Provider() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:         c.Name,
+		Match:        c.Match,
+		Priority:     c.Priority,
+		Description:  c.Description,
+		Hosts:        c.Hosts,
+		Patterns:     c.Patterns,
+		Examples:     c.Examples,
+		Capabilities: c.capabilities,
+	}
+}
+
+// Match uses the configured patterns if there are any, otherwise it asks the helper.
+func (c *Config) Match(s string) (video_archiver.Source, error) {
+	if len(c.patterns) > 0 {
+		for _, re := range c.patterns {
+			if re.MatchString(s) {
+				return &source{config: c, url: s}, nil
+			}
+		}
+		return nil, fmt.Errorf("no pattern matched")
+	}
+	var response MatchResponse
+	if err := c.call(context.Background(), Request{Action: ActionMatch, URL: s}, &response); err != nil {
+		return nil, err
+	}
+	if !response.Match {
+		if response.Error != "" {
+			return nil, errors.New(response.Error)
+		}
+		return nil, fmt.Errorf("helper did not match")
+	}
+	return &source{config: c, url: s}, nil
+}
+
+type source struct {
+	config *Config
+	url    string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	request := Request{Action: ActionRecon, URL: s.url, Options: video_archiver.OptionsFromContext(ctx)}
+	response := &ReconResponse{}
+	if err := s.config.call(ctx, request, response); err != nil {
+		return nil, err
+	}
+	if err := response.err(); err != nil {
+		return nil, err
+	}
+	if len(response.Downloads) == 0 && !response.SelfDownload {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: nothing to download", ErrHelper))
+	}
+	for _, download := range response.Downloads {
+		if err := checkFilename(download.Filename); err != nil {
+			return nil, err
+		}
+	}
+	return &resolvedSource{source: *s, response: response}, nil
+}
+
+type resolvedSource struct {
+	source
+	response *ReconResponse
+}
+
+func (s *resolvedSource) String() string {
+	if s.response.Name != "" {
+		return s.response.Name
+	}
+	return s.URL()
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := make(map[string]string, len(s.response.Metadata))
+	for key, value := range s.response.Metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+func (s *resolvedSource) Download(d video_archiver.Download) error {
+	if s.response.SelfDownload {
+		return s.selfDownload(d)
+	}
+	for _, download := range s.response.Downloads {
+		req, err := http.NewRequest(http.MethodGet, download.URL, nil)
+		if err != nil {
+			return video_archiver.Permanent(err)
+		}
+		for name, value := range download.Headers {
+			req.Header.Set(name, value)
+		}
+		if err := d.SaveHTTPRequest(download.Filename, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selfDownload has the helper write the files to a directory of its own, following its progress, and then copies the
+// files it reports into the download.
+func (s *resolvedSource) selfDownload(d video_archiver.Download) error {
+	dir, err := os.MkdirTemp("", "video-archiver-"+s.config.Name+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	request := Request{Action: ActionDownload, URL: s.url, Options: video_archiver.OptionsFromContext(d.Context()), Dir: dir}
+	var files []string
+	var last Progress
+	err = s.config.stream(d.Context(), request, func(event DownloadEvent) error {
+		if event.Progress != nil {
+			d.AddExpectedBytes(event.Progress.Expected - last.Expected)
+			d.AddDownloadedBytes(event.Progress.Downloaded - last.Downloaded)
+			last = *event.Progress
+		}
+		if event.File != "" {
+			if err := checkFilename(event.File); err != nil {
+				return err
+			}
+			files = append(files, event.File)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return video_archiver.Permanent(fmt.Errorf("%w: no files downloaded", ErrHelper))
+	}
+	for _, file := range files {
+		if err := copyFile(d, filepath.Join(dir, file), file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(d video_archiver.Download, src string, filename string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return video_archiver.Permanent(fmt.Errorf("%w: %v", ErrHelper, err))
+	}
+	defer in.Close()
+	out, err := d.CreateFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open target file: %w", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,187 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+const helperEnv = "VIDEO_ARCHIVER_TEST_HELPER"
+
+// TestMain lets the test binary stand in for a helper, when run with helperEnv set.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		runTestHelper()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runTestHelper() {
+	var request Request
+	generic.Unwrap_(json.NewDecoder(os.Stdin).Decode(&request))
+	u := generic.Unwrap(url.Parse(request.URL))
+	enc := json.NewEncoder(os.Stdout)
+	var response interface{}
+	switch request.Action {
+	case ActionMatch:
+		response = MatchResponse{Match: u.Host == "videos.example.com", Failure: Failure{Error: "wrong site"}}
+	case ActionRecon:
+		switch u.Path {
+		case "/direct":
+			response = ReconResponse{
+				Name:     "Direct video",
+				Metadata: map[string]string{"helper.quality": "best"},
+				Downloads: []FileDownload{{
+					URL:      request.Options["test.server"] + "/video.mp4",
+					Filename: "direct.mp4",
+					Headers:  map[string]string{"X-Token": "secret"},
+				}},
+			}
+		case "/self":
+			response = ReconResponse{Name: "Self-downloaded video", SelfDownload: true}
+		case "/unavailable":
+			response = ReconResponse{Failure: Failure{Error: "try again later", Transient: true}}
+		case "/escape":
+			response = ReconResponse{Downloads: []FileDownload{{URL: "https://videos.example.com/video.mp4", Filename: "../video.mp4"}}}
+		default:
+			fmt.Fprintln(os.Stderr, "helper crashed")
+			os.Exit(2)
+		}
+	case ActionDownload:
+		generic.Unwrap_(enc.Encode(DownloadEvent{Progress: &Progress{Downloaded: 0, Expected: 10}}))
+		generic.Unwrap_(os.WriteFile(filepath.Join(request.Dir, "self.txt"), []byte("0123456789"), 0644))
+		generic.Unwrap_(os.WriteFile(filepath.Join(request.Dir, "unreported.tmp"), []byte("junk"), 0644))
+		generic.Unwrap_(enc.Encode(DownloadEvent{Progress: &Progress{Downloaded: 10, Expected: 10}}))
+		response = DownloadEvent{File: "self.txt"}
+	}
+	generic.Unwrap_(enc.Encode(response))
+}
+
+func writeTestConfig(t *testing.T) string {
+	command := []string{os.Args[0]}
+	env := map[string]string{helperEnv: "1"}
+	file := ConfigFile{Providers: []Config{
+		{Name: "helper", Command: command, Env: env, Priority: 10},
+		{
+			Name:         "patterned",
+			Command:      command,
+			Env:          env,
+			Priority:     -10,
+			Patterns:     []string{`^https://patterned\.example\.com/`},
+			Description:  "Example site",
+			Examples:     []string{"https://patterned.example.com/self"},
+			Capabilities: []string{"video", "Subtitles"},
+		},
+	}}
+	path := filepath.Join(t.TempDir(), "providers.json")
+	generic.Unwrap_(os.WriteFile(path, generic.Unwrap(json.Marshal(file)), 0644))
+	return path
+}
+
+func download(t *testing.T, ctx context.Context, source video_archiver.Source) (string, video_archiver.ResolvedSource, video_archiver.Download, error) {
+	resolved, err := source.Recon(ctx)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dir := t.TempDir()
+	d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+		WithContext(ctx).
+		WithTargetPrefix(dir + string(os.PathSeparator)).
+		WithTempPath(t.TempDir()).
+		Build())
+	defer d.Close()
+	if err := resolved.Download(d); err != nil {
+		return "", resolved, d, err
+	}
+	generic.Unwrap_(d.Commit())
+	return dir, resolved, d, nil
+}
+
+func TestProvider(t *testing.T) {
+	assert := assert_.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/video.mp4" || r.Header.Get("X-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("direct video"))
+	}))
+	defer server.Close()
+	ctx := video_archiver.WithOptions(context.Background(), video_archiver.Options{"test.server": server.URL})
+
+	registry := &video_archiver.ProviderRegistry{}
+	if !assert.NoError(RegisterFile(registry, writeTestConfig(t))) {
+		return
+	}
+	assert.Equal([]string{"patterned", "helper"}, registry.List())
+	patterned := generic.Unwrap(registry.Get("patterned"))
+	assert.Equal("Example site", patterned.Description)
+	assert.Equal(video_archiver.CapabilityVideo|video_archiver.CapabilitySubtitles, patterned.Capabilities)
+	assert.Empty(registry.CheckExamples())
+
+	// Helper is asked whether it matches, unless there are patterns
+	match := generic.Unwrap(registry.Match("https://videos.example.com/direct"))
+	assert.Equal("helper", match.ProviderName)
+	assert.Equal("patterned", generic.Unwrap(registry.Match("https://patterned.example.com/self")).ProviderName)
+	_, err := registry.MatchWith("helper", "https://elsewhere.example.com/direct")
+	assert.Error(err)
+
+	// Provider downloads the files the helper describes
+	dir, resolved, _, err := download(t, ctx, match.Source)
+	if assert.NoError(err) {
+		assert.Equal("Direct video", resolved.String())
+		assert.Equal(map[string]string{"helper.quality": "best"}, resolved.(video_archiver.MetadataSource).Metadata())
+		assert.Equal("direct video", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "direct.mp4")))))
+	}
+
+	// Helper downloads the files itself, reporting progress, and only the files it reports are kept
+	dir, resolved, d, err := download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/self")).Source)
+	if assert.NoError(err) {
+		assert.Equal("Self-downloaded video", resolved.String())
+		assert.Equal("0123456789", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "self.txt")))))
+		assert.NoFileExists(filepath.Join(dir, "unreported.tmp"))
+		downloaded, expected := d.Progress()
+		assert.Equal(10, downloaded)
+		assert.Equal(10, expected)
+	}
+
+	_, _, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/unavailable")).Source)
+	assert.ErrorIs(err, ErrHelper)
+	assert.True(video_archiver.IsTransient(err))
+	_, _, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/escape")).Source)
+	assert.ErrorIs(err, ErrHelper)
+	_, _, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/crash")).Source)
+	if assert.ErrorIs(err, ErrHelper) {
+		assert.Contains(err.Error(), "helper crashed")
+		assert.False(video_archiver.IsTransient(err))
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	assert := assert_.New(t)
+	dir := t.TempDir()
+	for _, invalid := range []string{
+		`{"providers": [{"command": ["helper"]}]}`,
+		`{"providers": [{"name": "helper"}]}`,
+		`{"providers": [{"name": "helper", "command": ["helper"], "patterns": ["("]}]}`,
+		`{"providers": [{"name": "helper", "command": ["helper"], "timeout": "soon"}]}`,
+		`{"providers": [{"name": "helper", "command": ["helper"], "capabilities": ["teleportation"]}]}`,
+	} {
+		path := filepath.Join(dir, "providers.json")
+		generic.Unwrap_(os.WriteFile(path, []byte(invalid), 0644))
+		_, err := LoadConfigFile(path)
+		assert.Error(err, invalid)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Package external provides sources from helper programs, so that extractors written in other languages can be used
+without porting them to Go. Each helper is a provider, configured with a name, priority and command (see Config).
+
+# Protocol
+
+For each request the helper's command is run, a single JSON request is written to its stdin (which is then closed),
+and it writes its response to stdout. Anything written to stderr is included in the error if the helper fails. A
+request has the form:
+
+	{"action": "match" | "recon" | "download", "url": "<url>", "options": {"<key>": "<value>", ...}, "dir": "<dir>"}
+
+"options" are the provider options (see video_archiver.Options), and "dir" is only set for "download".
+
+"match" asks whether the helper can handle the URL, and the response is a single JSON object:
+
+	{"match": true | false, "error": "<why not>"}
+
+If the helper's configuration has patterns then they decide what matches, and "match" is never requested.
+
+"recon" gets information about the URL, and the response is a single JSON object:
+
+	{
+		"name": "<name to show for the download>",
+		"metadata": {"<key>": "<value>", ...},
+		"downloads": [{"url": "<url>", "filename": "<filename>", "headers": {"<name>": "<value>", ...}}, ...],
+		"self_download": true | false,
+		"error": "<message>",
+		"transient": true | false
+	}
+
+If "error" is set the recon failed, and "transient" says whether it is worth trying again later. Otherwise, each of
+"downloads" is fetched and saved as its filename. If instead "self_download" is true, the helper downloads the files
+itself in response to a "download" request.
+
+"download" asks the helper to write the files into "dir", and the response is a stream of JSON objects, one per line:
+
+	{"progress": {"downloaded": <bytes so far>, "expected": <total bytes>}}
+	{"file": "<filename written in dir>"}
+	{"error": "<message>", "transient": true | false}
+
+The download succeeded if the helper exits successfully without reporting an error, and only the reported files are
+kept.
+
+Filenames must be plain filenames, without any directory.
+*/
+package external
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// Actions of the protocol.
+const (
+	ActionMatch    = "match"
+	ActionRecon    = "recon"
+	ActionDownload = "download"
+)
+
+var ErrHelper = errors.New("helper failed")
+
+type Request struct {
+	Action  string                 `json:"action"`
+	URL     string                 `json:"url"`
+	Options video_archiver.Options `json:"options,omitempty"`
+	Dir     string                 `json:"dir,omitempty"`
+}
+
+// A Failure is how a helper reports an error, as part of any response.
+type Failure struct {
+	Error     string `json:"error,omitempty"`
+	Transient bool   `json:"transient,omitempty"`
+}
+
+func (f Failure) err() error {
+	if f.Error == "" {
+		return nil
+	}
+	err := fmt.Errorf("%w: %v", ErrHelper, f.Error)
+	if f.Transient {
+		return video_archiver.Transient(err)
+	}
+	return video_archiver.Permanent(err)
+}
+
+type MatchResponse struct {
+	Failure
+	Match bool `json:"match"`
+}
+
+type ReconResponse struct {
+	Failure
+	Name         string            `json:"name"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Downloads    []FileDownload    `json:"downloads,omitempty"`
+	SelfDownload bool              `json:"self_download,omitempty"`
+}
+
+// A FileDownload is a file for the provider to fetch and save.
+type FileDownload struct {
+	URL      string            `json:"url"`
+	Filename string            `json:"filename"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// A DownloadEvent is one line of the response to a download request.
+type DownloadEvent struct {
+	Failure
+	Progress *Progress `json:"progress,omitempty"`
+	File     string    `json:"file,omitempty"`
+}
+
+type Progress struct {
+	Downloaded int `json:"downloaded"`
+	Expected   int `json:"expected"`
+}
+
+// command creates the helper process for a request, with its stdin already set.
+func (c *Config) command(ctx context.Context, request Request) (*exec.Cmd, *bytes.Buffer, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = os.Environ()
+	for key, value := range c.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	return cmd, stderr, nil
+}
+
+// call runs the helper for a request with a single JSON response.
+func (c *Config) call(ctx context.Context, request Request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout.Duration())
+	defer cancel()
+	cmd, stderr, err := c.command(ctx, request)
+	if err != nil {
+		return video_archiver.Permanent(err)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return c.processError(ctx, err, stderr)
+	}
+	if err := json.Unmarshal(output, response); err != nil {
+		return video_archiver.Permanent(fmt.Errorf("%w: invalid %v response: %v", ErrHelper, request.Action, err))
+	}
+	return nil
+}
+
+// stream runs the helper for a download request, calling f for each event in the response.
+func (c *Config) stream(ctx context.Context, request Request, f func(DownloadEvent) error) error {
+	cmd, stderr, err := c.command(ctx, request)
+	if err != nil {
+		return video_archiver.Permanent(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return video_archiver.Permanent(fmt.Errorf("%w: %v", ErrHelper, err))
+	}
+	err = readEvents(stdout, f)
+	if err != nil {
+		// Don't leave the helper blocked writing to stdout
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = c.processError(ctx, waitErr, stderr)
+	}
+	return err
+}
+
+func readEvents(r io.Reader, f func(DownloadEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var event DownloadEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return video_archiver.Permanent(fmt.Errorf("%w: invalid download response: %v", ErrHelper, err))
+		}
+		if err := event.err(); err != nil {
+			return err
+		}
+		if err := f(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// processError explains why the helper process failed.
+func (c *Config) processError(ctx context.Context, err error, stderr *bytes.Buffer) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	message := strings.TrimSpace(stderr.String())
+	if message == "" {
+		message = err.Error()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return video_archiver.Permanent(fmt.Errorf("%w: %v", ErrHelper, message))
+	}
+	// Couldn't run the helper at all
+	return video_archiver.Permanent(fmt.Errorf("%w: %v: %v", ErrHelper, c.Command[0], err))
+}
+
+// checkFilename makes sure a helper can't write outside the download's directory.
+func checkFilename(filename string) error {
+	if filename == "" || filename != filepath.Base(filename) || filename == "." || filename == ".." {
+		return video_archiver.Permanent(fmt.Errorf("%w: invalid filename %#v", ErrHelper, filename))
+	}
+	return nil
+}
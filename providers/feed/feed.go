@@ -0,0 +1,371 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+var ErrItemNotFound = errors.New("item not found in feed")
+
+var protocols = generic.NewSet("http", "https")
+
+// URLs with these extensions, or with a path segment in feedSegments, are assumed to be feeds.
+var (
+	feedExtensions = generic.NewSet(".rss", ".atom", ".rdf", ".xml")
+	feedSegments   = generic.NewSet("feed", "feeds", "rss", "atom", "podcast", "podcasts")
+)
+
+// Each item of a feed is a separate download, with the item's ID in the fragment of the feed's URL, so that it can be
+// matched again (e.g. when a download is restored). The fragment also has what's needed to download the item, so that
+// the feed doesn't have to be fetched again for each of its items.
+const (
+	itemFragmentKey      = "item"
+	mediaFragmentKey     = "media"
+	typeFragmentKey      = "type"
+	titleFragmentKey     = "title"
+	publishedFragmentKey = "published"
+	authorFragmentKey    = "author"
+	feedFragmentKey      = "feed"
+)
+
+// Extensions for common media types, used when the media URL doesn't have one.
+var extensions = map[string]string{
+	"audio/aac":       ".aac",
+	"audio/mp4":       ".m4a",
+	"audio/mpeg":      ".mp3",
+	"audio/ogg":       ".ogg",
+	"audio/x-m4a":     ".m4a",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+	"video/x-m4v":     ".m4v",
+}
+
+// looksLikeFeed guesses from a URL whether it is a feed, e.g. "/podcast.rss", "/feed/", "?feed=rss2" or
+// "feeds.example.com".
+func looksLikeFeed(u *url.URL) bool {
+	if strings.HasPrefix(u.Hostname(), "feeds.") {
+		return true
+	}
+	if feedExtensions.Contains(strings.ToLower(path.Ext(u.Path))) {
+		return true
+	}
+	for _, segment := range strings.Split(strings.ToLower(u.Path), "/") {
+		if feedSegments.Contains(segment) {
+			return true
+		}
+	}
+	query := u.Query()
+	if query.Has("feed") {
+		return true
+	}
+	switch strings.ToLower(query.Get("format")) {
+	case "rss", "atom":
+		return true
+	}
+	return false
+}
+
+func Match(s string) (video_archiver.Source, error) {
+	parsedURL, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !protocols.Contains(parsedURL.Scheme) {
+		return nil, fmt.Errorf("unknown URL scheme %v", parsedURL.Scheme)
+	}
+	if !looksLikeFeed(parsedURL) {
+		return nil, fmt.Errorf("not a feed URL")
+	}
+	fragment, _ := url.ParseQuery(parsedURL.EscapedFragment())
+	parsedURL.Fragment = ""
+	parsedURL.RawFragment = ""
+	if id := fragment.Get(itemFragmentKey); id != "" {
+		return matchItem(parsedURL.String(), id, fragment), nil
+	}
+	return &source{url: parsedURL.String()}, nil
+}
+
+// matchItem creates the source for an item's URL, with the item's details if the fragment has them (see
+// itemSource.URL), or else only its ID.
+func matchItem(feedURL string, id string, fragment url.Values) *itemSource {
+	s := &itemSource{feedURL: feedURL, id: id}
+	if media := fragment.Get(mediaFragmentKey); media != "" {
+		s.feed = &Feed{Title: fragment.Get(feedFragmentKey), Author: fragment.Get(authorFragmentKey)}
+		s.item = &Item{
+			ID:    id,
+			Title: fragment.Get(titleFragmentKey),
+			Media: []Media{{URL: media, Type: fragment.Get(typeFragmentKey)}},
+		}
+		s.item.Published, _ = time.Parse(time.RFC3339, fragment.Get(publishedFragmentKey))
+	}
+	return s
+}
+
+func New() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:        "feed",
+		Match:       Match,
+		Description: "Podcasts and video feeds (RSS and Atom), with a download for each item",
+		Patterns:    []string{"*.rss", "*.atom", "*.rdf", "*.xml", "https://{host}/feed/", "https://feeds.{host}/…"},
+		Examples: []string{
+			"https://podcast.example.com/podcast.rss",
+			"https://example.com/feed/",
+			"https://example.com/?feed=rss2",
+			"https://example.com/feed.rss#item=episode-1",
+		},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityAudio |
+			video_archiver.CapabilityPlaylists | video_archiver.CapabilityMetadata,
+	}
+}
+
+func fetchFeed(ctx context.Context, feedURL string) (*Feed, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, text/xml;q=0.9, */*;q=0.8")
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get feed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get feed: %w", video_archiver.NewHTTPError(resp))
+	}
+	// Relative URLs are relative to where the feed ended up after any redirects
+	feed, err := ParseFeed(resp.Body, resp.Request.URL)
+	if errors.Is(err, ErrInvalidFeed) {
+		err = video_archiver.Permanent(err)
+	}
+	return feed, err
+}
+
+type source struct {
+	url string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	feed, err := fetchFeed(ctx, s.url)
+	if err != nil {
+		return nil, err
+	}
+	return &resolvedSource{source: *s, feed: feed}, nil
+}
+
+type resolvedSource struct {
+	source
+	feed *Feed
+}
+
+func (s *resolvedSource) String() string {
+	if s.feed.Title != "" {
+		return s.feed.Title
+	}
+	return s.URL()
+}
+
+func (s *resolvedSource) Download(video_archiver.Download) error {
+	// Nothing to download, each item is downloaded separately
+	return nil
+}
+
+// Children are the items that have something to download, in feed order.
+func (s *resolvedSource) Children() []video_archiver.Source {
+	var children []video_archiver.Source
+	for i := range s.feed.Items {
+		item := &s.feed.Items[i]
+		if item.BestMedia() == nil {
+			continue
+		}
+		children = append(children, &itemSource{feedURL: s.url, id: item.ID, feed: s.feed, item: item})
+	}
+	return children
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := map[string]string{
+		"feed.items": fmt.Sprint(len(s.feed.Items)),
+	}
+	if s.feed.Link != "" {
+		metadata["feed.link"] = s.feed.Link
+	}
+	if s.feed.Author != "" {
+		metadata["feed.author"] = s.feed.Author
+	}
+	return metadata
+}
+
+// An itemSource is one item of a feed. It is created either from an already fetched feed (as one of the feed's
+// Children), or by matching the item's URL, which has enough of the item's details to download it. An item URL with
+// only the ID has the feed fetched again by Recon.
+type itemSource struct {
+	feedURL string
+	id      string
+	feed    *Feed
+	item    *Item
+}
+
+func (s *itemSource) URL() string {
+	fragment := url.Values{itemFragmentKey: {s.id}}
+	if s.item != nil {
+		if media := s.item.BestMedia(); media != nil {
+			fragment.Set(mediaFragmentKey, media.URL)
+			for key, value := range map[string]string{
+				typeFragmentKey:   media.Type,
+				titleFragmentKey:  s.item.Title,
+				authorFragmentKey: firstOf(s.item.Author, s.feed.Author),
+				feedFragmentKey:   s.feed.Title,
+			} {
+				if value != "" {
+					fragment.Set(key, value)
+				}
+			}
+			if !s.item.Published.IsZero() {
+				fragment.Set(publishedFragmentKey, s.item.Published.Format(time.RFC3339))
+			}
+		}
+	}
+	return s.feedURL + "#" + fragment.Encode()
+}
+
+func (s *itemSource) String() string {
+	if s.item != nil && s.item.Title != "" {
+		return s.item.Title
+	}
+	return s.URL()
+}
+
+func (s *itemSource) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	resolved := *s
+	if resolved.item == nil {
+		feed, err := fetchFeed(ctx, s.feedURL)
+		if err != nil {
+			return nil, err
+		}
+		for i := range feed.Items {
+			if feed.Items[i].ID == s.id {
+				resolved.feed, resolved.item = feed, &feed.Items[i]
+				break
+			}
+		}
+		if resolved.item == nil {
+			return nil, video_archiver.Permanent(fmt.Errorf("%w: %v", ErrItemNotFound, s.id))
+		}
+	}
+	media := resolved.item.BestMedia()
+	if media == nil {
+		return nil, video_archiver.Permanent(fmt.Errorf("nothing to download for item %v", s.id))
+	}
+	return &resolvedItemSource{itemSource: resolved, media: media, filename: itemFilename(resolved.item, media)}, nil
+}
+
+// itemFilename names the download from the feed rather than the media URL (which is often something meaningless like
+// "media.mp3?id=1234"), as "<date> <title>.<ext>".
+func itemFilename(item *Item, media *Media) string {
+	name := item.Title
+	if name == "" {
+		name, _ = util.FilenameFromURLString(media.URL)
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if !item.Published.IsZero() {
+		name = strings.TrimSpace(item.Published.Format("2006-01-02") + " " + name)
+	}
+	return util.SanitizeFilename(name + mediaExtension(media))
+}
+
+func mediaExtension(media *Media) string {
+	if filename, err := util.FilenameFromURLString(media.URL); err == nil {
+		if ext := path.Ext(filename); len(ext) > 1 && len(ext) <= 5 {
+			return strings.ToLower(ext)
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(media.Type)
+	if ext, ok := extensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+type resolvedItemSource struct {
+	itemSource
+	media    *Media
+	filename string
+}
+
+func (s *resolvedItemSource) Download(d video_archiver.Download) error {
+	return d.SaveURL(s.filename, s.media.URL)
+}
+
+func (s *resolvedItemSource) Metadata() map[string]string {
+	metadata := map[string]string{
+		"feed.media": s.media.URL,
+	}
+	if s.feed.Title != "" {
+		metadata["feed.title"] = s.feed.Title
+	}
+	if !s.item.Published.IsZero() {
+		metadata["feed.published"] = s.item.Published.Format(time.RFC3339)
+	}
+	if s.media.Type != "" {
+		metadata["feed.type"] = s.media.Type
+	}
+	if s.media.Length > 0 {
+		metadata["feed.length"] = fmt.Sprint(s.media.Length)
+	}
+	if s.media.Width > 0 && s.media.Height > 0 {
+		metadata["feed.resolution"] = fmt.Sprintf("%dx%d", s.media.Width, s.media.Height)
+	}
+	return metadata
+}
+
+func (s *resolvedItemSource) Info() *video_archiver.Info {
+	info := &video_archiver.Info{
+		Filename:    s.filename,
+		Title:       s.item.Title,
+		ID:          s.item.ID,
+		Uploader:    s.item.Author,
+		UploadDate:  s.item.Published,
+		Duration:    s.item.Duration,
+		Description: s.item.Description,
+		URL:         s.item.Link,
+		Format:      s.Metadata(),
+		Thumbnail:   s.item.Thumbnail,
+	}
+	if info.Uploader == "" {
+		info.Uploader = firstOf(s.feed.Author, s.feed.Title)
+	}
+	if info.URL == "" {
+		info.URL = s.URL()
+	}
+	if info.Thumbnail == "" {
+		info.Thumbnail = s.feed.Image
+	}
+	return info
+}
+
+func init() {
+	video_archiver.DefaultProviderRegistry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 3))
+}
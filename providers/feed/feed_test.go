@@ -0,0 +1,218 @@
+package feed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+// newTestServer serves the feeds in testdata, and the media they refer to, recording the path of each request.
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	var requests []string
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	mux.HandleFunc("/media/download", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "3" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("episode three"))
+	})
+	mux.HandleFunc("/media/ep2.MP3", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("episode 2"))
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func parseTestFeed(t *testing.T, name string) *Feed {
+	f := generic.Unwrap(os.Open(filepath.Join("testdata", name)))
+	defer f.Close()
+	return generic.Unwrap(ParseFeed(f, generic.Unwrap(url.Parse("https://feeds.example.com/"+name))))
+}
+
+func TestParseFeed(t *testing.T) {
+	assert := assert_.New(t)
+
+	// RSS 2.0 podcast, in ISO-8859-1, with iTunes extensions
+	feed := parseTestFeed(t, "podcast.rss")
+	assert.Equal("Example Podcast", feed.Title)
+	assert.Equal("https://podcast.example.com/", feed.Link)
+	assert.Equal("Example Author", feed.Author)
+	assert.Equal("https://feeds.example.com/images/podcast.jpg", feed.Image)
+	if assert.Len(feed.Items, 3) {
+		item := feed.Items[0]
+		assert.Equal("episode-3", item.ID)
+		assert.Equal("Episode 3: Café & Crème", item.Title)
+		assert.Equal("<p>The third episode</p>", item.Description)
+		assert.Equal(time.Date(2022, 3, 3, 10, 0, 0, 0, time.UTC), item.Published.UTC())
+		assert.Equal(time.Hour+2*time.Minute+3*time.Second, item.Duration)
+		assert.Equal([]Media{{URL: "https://feeds.example.com/media/download?id=3", Type: "audio/mpeg", Length: 13}}, item.Media)
+		assert.Empty(feed.Items[1].Media)
+		assert.Nil(feed.Items[1].BestMedia())
+		item = feed.Items[2]
+		assert.Equal(time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC), item.Published.UTC())
+		assert.Equal(754*time.Second, item.Duration)
+		assert.Equal("https://podcast.example.com/images/2.jpg", item.Thumbnail)
+	}
+
+	// Atom with Media RSS groups (namespace without trailing slash) and enclosure links
+	feed = parseTestFeed(t, "videos.atom")
+	assert.Equal("Example Videos", feed.Title)
+	assert.Equal("https://videos.example.com/", feed.Link)
+	assert.Equal("Example Channel", feed.Author)
+	if assert.Len(feed.Items, 2) {
+		item := feed.Items[0]
+		assert.Equal("Second video", item.Title)
+		assert.Equal("The second video", item.Description)
+		assert.Equal("https://videos.example.com/watch/2", item.Link)
+		assert.Equal("https://videos.example.com/thumbs/2.jpg", item.Thumbnail)
+		assert.Equal(95*time.Second, item.Duration)
+		assert.Len(item.Media, 3)
+		assert.Equal("https://feeds.example.com/media/2-720.mp4", item.BestMedia().URL)
+		item = feed.Items[1]
+		assert.Equal("First video", item.Title)
+		assert.Equal(time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC), item.Published.UTC())
+		assert.Equal("https://cdn.example.com/v/1", item.BestMedia().URL)
+	}
+
+	// Media RSS, where only video and audio are downloadable
+	feed = parseTestFeed(t, "media.rss")
+	if assert.Len(feed.Items, 2) {
+		item := feed.Items[0]
+		assert.Equal("Clip Maker", item.Author)
+		assert.Equal("https://feeds.example.com/media/clip.mp4", item.ID)
+		assert.Equal("https://feeds.example.com/media/clip-hd.mp4", item.BestMedia().URL)
+		assert.Nil(feed.Items[1].BestMedia())
+	}
+
+	// RSS 1.0 with mod_enclosure
+	feed = parseTestFeed(t, "rdf.rdf")
+	assert.Equal("Old Style", feed.Title)
+	if assert.Len(feed.Items, 1) {
+		item := feed.Items[0]
+		assert.Equal("https://old.example.com/items/1", item.ID)
+		assert.Equal(time.Date(2004, 6, 1, 0, 0, 0, 0, time.UTC), item.Published)
+		assert.Equal([]Media{{URL: "https://old.example.com/old.mov", Type: "video/quicktime", Length: 3}}, item.Media)
+	}
+
+	_, err := ParseFeed(generic.Unwrap(os.Open("testdata/../feed.go")), nil)
+	assert.ErrorIs(err, ErrInvalidFeed)
+}
+
+func TestParseDate(t *testing.T) {
+	assert := assert_.New(t)
+	expected := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"Tue, 01 Mar 2022 10:00:00 GMT",
+		"Tue, 1 Mar 2022 10:00:00 +0000",
+		"Tue,  1 Mar 2022 11:00:00 +0100",
+		"Tue, 01 Mar 2022 10:00 GMT",
+		"01 Mar 2022 10:00:00 UT",
+		"Tuesday, 01 Mar 2022 10:00:00 GMT+0000",
+		"2022-03-01T10:00:00Z",
+		"2022-03-01T12:00:00.000+02:00",
+	} {
+		assert.Equal(expected, parseDate(s).UTC(), s)
+	}
+	assert.True(parseDate("last Tuesday").IsZero())
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert_.New(t)
+	for _, s := range []string{
+		"https://podcast.example.com/podcast.rss",
+		"https://example.com/feed/",
+		"https://example.com/blog/rss",
+		"https://example.com/?feed=rss2",
+		"https://example.com/videos?format=atom",
+		"https://feeds.example.com/show",
+	} {
+		_, err := Match(s)
+		assert.NoError(err, s)
+	}
+	for _, s := range []string{
+		"https://example.com/video.mp4",
+		"https://example.com/feedback",
+		"ftp://example.com/podcast.rss",
+	} {
+		_, err := Match(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	assert := assert_.New(t)
+	server, requests := newTestServer(t)
+	ctx := context.Background()
+
+	source := generic.Unwrap(Match(server.URL + "/podcast.rss"))
+	resolved := generic.Unwrap(source.Recon(ctx))
+	assert.Equal("Example Podcast", resolved.String())
+	collection, ok := resolved.(video_archiver.CollectionSource)
+	if !assert.True(ok) {
+		return
+	}
+	// One child per item with something to download, named from the feed
+	children := collection.Children()
+	if !assert.Len(children, 2) {
+		return
+	}
+	assert.Equal(server.URL+"/podcast.rss#author=Example+Author&feed=Example+Podcast&item=episode-3"+
+		"&media="+url.QueryEscape(server.URL+"/media/download?id=3")+"&published=2022-03-03T10%3A00%3A00Z"+
+		"&title=Episode+3%3A+Caf%C3%A9+%26+Cr%C3%A8me&type=audio%2Fmpeg", children[0].URL())
+	assert.Equal("Episode 3: Café & Crème", children[0].String())
+	assert.Equal(server.URL+"/podcast.rss#author=Example+Author&feed=Example+Podcast"+
+		"&item=https%3A%2F%2Fpodcast.example.com%2Fepisodes%2F2&media="+url.QueryEscape(server.URL+"/media/ep2.MP3?token=abc")+
+		"&published=2022-03-01T10%3A00%3A00%2B01%3A00&title=Episode+2&type=audio%2Fmpeg", children[1].URL())
+
+	*requests = nil
+	for i, filename := range []string{"2022-03-03 Episode 3_ Café & Crème.mp3", "2022-03-01 Episode 2.mp3"} {
+		// Same result from the child, or from matching the child's URL (which has enough to download the item)
+		matched := generic.Unwrap(Match(children[i].URL()))
+		assert.Equal(children[i].URL(), matched.URL())
+		for _, child := range []video_archiver.Source{children[i], matched} {
+			dir := t.TempDir()
+			resolved := generic.Unwrap(child.Recon(ctx))
+			d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+				WithContext(ctx).
+				WithTargetPrefix(dir + string(os.PathSeparator)).
+				WithTempPath(t.TempDir()).
+				Build())
+			if assert.NoError(resolved.Download(d)) {
+				generic.Unwrap_(d.Commit())
+				assert.FileExists(filepath.Join(dir, filename))
+			}
+			d.Close()
+			info := resolved.(video_archiver.InfoSource).Info()
+			assert.Equal(filename, info.Filename)
+			assert.Equal("Example Author", info.Uploader)
+			assert.Equal("Example Podcast", resolved.(video_archiver.MetadataSource).Metadata()["feed.title"])
+		}
+	}
+
+	assert.NotContains(*requests, "/podcast.rss")
+
+	// An item URL with only the ID fetches the feed again
+	resolved = generic.Unwrap(generic.Unwrap(Match(server.URL + "/podcast.rss#item=episode-3")).Recon(ctx))
+	assert.Equal("Episode 3: Café & Crème", resolved.String())
+	assert.Contains(*requests, "/podcast.rss")
+	_, err := generic.Unwrap(Match(server.URL + "/podcast.rss#item=missing")).Recon(ctx)
+	assert.ErrorIs(err, ErrItemNotFound)
+	_, err = generic.Unwrap(Match(server.URL + "/missing.rss")).Recon(ctx)
+	assert.Error(err)
+}
@@ -0,0 +1,496 @@
+package feed
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+var ErrInvalidFeed = errors.New("invalid feed")
+
+// A Feed is an RSS (0.9x, 1.0 or 2.0) or Atom feed, e.g. a podcast.
+type Feed struct {
+	Title       string
+	Link        string
+	Description string
+	Author      string
+	Image       string
+	Items       []Item
+}
+
+// An Item is an entry in a feed, e.g. an episode of a podcast.
+type Item struct {
+	// Unique ID, from the guid or Atom id, or else the URL of the first video or audio.
+	ID          string
+	Title       string
+	Link        string
+	Description string
+	Author      string
+	Published   time.Time
+	Duration    time.Duration
+	Thumbnail   string
+	// Enclosures and Media RSS content, in the order they appear.
+	Media []Media
+}
+
+// A Media is an <enclosure>, <media:content> or Atom enclosure link.
+type Media struct {
+	URL    string
+	Type   string
+	Medium string
+	Length int64
+	// Bits per second.
+	Bitrate  int64
+	Width    int
+	Height   int
+	Duration time.Duration
+}
+
+// kind is how suitable the media is to download: 2 for video, 1 for audio or unknown, 0 for anything else (e.g. an
+// image, or a Flash player).
+func (m *Media) kind() int {
+	mediaType := strings.ToLower(m.Type)
+	switch {
+	case m.Medium == "video" || strings.HasPrefix(mediaType, "video/"):
+		return 2
+	case m.Medium == "audio" || strings.HasPrefix(mediaType, "audio/"):
+		return 1
+	case m.Medium == "" && mediaType == "":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// BestMedia chooses the media to download: video rather than audio, and then the highest resolution, bitrate or size.
+// Returns nil if there is nothing suitable.
+func (i *Item) BestMedia() *Media {
+	var best *Media
+	for j := range i.Media {
+		m := &i.Media[j]
+		if m.kind() == 0 {
+			continue
+		}
+		if best == nil || m.betterThan(best) {
+			best = m
+		}
+	}
+	return best
+}
+
+func (m *Media) betterThan(other *Media) bool {
+	switch {
+	case m.kind() != other.kind():
+		return m.kind() > other.kind()
+	case m.Height != other.Height:
+		return m.Height > other.Height
+	case m.Bitrate != other.Bitrate:
+		return m.Bitrate > other.Bitrate
+	default:
+		return m.Length > other.Length
+	}
+}
+
+// An element is a parsed XML element. Feeds in the wild mix namespaces and versions freely, so they are interpreted
+// by local name where possible, rather than decoded into structs with exact namespaces.
+type element struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	text     strings.Builder
+	children []*element
+}
+
+func (e *element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.Name.Local == name {
+			return strings.TrimSpace(a.Value)
+		}
+	}
+	return ""
+}
+
+func (e *element) Text() string {
+	return strings.TrimSpace(e.text.String())
+}
+
+func (e *element) is(namespace func(string) bool, local string) bool {
+	return e.name.Local == local && namespace(e.name.Space)
+}
+
+// child finds the first child with the given name, or returns an empty element.
+func (e *element) child(namespace func(string) bool, local string) *element {
+	for _, c := range e.children {
+		if c.is(namespace, local) {
+			return c
+		}
+	}
+	return &element{}
+}
+
+// childText is the text of the first child with the given name that has any.
+func (e *element) childText(namespace func(string) bool, local string) string {
+	for _, c := range e.children {
+		if c.is(namespace, local) && c.Text() != "" {
+			return c.Text()
+		}
+	}
+	return ""
+}
+
+// Namespaces are matched loosely: undeclared prefixes are left as the prefix, and the Media RSS namespace is often
+// written without its trailing slash.
+func anyNS(string) bool { return true }
+
+func plainNS(space string) bool {
+	return space == "" || strings.Contains(space, "purl.org/rss/1.0") || strings.Contains(space, "www.w3.org/2005/Atom") ||
+		strings.Contains(space, "backend.userland.com/rss2") || strings.Contains(space, "my.netscape.com/rdf")
+}
+
+func mediaNS(space string) bool {
+	return space == "media" || strings.Contains(space, "search.yahoo.com/mrss")
+}
+
+func itunesNS(space string) bool {
+	return space == "itunes" || strings.Contains(space, "itunes.com/dtds/podcast")
+}
+
+func dcNS(space string) bool {
+	return space == "dc" || strings.Contains(space, "purl.org/dc/elements")
+}
+
+func parseTree(r io.Reader) (*element, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	var root *element
+	var stack []*element
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFeed, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &element{name: t.Name, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, e)
+			} else if root == nil {
+				root = e
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("%w: empty document", ErrInvalidFeed)
+	}
+	return root, nil
+}
+
+// ParseFeed parses an RSS or Atom feed, resolving relative URLs against base.
+func ParseFeed(r io.Reader, base *url.URL) (*Feed, error) {
+	root, err := parseTree(r)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{base: base}
+	switch strings.ToLower(root.name.Local) {
+	case "rss":
+		channel := root.child(anyNS, "channel")
+		feed := p.rssChannel(channel)
+		for _, c := range channel.children {
+			if c.is(plainNS, "item") {
+				feed.Items = append(feed.Items, p.rssItem(c))
+			}
+		}
+		return feed, nil
+	case "rdf":
+		// RSS 1.0 (and 0.90) items are siblings of the channel
+		feed := p.rssChannel(root.child(anyNS, "channel"))
+		if image := root.child(plainNS, "image"); feed.Image == "" {
+			feed.Image = p.resolve(image.childText(plainNS, "url"))
+		}
+		for _, c := range root.children {
+			if c.is(plainNS, "item") {
+				feed.Items = append(feed.Items, p.rssItem(c))
+			}
+		}
+		return feed, nil
+	case "feed":
+		return p.atomFeed(root), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown root element <%v>", ErrInvalidFeed, root.name.Local)
+	}
+}
+
+type parser struct {
+	base *url.URL
+}
+
+func (p *parser) resolve(ref string) string {
+	if ref == "" || p.base == nil {
+		return ref
+	}
+	if u, err := p.base.Parse(ref); err == nil {
+		return u.String()
+	}
+	return ref
+}
+
+func (p *parser) rssChannel(channel *element) *Feed {
+	feed := &Feed{
+		Title:       channel.childText(plainNS, "title"),
+		Link:        p.resolve(channel.childText(plainNS, "link")),
+		Description: firstOf(channel.childText(plainNS, "description"), channel.childText(itunesNS, "summary")),
+		Author:      firstOf(channel.childText(itunesNS, "author"), channel.childText(dcNS, "creator"), channel.childText(plainNS, "managingEditor")),
+		Image: firstOf(
+			p.resolve(channel.child(itunesNS, "image").attr("href")),
+			p.resolve(channel.child(plainNS, "image").childText(plainNS, "url")),
+			p.resolve(channel.child(mediaNS, "thumbnail").attr("url")),
+		),
+	}
+	if feed.Link == "" {
+		// Atom links in RSS feeds, e.g. <atom:link rel="self" href="..."/>
+		feed.Link = p.atomLink(channel, "alternate")
+	}
+	return feed
+}
+
+func (p *parser) rssItem(e *element) Item {
+	item := Item{
+		ID:          firstOf(e.childText(plainNS, "guid"), e.attr("about")),
+		Title:       firstOf(e.childText(plainNS, "title"), e.childText(mediaNS, "title"), e.childText(itunesNS, "title")),
+		Link:        p.resolve(e.childText(plainNS, "link")),
+		Description: firstOf(e.childText(plainNS, "description"), e.childText(itunesNS, "summary"), e.childText(mediaNS, "description")),
+		Author:      firstOf(e.childText(itunesNS, "author"), e.childText(dcNS, "creator"), e.childText(plainNS, "author")),
+		Published:   parseDate(firstOf(e.childText(plainNS, "pubDate"), e.childText(dcNS, "date"), e.childText(plainNS, "published"))),
+		Duration:    parseDuration(e.childText(itunesNS, "duration")),
+		Thumbnail:   p.resolve(e.child(itunesNS, "image").attr("href")),
+	}
+	for _, c := range e.children {
+		// RSS 1.0 enclosures (mod_enclosure) are <enc:enclosure rdf:resource="..."/>
+		if u := firstOf(c.attr("url"), c.attr("resource")); c.is(anyNS, "enclosure") && u != "" {
+			item.Media = append(item.Media, Media{
+				URL:    p.resolve(u),
+				Type:   c.attr("type"),
+				Length: parseInt(c.attr("length")),
+			})
+		}
+	}
+	p.mediaRSS(e, &item)
+	p.finishItem(&item)
+	return item
+}
+
+func (p *parser) atomFeed(root *element) *Feed {
+	feed := &Feed{
+		Title:       atomText(root.child(plainNS, "title")),
+		Link:        p.atomLink(root, "alternate"),
+		Description: root.childText(plainNS, "subtitle"),
+		Author:      firstOf(root.child(plainNS, "author").childText(plainNS, "name"), root.childText(itunesNS, "author")),
+		Image: firstOf(
+			p.resolve(root.childText(plainNS, "logo")),
+			p.resolve(root.child(itunesNS, "image").attr("href")),
+			p.resolve(root.childText(plainNS, "icon")),
+		),
+	}
+	for _, e := range root.children {
+		if !e.is(plainNS, "entry") {
+			continue
+		}
+		item := Item{
+			ID:          e.childText(plainNS, "id"),
+			Title:       firstOf(atomText(e.child(plainNS, "title")), e.child(mediaNS, "group").childText(mediaNS, "title")),
+			Link:        p.atomLink(e, "alternate"),
+			Description: firstOf(e.childText(plainNS, "summary"), e.child(mediaNS, "group").childText(mediaNS, "description"), e.childText(plainNS, "content")),
+			Author:      e.child(plainNS, "author").childText(plainNS, "name"),
+			Published:   parseDate(firstOf(e.childText(plainNS, "published"), e.childText(plainNS, "updated"))),
+			Duration:    parseDuration(e.childText(itunesNS, "duration")),
+			Thumbnail:   p.resolve(e.child(itunesNS, "image").attr("href")),
+		}
+		for _, link := range e.children {
+			if link.is(plainNS, "link") && link.attr("rel") == "enclosure" && link.attr("href") != "" {
+				item.Media = append(item.Media, Media{
+					URL:    p.resolve(link.attr("href")),
+					Type:   link.attr("type"),
+					Length: parseInt(link.attr("length")),
+				})
+			}
+		}
+		p.mediaRSS(e, &item)
+		p.finishItem(&item)
+		feed.Items = append(feed.Items, item)
+	}
+	return feed
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// atomText is the text of an Atom text construct, which may be escaped HTML.
+func atomText(e *element) string {
+	if e.attr("type") == "html" {
+		return strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(e.Text(), "")))
+	}
+	return e.Text()
+}
+
+// atomLink finds the href of a <link> with the given rel (a missing rel means "alternate").
+func (p *parser) atomLink(e *element, rel string) string {
+	for _, c := range e.children {
+		if c.name.Local != "link" || c.attr("href") == "" {
+			continue
+		}
+		if r := c.attr("rel"); r == rel || (r == "" && rel == "alternate") {
+			return p.resolve(c.attr("href"))
+		}
+	}
+	return ""
+}
+
+// mediaRSS adds Media RSS content, which may be directly in the item or in <media:group> elements.
+func (p *parser) mediaRSS(e *element, item *Item) {
+	for _, c := range e.children {
+		switch {
+		case c.is(mediaNS, "content") && c.attr("url") != "":
+			item.Media = append(item.Media, Media{
+				URL:      p.resolve(c.attr("url")),
+				Type:     c.attr("type"),
+				Medium:   strings.ToLower(c.attr("medium")),
+				Length:   parseInt(c.attr("fileSize")),
+				Bitrate:  parseInt(c.attr("bitrate")) * 1000,
+				Width:    int(parseInt(c.attr("width"))),
+				Height:   int(parseInt(c.attr("height"))),
+				Duration: parseDuration(c.attr("duration")),
+			})
+			if item.Thumbnail == "" {
+				item.Thumbnail = p.resolve(c.child(mediaNS, "thumbnail").attr("url"))
+			}
+		case c.is(mediaNS, "group"):
+			p.mediaRSS(c, item)
+		case c.is(mediaNS, "thumbnail") && item.Thumbnail == "":
+			item.Thumbnail = p.resolve(c.attr("url"))
+		}
+	}
+}
+
+func (p *parser) finishItem(item *Item) {
+	if item.ID == "" {
+		// The first media rather than the best, so the ID doesn't change if better media is added
+		for _, m := range item.Media {
+			if m.kind() > 0 {
+				item.ID = m.URL
+				break
+			}
+		}
+	}
+	if item.ID == "" {
+		item.ID = item.Link
+	}
+	best := item.BestMedia()
+	if item.Duration == 0 && best != nil {
+		item.Duration = best.Duration
+	}
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseInt(s string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Date formats seen in feeds, most of which are meant to be RFC 822 or RFC 3339.
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"Mon, 2 January 2006 15:04:05 MST",
+	"Monday, 2 Jan 2006 15:04:05 -0700",
+	"Monday, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 06 15:04:05 MST",
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseDate parses a date in any of dateLayouts, giving the zero time if it can't.
+func parseDate(s string) time.Time {
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return time.Time{}
+	}
+	// "GMT+0000", "UT" and lower case "gmt" are all seen, and Go only knows "GMT" and "UTC" by name
+	s = strings.Replace(s, " GMT+", " +", 1)
+	if strings.HasSuffix(s, " UT") {
+		s += "C"
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseDuration parses "HH:MM:SS", "MM:SS" or a number of seconds, giving 0 if it can't.
+func parseDuration(s string) time.Duration {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0
+	}
+	var seconds float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+}
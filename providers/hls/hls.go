@@ -0,0 +1,299 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/internal/segmented"
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+// Options understood by the hls provider.
+const (
+	// Maximum video height, e.g. "720".
+	OptionMaxHeight = "hls.max-height"
+	// Maximum bandwidth in bits per second, e.g. "3M". Multiples are binary, as for sizes (see util.ParseSize), so "3M"
+	// is 3×1048576 bits per second.
+	OptionMaxBandwidth = "hls.max-bandwidth"
+	// How many times to retry each segment after a transient error, default segmented.DefaultRetries.
+	OptionSegmentRetries = "hls.segment-retries"
+)
+
+var (
+	ErrNoVariant  = errors.New("no variant matches the variant policy")
+	ErrLiveStream = errors.New("live streams are not supported")
+)
+
+var protocols = generic.NewSet("http", "https")
+
+// A VariantPolicy chooses which variant of a stream to download. The zero value chooses the highest bandwidth.
+type VariantPolicy struct {
+	MaxHeight    int
+	MaxBandwidth int64
+}
+
+// VariantPolicyFromOptions creates a VariantPolicy from provider options (see OptionMaxHeight etc.).
+func VariantPolicyFromOptions(options video_archiver.Options) (p VariantPolicy, err error) {
+	if p.MaxHeight, err = options.Int(OptionMaxHeight); err != nil {
+		return p, err
+	}
+	if p.MaxBandwidth, err = util.ParseSize(options.Get(OptionMaxBandwidth)); err != nil {
+		return p, fmt.Errorf("invalid value for %v: %w", OptionMaxBandwidth, err)
+	}
+	return p, nil
+}
+
+// Select chooses the highest bandwidth variant within the limits. Variants of unknown height are allowed.
+func (p VariantPolicy) Select(variants []Variant) (*Variant, error) {
+	var best *Variant
+	for i, v := range variants {
+		if p.MaxHeight > 0 && v.Height > p.MaxHeight {
+			continue
+		}
+		if p.MaxBandwidth > 0 && v.Bandwidth > p.MaxBandwidth {
+			continue
+		}
+		if best == nil || v.Bandwidth > best.Bandwidth {
+			best = &variants[i]
+		}
+	}
+	if best == nil {
+		return nil, ErrNoVariant
+	}
+	return best, nil
+}
+
+func Match(s string) (video_archiver.Source, error) {
+	parsedURL, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !protocols.Contains(parsedURL.Scheme) {
+		return nil, fmt.Errorf("unknown URL scheme %v", parsedURL.Scheme)
+	}
+	filename, err := util.FilenameFromURL(parsedURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(path.Ext(filename)) != ".m3u8" {
+		return nil, fmt.Errorf("not an .m3u8 URL")
+	}
+	return &source{url: s, name: strings.TrimSuffix(filename, path.Ext(filename))}, nil
+}
+
+func New() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:         "hls",
+		Match:        Match,
+		Description:  "HTTP Live Streaming (HLS) playlists, saved as a single file",
+		Patterns:     []string{"*.m3u8"},
+		Examples:     []string{"https://example.com/live/stream.m3u8"},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityAudio | video_archiver.CapabilityMetadata,
+	}
+}
+
+type source struct {
+	url  string
+	name string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	options := video_archiver.OptionsFromContext(ctx)
+	policy, err := VariantPolicyFromOptions(options)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	retries, err := segmented.RetriesFromOptions(options, OptionSegmentRetries)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	client := video_archiver.HTTPClientFromContext(ctx)
+
+	resolved := &resolvedSource{source: *s, retries: retries}
+	master, media, err := fetchPlaylist(ctx, client, s.url)
+	if err != nil {
+		return nil, err
+	}
+	if master != nil {
+		if resolved.variant, err = policy.Select(master.Variants); err != nil {
+			return nil, video_archiver.Permanent(err)
+		}
+		if _, media, err = fetchPlaylist(ctx, client, resolved.variant.URI); err != nil {
+			return nil, err
+		} else if media == nil {
+			return nil, video_archiver.Permanent(fmt.Errorf("%w: variant is a master playlist", ErrInvalidPlaylist))
+		}
+	}
+	if !media.EndList {
+		return nil, video_archiver.Permanent(ErrLiveStream)
+	}
+	if len(media.Segments) == 0 {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: no segments", ErrInvalidPlaylist))
+	}
+	resolved.media = media
+	return resolved, nil
+}
+
+func fetchPlaylist(ctx context.Context, client *http.Client, playlistURL string) (*MasterPlaylist, *MediaPlaylist, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
+	if err != nil {
+		return nil, nil, video_archiver.Permanent(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get playlist: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to get playlist: %w", video_archiver.NewHTTPError(resp))
+	}
+	// Relative URIs are relative to where the playlist ended up after any redirects
+	master, media, err := ParsePlaylist(resp.Body, resp.Request.URL)
+	if errors.Is(err, ErrInvalidPlaylist) {
+		err = video_archiver.Permanent(err)
+	}
+	return master, media, err
+}
+
+type resolvedSource struct {
+	source
+	// Chosen variant, or nil if the URL was a media playlist
+	variant *Variant
+	media   *MediaPlaylist
+	retries int
+}
+
+func (s *resolvedSource) String() string {
+	return s.name
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := map[string]string{
+		"hls.segments": fmt.Sprint(len(s.media.Segments)),
+		"hls.duration": (time.Duration(s.media.Duration() * float64(time.Second))).Round(time.Second).String(),
+	}
+	if s.variant != nil {
+		metadata["hls.bandwidth"] = fmt.Sprint(s.variant.Bandwidth)
+		if s.variant.Width > 0 && s.variant.Height > 0 {
+			metadata["hls.resolution"] = fmt.Sprintf("%dx%d", s.variant.Width, s.variant.Height)
+		}
+		if s.variant.Codecs != "" {
+			metadata["hls.codecs"] = s.variant.Codecs
+		}
+	}
+	return metadata
+}
+
+// getFilename is named after the playlist, with ".ts" for MPEG-TS segments, or ".mp4" for fragmented MP4 segments
+// (which have an initialisation section).
+func (s *resolvedSource) getFilename() string {
+	if s.media.Segments[0].Map != nil {
+		return s.name + ".mp4"
+	}
+	return s.name + ".ts"
+}
+
+// Download fetches each segment in turn, decrypting if necessary, and concatenates them into a single file.
+func (s *resolvedSource) Download(d video_archiver.Download) error {
+	f, err := d.CreateFile(s.getFilename())
+	if err != nil {
+		return fmt.Errorf("failed to open target file: %w", err)
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	var currentMap *Map
+	progress := segmented.NewProgress(d, len(s.media.Segments))
+	for _, segment := range s.media.Segments {
+		var data []byte
+		var n int
+		if segment.Map != nil && segment.Map != currentMap {
+			if data, err = s.fetch(d, segment.Map.URI, segment.Map.ByteRangeOffset, segment.Map.ByteRangeLength); err != nil {
+				return fmt.Errorf("failed to get initialisation section: %w", err)
+			} else if err = d.AppendStream(f, bytes.NewReader(data)); err != nil {
+				return err
+			}
+			currentMap = segment.Map
+			n += len(data)
+		}
+		if data, err = s.fetch(d, segment.URI, segment.ByteRangeOffset, segment.ByteRangeLength); err != nil {
+			return fmt.Errorf("failed to get segment %d: %w", segment.Sequence, err)
+		}
+		if segment.Key != nil {
+			if data, err = s.decrypt(d, keys, segment, data); err != nil {
+				return fmt.Errorf("failed to decrypt segment %d: %w", segment.Sequence, err)
+			}
+		}
+		if err = d.AppendStream(f, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		progress.Add(n + len(data))
+	}
+	return f.Close()
+}
+
+// fetch gets a whole resource, or part of it if length > 0, retrying transient errors.
+func (s *resolvedSource) fetch(d video_archiver.Download, uri string, offset int64, length int64) ([]byte, error) {
+	return segmented.Fetch(d.Context(), s.retries, segmented.Request{URL: uri, Offset: offset, Length: length})
+}
+
+// decrypt decrypts an AES-128 segment, fetching the key if it hasn't been fetched already.
+func (s *resolvedSource) decrypt(d video_archiver.Download, keys map[string][]byte, segment Segment, data []byte) ([]byte, error) {
+	key, ok := keys[segment.Key.URI]
+	if !ok {
+		var err error
+		if key, err = s.fetch(d, segment.Key.URI, 0, 0); err != nil {
+			return nil, fmt.Errorf("failed to get key: %w", err)
+		}
+		keys[segment.Key.URI] = key
+	}
+	iv := segment.Key.IV
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(segment.Sequence))
+	}
+	return decryptAES128(key, iv, data)
+}
+
+// decryptAES128 decrypts AES-128-CBC data with PKCS#7 padding.
+func decryptAES128(key []byte, iv []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, video_archiver.Permanent(fmt.Errorf("encrypted data is not a whole number of blocks"))
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, video_archiver.Permanent(fmt.Errorf("invalid padding"))
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+func init() {
+	// Only matches .m3u8 URLs, so only needs to be ahead of the catch-all providers
+	video_archiver.DefaultProviderRegistry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 4))
+}
@@ -0,0 +1,175 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/internal/segmented"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+// encrypt is the inverse of decryptAES128.
+func encrypt(data []byte, iv []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(generic.Unwrap(aes.NewCipher(testKey)), iv).CryptBlocks(out, data)
+	return out
+}
+
+// newTestServer serves the playlists in testdata, and the segments they refer to.
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	sequenceIV := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(sequenceIV[8:], 11)
+	explicitIV := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	failures := 1
+	var requests []string
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	mux.HandleFunc("/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(testKey)
+	})
+	mux.HandleFunc("/high/seg0.ts", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("segment0|"))
+	})
+	mux.HandleFunc("/high/seg1.ts", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(encrypt([]byte("segment1|"), sequenceIV))
+	})
+	mux.HandleFunc("/high/seg2.ts", func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(encrypt([]byte("segment2"), explicitIV))
+	})
+	mux.HandleFunc("/low/all.ts", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "all.ts", time.Time{}, strings.NewReader("xxABCDEFGHIyy"))
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func download(t *testing.T, ctx context.Context, s string) (string, video_archiver.ResolvedSource, error) {
+	source, err := Match(s)
+	if err != nil {
+		return "", nil, err
+	}
+	resolved, err := source.Recon(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := t.TempDir()
+	d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+		WithContext(ctx).
+		WithTargetPrefix(dir + string(os.PathSeparator)).
+		WithTempPath(t.TempDir()).
+		Build())
+	defer d.Close()
+	if err := resolved.Download(d); err != nil {
+		return "", resolved, err
+	}
+	generic.Unwrap_(d.Commit())
+	return dir, resolved, nil
+}
+
+func TestDownload(t *testing.T) {
+	assert := assert_.New(t)
+	segmented.RetryDelay = time.Millisecond
+	server, requests := newTestServer(t)
+	ctx := context.Background()
+
+	// Highest bandwidth variant, with plain, encrypted (sequence number IV) and encrypted (explicit IV) segments
+	dir, resolved, err := download(t, ctx, server.URL+"/master.m3u8")
+	if assert.NoError(err) {
+		assert.Equal("segment0|segment1|segment2", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "master.ts")))))
+		assert.Equal(map[string]string{
+			"hls.segments":   "3",
+			"hls.duration":   "12s",
+			"hls.bandwidth":  "2500000",
+			"hls.resolution": "1280x720",
+			"hls.codecs":     "avc1.4d401f,mp4a.40.2",
+		}, resolved.(video_archiver.MetadataSource).Metadata())
+		// Key is only fetched once, and failed segment is retried
+		assert.Equal([]string{"/master.m3u8", "/high/index.m3u8", "/high/seg0.ts", "/high/seg1.ts", "/key.bin", "/high/seg2.ts", "/high/seg2.ts"}, *requests)
+	}
+
+	// Variant chosen by policy, with byte ranges
+	ctx = video_archiver.WithOptions(ctx, video_archiver.Options{OptionMaxHeight: "480"})
+	dir, _, err = download(t, ctx, server.URL+"/master.m3u8")
+	if assert.NoError(err) {
+		assert.Equal("ABCDEFGHI", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "master.ts")))))
+	}
+
+	_, _, err = download(t, ctx, server.URL+"/live.m3u8")
+	assert.ErrorIs(err, ErrLiveStream)
+	assert.False(video_archiver.IsTransient(err))
+	_, _, err = download(t, video_archiver.WithOptions(ctx, video_archiver.Options{OptionMaxBandwidth: "100K"}), server.URL+"/master.m3u8")
+	assert.ErrorIs(err, ErrNoVariant)
+	_, err = Match(server.URL + "/video.mp4")
+	assert.Error(err)
+}
+
+func TestParsePlaylist(t *testing.T) {
+	assert := assert_.New(t)
+	base := generic.Unwrap(url.Parse("https://example.com/video/index.m3u8"))
+
+	master, media, err := ParsePlaylist(generic.Unwrap(os.Open("testdata/master.m3u8")), base)
+	if assert.NoError(err) && assert.Nil(media) {
+		assert.Equal([]Variant{
+			{URI: "https://example.com/video/low/index.m3u8", Bandwidth: 800000, Width: 640, Height: 360, Codecs: "avc1.4d401e,mp4a.40.2"},
+			{URI: "https://example.com/video/high/index.m3u8", Bandwidth: 2500000, Width: 1280, Height: 720, Codecs: "avc1.4d401f,mp4a.40.2"},
+		}, master.Variants)
+	}
+
+	fmp4 := `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@0"
+#EXTINF:2,
+/segments/1.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:2,
+https://cdn.example.com/2.m4s
+#EXT-X-ENDLIST`
+	master, media, err = ParsePlaylist(strings.NewReader(fmp4), base)
+	if assert.NoError(err) && assert.Nil(master) {
+		assert.True(media.EndList)
+		assert.Equal(4.0, media.Duration())
+		initMap := &Map{URI: "https://example.com/video/init.mp4", ByteRangeLength: 100}
+		assert.Equal([]Segment{
+			{URI: "https://example.com/segments/1.m4s", Duration: 2, Sequence: 0, Map: initMap},
+			{URI: "https://cdn.example.com/2.m4s", Duration: 2, Sequence: 1, Map: initMap},
+		}, media.Segments)
+	}
+
+	for _, invalid := range []string{
+		"not a playlist",
+		"#EXTM3U\n#EXT-X-STREAM-INF:RESOLUTION=1x1\nvariant.m3u8",
+		"#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key\"\n#EXTINF:1,\nsegment.ts",
+		"#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0x1234\n#EXTINF:1,\nsegment.ts",
+		"#EXTM3U\n#EXTINF:one,\nsegment.ts",
+	} {
+		_, _, err := ParsePlaylist(strings.NewReader(invalid), base)
+		assert.ErrorIs(err, ErrInvalidPlaylist, "playlist: %v", invalid)
+	}
+}
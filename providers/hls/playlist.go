@@ -0,0 +1,223 @@
+package hls
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid playlist")
+
+// A MasterPlaylist lists the variants of a stream, e.g. at different resolutions.
+type MasterPlaylist struct {
+	Variants []Variant
+}
+
+// A Variant is a media playlist for one version of the stream.
+type Variant struct {
+	URI       string
+	Bandwidth int64
+	Width     int
+	Height    int
+	Codecs    string
+}
+
+// A MediaPlaylist lists the segments of a stream.
+type MediaPlaylist struct {
+	TargetDuration float64
+	MediaSequence  int64
+	// False for a live stream, which may have more segments added later.
+	EndList  bool
+	Segments []Segment
+}
+
+// Duration is the total duration of all segments, in seconds.
+func (p *MediaPlaylist) Duration() float64 {
+	var total float64
+	for _, s := range p.Segments {
+		total += s.Duration
+	}
+	return total
+}
+
+// A Segment is a piece of the stream.
+type Segment struct {
+	URI      string
+	Duration float64
+	// Sequence number, used as the IV for encrypted segments if the key doesn't specify one.
+	Sequence int64
+	// Part of the resource, if ByteRangeLength > 0.
+	ByteRangeOffset int64
+	ByteRangeLength int64
+	// Encryption key, or nil if the segment is not encrypted.
+	Key *Key
+	// Initialisation section (e.g. for fragmented MP4 segments) that must precede the segment, or nil if none.
+	Map *Map
+}
+
+// A Key is how segments are encrypted.
+type Key struct {
+	Method string
+	URI    string
+	// Nil if not specified, in which case the segment's sequence number is used.
+	IV []byte
+}
+
+// A Map is the initialisation section of the segments that follow it.
+type Map struct {
+	URI             string
+	ByteRangeOffset int64
+	ByteRangeLength int64
+}
+
+// ParsePlaylist parses an M3U8 playlist, which is either a master playlist or a media playlist (the other result is
+// nil). URIs are resolved relative to base.
+func ParsePlaylist(r io.Reader, base *url.URL) (*MasterPlaylist, *MediaPlaylist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return nil, nil, fmt.Errorf("%w: missing #EXTM3U header", ErrInvalidPlaylist)
+	}
+
+	master := &MasterPlaylist{}
+	media := &MediaPlaylist{}
+	isMaster := false
+	var variant *Variant
+	var segment Segment
+	var key *Key
+	var initMap *Map
+	var nextOffset int64
+	for lineNo := 2; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		var err error
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			isMaster = true
+			attrs := parseAttributes(value)
+			variant = &Variant{Codecs: attrs["CODECS"]}
+			if variant.Bandwidth, err = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64); err != nil {
+				err = fmt.Errorf("invalid BANDWIDTH")
+			} else if resolution := attrs["RESOLUTION"]; resolution != "" {
+				_, err = fmt.Sscanf(resolution, "%dx%d", &variant.Width, &variant.Height)
+			}
+		case tag == "#EXT-X-TARGETDURATION":
+			media.TargetDuration, err = strconv.ParseFloat(value, 64)
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			media.MediaSequence, err = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-ENDLIST":
+			media.EndList = true
+		case tag == "#EXTINF":
+			segment.Duration, err = strconv.ParseFloat(strings.SplitN(value, ",", 2)[0], 64)
+		case tag == "#EXT-X-BYTERANGE":
+			segment.ByteRangeOffset, segment.ByteRangeLength, err = parseByteRange(value, nextOffset)
+		case tag == "#EXT-X-KEY":
+			key, err = parseKey(parseAttributes(value), base)
+		case tag == "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			initMap = &Map{}
+			if initMap.URI, err = resolveURI(base, attrs["URI"]); err == nil && attrs["BYTERANGE"] != "" {
+				initMap.ByteRangeOffset, initMap.ByteRangeLength, err = parseByteRange(attrs["BYTERANGE"], 0)
+			}
+		case strings.HasPrefix(line, "#"):
+			// Other tags and comments don't affect what is downloaded
+		case variant != nil:
+			variant.URI, err = resolveURI(base, line)
+			master.Variants = append(master.Variants, *variant)
+			variant = nil
+		default:
+			segment.URI, err = resolveURI(base, line)
+			segment.Sequence = media.MediaSequence + int64(len(media.Segments))
+			segment.Key = key
+			segment.Map = initMap
+			media.Segments = append(media.Segments, segment)
+			nextOffset = segment.ByteRangeOffset + segment.ByteRangeLength
+			segment = Segment{}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: line %d: %v", ErrInvalidPlaylist, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if isMaster {
+		return master, nil, nil
+	}
+	return nil, media, nil
+}
+
+// parseAttributes parses an attribute list, e.g. `BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`.
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		var name, value string
+		name, s, _ = strings.Cut(s, "=")
+		if strings.HasPrefix(s, `"`) {
+			value, s, _ = strings.Cut(s[1:], `"`)
+			s = strings.TrimPrefix(s, ",")
+		} else {
+			value, s, _ = strings.Cut(s, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+	}
+	return attrs
+}
+
+// parseByteRange parses "<length>[@<offset>]", where the offset defaults to the end of the previous range.
+func parseByteRange(s string, defaultOffset int64) (offset int64, length int64, err error) {
+	lengthStr, offsetStr, hasOffset := strings.Cut(s, "@")
+	if length, err = strconv.ParseInt(lengthStr, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range %#v", s)
+	}
+	offset = defaultOffset
+	if hasOffset {
+		if offset, err = strconv.ParseInt(offsetStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid byte range %#v", s)
+		}
+	}
+	return offset, length, nil
+}
+
+func parseKey(attrs map[string]string, base *url.URL) (*Key, error) {
+	method := attrs["METHOD"]
+	switch method {
+	case "NONE":
+		return nil, nil
+	case "AES-128":
+	default:
+		return nil, fmt.Errorf("unsupported encryption method %#v", method)
+	}
+	key := &Key{Method: method}
+	var err error
+	if key.URI, err = resolveURI(base, attrs["URI"]); err != nil {
+		return nil, err
+	}
+	if iv := attrs["IV"]; iv != "" {
+		iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+		if key.IV, err = hex.DecodeString(iv); err != nil || len(key.IV) != 16 {
+			return nil, fmt.Errorf("invalid IV %#v", attrs["IV"])
+		}
+	}
+	return key, nil
+}
+
+func resolveURI(base *url.URL, s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing URI")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,223 @@
+package html
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/oembed"
+)
+
+const providerName = "html"
+
+var ErrNoMedia = errors.New("no downloadable media found on page")
+
+// errNotPage is given by fetchPage for something that isn't a web page, so it can be handed over to a provider after
+// html (e.g. bin) instead.
+var errNotPage = fmt.Errorf("%w: not an HTML page", ErrNoMedia)
+
+// Pages bigger than this are unlikely to be worth searching.
+const maxPageSize = 5 * 1024 * 1024
+
+var protocols = generic.NewSet("http", "https")
+
+var pageTypes = generic.NewSet("text/html", "application/xhtml+xml")
+
+// Match accepts any web page, since it can't know whether there is media on the page until it has been fetched.
+func Match(s string) (video_archiver.Source, error) {
+	parsedURL, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !protocols.Contains(parsedURL.Scheme) {
+		return nil, fmt.Errorf("unknown URL scheme %v", parsedURL.Scheme)
+	}
+	return &source{url: s}, nil
+}
+
+func New() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:         providerName,
+		Match:        Match,
+		Description:  "Media embedded in any other web page, downloaded by whichever provider handles it",
+		Patterns:     []string{"https://{any web page}"},
+		Examples:     []string{"https://example.com/blog/2022/a-video"},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityAudio | video_archiver.CapabilityMetadata,
+	}
+}
+
+type source struct {
+	url string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+// Recon fetches the page and tries each media URL found on it with the other providers (from the context's
+// ProviderRegistry), until one of them can download it. If it isn't a web page after all (e.g. a direct link to a file
+// that no other provider recognised), it's handed over to the providers after html.
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	registry := video_archiver.ProviderRegistryFromContext(ctx)
+	page, err := fetchPage(ctx, s.url)
+	if errors.Is(err, errNotPage) {
+		if match, matchErr := registry.MatchAfter(providerName, s.url); matchErr == nil {
+			return match.Source.Recon(ctx)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	var result error
+	for _, media := range page.Media {
+		match, err := registry.Match(media)
+		if err == nil && match.ProviderName == providerName {
+			match, err = matchNotPage(ctx, registry, media)
+		}
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%v: %w", media, err))
+			continue
+		}
+		resolved, err := match.Source.Recon(ctx)
+		if video_archiver.IsTransient(err) {
+			return nil, err
+		} else if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%v: [%v] %w", media, match.ProviderName, err))
+			continue
+		}
+		if page.OEmbed != "" {
+			// Only nice to have, so carry on without it if it doesn't work
+			if response, err := oembed.Fetch(ctx, page.OEmbed); err == nil {
+				resolved = oembed.Enrich(resolved, response)
+			}
+		}
+		return wrap(resolved, s.url, page, media, match.ProviderName), nil
+	}
+	if result != nil {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: %v", ErrNoMedia, result))
+	}
+	return nil, video_archiver.Permanent(ErrNoMedia)
+}
+
+// matchNotPage matches media that only html matched with the providers after html, unless it's another page, because
+// following that could go on forever.
+func matchNotPage(ctx context.Context, registry *video_archiver.ProviderRegistry, media string) (*video_archiver.Match, error) {
+	if _, err := fetchPage(ctx, media); err == nil {
+		return nil, fmt.Errorf("another page, not followed")
+	} else if !errors.Is(err, errNotPage) {
+		return nil, err
+	}
+	return registry.MatchAfter(providerName, media)
+}
+
+func fetchPage(ctx context.Context, pageURL string) (*Page, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get page: %w", video_archiver.NewHTTPError(resp))
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !pageTypes.Contains(mediaType) {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w (%v)", errNotPage, mediaType))
+	}
+	// Relative URLs are relative to where the page ended up after any redirects
+	page, err := ParsePage(io.LimitReader(resp.Body, maxPageSize), resp.Request.URL)
+	if err == nil && page.OEmbed == "" {
+		page.OEmbed = oembed.EndpointFromHeader(resp.Header, resp.Request.URL)
+	}
+	return page, err
+}
+
+// wrap makes the source resolved by the provider that matched the media look like it came from the page, keeping its
+// sidecar information if it has some. Collections (e.g. a playlist or feed linked from the page) are returned as they
+// are, so that their children are still downloaded.
+func wrap(resolved video_archiver.ResolvedSource, pageURL string, page *Page, media string, provider string) video_archiver.ResolvedSource {
+	if _, ok := resolved.(video_archiver.CollectionSource); ok {
+		return resolved
+	}
+	wrapped := &resolvedSource{
+		ResolvedSource: resolved,
+		url:            pageURL,
+		page:           page,
+		media:          media,
+		provider:       provider,
+	}
+	if _, ok := resolved.(video_archiver.InfoSource); ok {
+		return &resolvedInfoSource{wrapped}
+	}
+	return wrapped
+}
+
+// A resolvedSource downloads using the provider that matched the media found on the page.
+type resolvedSource struct {
+	video_archiver.ResolvedSource
+	url      string
+	page     *Page
+	media    string
+	provider string
+}
+
+func (s *resolvedSource) URL() string {
+	return s.url
+}
+
+// String is the page's title if it has one, since the media URL probably isn't very descriptive.
+func (s *resolvedSource) String() string {
+	if s.page.Title != "" {
+		return s.page.Title
+	}
+	return s.ResolvedSource.String()
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := make(map[string]string)
+	if m, ok := s.ResolvedSource.(video_archiver.MetadataSource); ok {
+		for key, value := range m.Metadata() {
+			metadata[key] = value
+		}
+	}
+	metadata["html.media"] = s.media
+	metadata["html.provider"] = s.provider
+	return metadata
+}
+
+// A resolvedInfoSource keeps the sidecar information of a source that has it, filling in any gaps from the page.
+type resolvedInfoSource struct {
+	*resolvedSource
+}
+
+func (s *resolvedInfoSource) Info() *video_archiver.Info {
+	info := s.ResolvedSource.(video_archiver.InfoSource).Info()
+	if info.Title == "" {
+		info.Title = s.page.Title
+	}
+	if info.Description == "" {
+		info.Description = s.page.Description
+	}
+	if info.Thumbnail == "" {
+		info.Thumbnail = s.page.Thumbnail
+	}
+	return info
+}
+
+func init() {
+	video_archiver.DefaultProviderRegistry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 1))
+}
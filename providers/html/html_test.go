@@ -0,0 +1,197 @@
+package html
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/bin"
+	"github.com/alanbriolat/video-archiver/providers/feed"
+	"github.com/alanbriolat/video-archiver/providers/hls"
+	"github.com/alanbriolat/video-archiver/providers/raw"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	mux.HandleFunc("/media/clip.webm", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("webm video"))
+	})
+	mux.HandleFunc("/media/stream.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:1,\nsegment.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/media/segment.ts", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ts video"))
+	})
+	mux.HandleFunc("/media/episode.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		_, _ = w.Write([]byte("mp3 audio"))
+	})
+	mux.HandleFunc("/show.rss", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>The Show</title>` +
+			`<item><title>Episode 1</title><guid>ep-1</guid><enclosure url="/media/episode.mp3" type="audio/mpeg"/></item>` +
+			`<item><title>Episode 2</title><guid>ep-2</guid><enclosure url="/media/episode.mp3" type="audio/mpeg"/></item>` +
+			`</channel></rss>`))
+	})
+	mux.HandleFunc("/oembed.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"type": "video", "version": "1.0", "title": "Streamed", "author_name": "Someone"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func download(t *testing.T, ctx context.Context, s string) (string, video_archiver.ResolvedSource, error) {
+	match, err := video_archiver.ProviderRegistryFromContext(ctx).Match(s)
+	if err != nil {
+		return "", nil, err
+	}
+	resolved, err := match.Source.Recon(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := t.TempDir()
+	d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+		WithContext(ctx).
+		WithTargetPrefix(dir + string(os.PathSeparator)).
+		WithTempPath(t.TempDir()).
+		Build())
+	defer d.Close()
+	if err := resolved.Download(d); err != nil {
+		return "", resolved, err
+	}
+	generic.Unwrap_(d.Commit())
+	return dir, resolved, nil
+}
+
+func TestDownload(t *testing.T) {
+	assert := assert_.New(t)
+	server := newTestServer(t)
+	registry := &video_archiver.ProviderRegistry{}
+	registry.MustAdd(hls.New().WithPriority(video_archiver.PriorityLowest - 3))
+	registry.MustAdd(raw.NewConfig().Provider().WithPriority(video_archiver.PriorityLowest - 2))
+	registry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 1))
+	ctx := video_archiver.WithProviderRegistry(context.Background(), registry)
+
+	// The og:video is a player page rather than media, so the first <source> is used
+	dir, resolved, err := download(t, ctx, server.URL+"/article.html")
+	if assert.NoError(err) {
+		assert.Equal("Cats & Dogs", resolved.String())
+		assert.Equal(server.URL+"/article.html", resolved.URL())
+		assert.Equal(map[string]string{
+			"html.media":    server.URL + "/media/clip.webm",
+			"html.provider": "raw",
+		}, resolved.(video_archiver.MetadataSource).Metadata())
+		assert.Equal("webm video", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "clip.webm")))))
+	}
+
+	// JSON-LD is preferred, and the HLS provider's metadata is kept, along with the page's oEmbed information
+	dir, resolved, err = download(t, ctx, server.URL+"/jsonld.html")
+	if assert.NoError(err) {
+		assert.Equal("Stream", resolved.String())
+		metadata := resolved.(video_archiver.MetadataSource).Metadata()
+		assert.Equal("hls", metadata["html.provider"])
+		assert.Equal("1", metadata["hls.segments"])
+		assert.Equal("Someone", metadata["oembed.author"])
+		assert.Equal("ts video", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "stream.ts")))))
+	}
+
+	// Links to other pages aren't followed
+	_, _, err = download(t, ctx, server.URL+"/links.html")
+	assert.ErrorIs(err, ErrNoMedia)
+	assert.False(video_archiver.IsTransient(err))
+	_, _, err = download(t, ctx, server.URL+"/empty.html")
+	assert.ErrorIs(err, ErrNoMedia)
+	// Not a web page
+	_, _, err = download(t, ctx, server.URL+"/media/segment.ts")
+	assert.ErrorIs(err, ErrNoMedia)
+
+	// Unless there's a provider after html that can download anything
+	registry.MustCreatePriority("bin", bin.Match, video_archiver.PriorityLowest)
+	for _, s := range []string{server.URL + "/media/episode.mp3", server.URL + "/podcast.html"} {
+		dir, resolved, err = download(t, ctx, s)
+		if assert.NoError(err, s) {
+			files := generic.Unwrap(os.ReadDir(dir))
+			if assert.Len(files, 1, s) {
+				assert.Equal("mp3 audio", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, files[0].Name())))))
+			}
+		}
+	}
+	// The page's media is downloaded, but not the other page it links to
+	assert.Equal("bin", resolved.(video_archiver.MetadataSource).Metadata()["html.provider"])
+	_, _, err = download(t, ctx, server.URL+"/links.html")
+	assert.ErrorIs(err, ErrNoMedia)
+}
+
+func TestCollectionsAndInfo(t *testing.T) {
+	assert := assert_.New(t)
+	server := newTestServer(t)
+	registry := &video_archiver.ProviderRegistry{}
+	registry.MustAdd(feed.New().WithPriority(video_archiver.PriorityLowest - 3))
+	registry.MustAdd(New().WithPriority(video_archiver.PriorityLowest - 1))
+	ctx := video_archiver.WithProviderRegistry(context.Background(), registry)
+
+	// A feed linked from a page is still a collection, so each item gets downloaded
+	resolved, err := generic.Unwrap(registry.Match(server.URL + "/show.html")).Source.Recon(ctx)
+	if assert.NoError(err) {
+		collection, ok := resolved.(video_archiver.CollectionSource)
+		if assert.True(ok) {
+			assert.Len(collection.Children(), 2)
+		}
+	}
+
+	// Sidecar information comes from whatever the page links to, with gaps filled in from the page
+	resolved, err = generic.Unwrap(registry.Match(server.URL + "/episode.html")).Source.Recon(ctx)
+	if assert.NoError(err) {
+		source, ok := resolved.(video_archiver.InfoSource)
+		if assert.True(ok) {
+			info := source.Info()
+			assert.Equal("Episode 1", info.Title)
+			assert.Equal("The first episode.", info.Description)
+		}
+		assert.Equal(server.URL+"/episode.html", resolved.URL())
+		assert.Equal("feed", resolved.(video_archiver.MetadataSource).Metadata()["html.provider"])
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	assert := assert_.New(t)
+	base := generic.Unwrap(url.Parse("https://example.com/articles/1"))
+
+	page := generic.Unwrap(ParsePage(generic.Unwrap(os.Open("testdata/article.html")), base))
+	assert.Equal(&Page{
+		Title:       "Cats & Dogs",
+		Description: "A short film about cats and dogs.",
+		Thumbnail:   "https://example.com/images/poster.jpg",
+		Media: []string{
+			"https://www.example.com/player?id=1",
+			"https://example.com/articles/media/clip.webm",
+			"https://example.com/articles/media/clip.mp4",
+		},
+	}, page)
+
+	page = generic.Unwrap(ParsePage(generic.Unwrap(os.Open("testdata/jsonld.html")), base))
+	assert.Equal(&Page{
+		Title:       "Stream",
+		Description: "A streamed video.",
+		Thumbnail:   "https://example.com/media/thumb.jpg",
+		Media: []string{
+			"https://example.com/media/stream.m3u8",
+			"https://embed.example.com/video/1",
+			"https://example.com/media/fallback.mp4",
+		},
+		OEmbed: "https://example.com/oembed.json?url=jsonld.html",
+	}, page)
+
+	page = generic.Unwrap(ParsePage(generic.Unwrap(os.Open("testdata/empty.html")), base))
+	assert.Equal(&Page{Title: "Nothing to see here"}, page)
+}
@@ -0,0 +1,187 @@
+package html
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/alanbriolat/video-archiver/providers/oembed"
+)
+
+// A Page is what was found on a web page: some information about it, and the URLs of any media it refers to.
+type Page struct {
+	Title       string
+	Description string
+	Thumbnail   string
+	// Absolute URLs of media, most likely to be the page's main video first.
+	Media []string
+	// The page's oEmbed endpoint, if it has one.
+	OEmbed string
+}
+
+var (
+	commentPattern   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	titlePattern     = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	scriptPattern    = regexp.MustCompile(`(?is)<script\b([^>]*)>(.*?)</script\s*>`)
+	tagPattern       = regexp.MustCompile(`(?is)<(base|meta|video|source)\b([^>]*)>`)
+	attributePattern = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+)))?`)
+)
+
+// ParsePage finds media on an HTML page, from schema.org VideoObject JSON-LD, Open Graph "og:video" meta tags, and
+// <video>/<source> tags, in that order of preference. Relative URLs are resolved against base, or the page's <base>
+// if it has one.
+func ParsePage(r io.Reader, base *url.URL) (*Page, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	doc := commentPattern.ReplaceAllString(string(data), "")
+	page := &Page{}
+	media := &urlList{base: base}
+
+	var meta = make(map[string]string)
+	var videoTags []string
+	for _, match := range tagPattern.FindAllStringSubmatch(doc, -1) {
+		attrs := parseAttributes(match[2])
+		switch strings.ToLower(match[1]) {
+		case "base":
+			if href := attrs["href"]; href != "" {
+				if u, err := base.Parse(href); err == nil {
+					media.base = u
+				}
+			}
+		case "meta":
+			key := attrs["property"]
+			if key == "" {
+				key = attrs["name"]
+			}
+			if key = strings.ToLower(key); key != "" && meta[key] == "" {
+				meta[key] = attrs["content"]
+			}
+		case "video", "source":
+			videoTags = append(videoTags, attrs["src"])
+		}
+	}
+
+	for _, match := range scriptPattern.FindAllStringSubmatch(doc, -1) {
+		if strings.EqualFold(strings.TrimSpace(parseAttributes(match[1])["type"]), "application/ld+json") {
+			var value interface{}
+			if json.Unmarshal([]byte(strings.TrimSpace(match[2])), &value) == nil {
+				findVideoObjects(value, page, media)
+			}
+		}
+	}
+	media.add(meta["og:video:secure_url"], meta["og:video:url"], meta["og:video"])
+	media.add(videoTags...)
+	page.Media = media.urls
+
+	if title := meta["og:title"]; title != "" {
+		page.Title = title
+	} else if page.Title == "" {
+		if match := titlePattern.FindStringSubmatch(doc); match != nil {
+			page.Title = strings.TrimSpace(html.UnescapeString(match[1]))
+		}
+	}
+	if page.Description == "" {
+		page.Description = firstNonEmpty(meta["og:description"], meta["description"])
+	}
+	if page.Thumbnail == "" {
+		page.Thumbnail = media.resolve(meta["og:image"])
+	}
+	page.OEmbed = oembed.FindEndpoint(doc, media.base)
+	return page, nil
+}
+
+// findVideoObjects adds the media from each VideoObject in some JSON-LD, which may be a single object, an array, or
+// an object with a "@graph" of objects. Information about the page comes from the first VideoObject.
+func findVideoObjects(value interface{}, page *Page, media *urlList) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			findVideoObjects(v, page, media)
+		}
+	case map[string]interface{}:
+		if graph, ok := value["@graph"]; ok {
+			findVideoObjects(graph, page, media)
+		}
+		if value["@type"] != "VideoObject" {
+			return
+		}
+		media.add(jsonString(value["contentUrl"]), jsonString(value["embedUrl"]))
+		if page.Title == "" {
+			page.Title = jsonString(value["name"])
+		}
+		if page.Description == "" {
+			page.Description = jsonString(value["description"])
+		}
+		if page.Thumbnail == "" {
+			page.Thumbnail = media.resolve(jsonString(value["thumbnailUrl"]))
+		}
+	}
+}
+
+// jsonString gets a string from a JSON value that should be a string, or might be an array of strings.
+func jsonString(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case []interface{}:
+		if len(value) > 0 {
+			return jsonString(value[0])
+		}
+	}
+	return ""
+}
+
+// parseAttributes parses the attributes of a tag, with lower case names and unescaped values.
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range attributePattern.FindAllStringSubmatch(s, -1) {
+		attrs[strings.ToLower(match[1])] = html.UnescapeString(match[2] + match[3] + match[4])
+	}
+	return attrs
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// A urlList is a list of unique absolute URLs.
+type urlList struct {
+	base *url.URL
+	urls []string
+}
+
+func (l *urlList) resolve(s string) string {
+	if s == "" || strings.HasPrefix(s, "data:") || strings.HasPrefix(s, "blob:") {
+		return ""
+	}
+	u, err := l.base.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func (l *urlList) add(urls ...string) {
+	for _, s := range urls {
+		if s = l.resolve(s); s == "" {
+			continue
+		}
+		found := false
+		for _, existing := range l.urls {
+			found = found || existing == s
+		}
+		if !found {
+			l.urls = append(l.urls, s)
+		}
+	}
+}
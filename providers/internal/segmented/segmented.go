@@ -0,0 +1,109 @@
+// Package segmented has the parts of downloading segmented streams (e.g. HLS and DASH) that don't depend on the
+// manifest format: fetching each segment with retries, and estimating progress.
+package segmented
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// How many times to retry each segment after a transient error, unless configured otherwise.
+const DefaultRetries = 3
+
+// Delay before the first retry of a segment, doubled for each subsequent retry.
+var RetryDelay = time.Second
+
+// A Request is for a whole resource, or part of it if Length > 0.
+type Request struct {
+	URL string
+	// Byte range, if Length > 0
+	Offset int64
+	Length int64
+}
+
+// RetriesFromOptions gets how many times to retry each segment from a provider option, or DefaultRetries if it isn't
+// set.
+func RetriesFromOptions(options video_archiver.Options, option string) (int, error) {
+	if options.Get(option) == "" {
+		return DefaultRetries, nil
+	}
+	return options.Int(option)
+}
+
+// Get makes a request once, with the context's http.Client.
+func Get(ctx context.Context, r Request) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	if r.Length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1))
+	}
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && r.Length > 0:
+		return io.ReadAll(resp.Body)
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil || r.Length == 0 {
+			return data, err
+		}
+		// Server ignored the range, so pick it out of the whole resource
+		if int64(len(data)) < r.Offset+r.Length {
+			return nil, video_archiver.Permanent(fmt.Errorf("byte range %d-%d is beyond the end of %v", r.Offset, r.Offset+r.Length-1, r.URL))
+		}
+		return data[r.Offset : r.Offset+r.Length], nil
+	default:
+		return nil, video_archiver.NewHTTPError(resp)
+	}
+}
+
+// Fetch makes a request, retrying up to retries times after transient errors.
+func Fetch(ctx context.Context, retries int, r Request) ([]byte, error) {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		data, err := Get(ctx, r)
+		if err == nil || attempt >= retries || !video_archiver.IsTransient(err) {
+			return data, err
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// A Progress extrapolates the expected size of a download from the segments fetched so far, since the total size is
+// unknown until the end.
+type Progress struct {
+	d        video_archiver.Download
+	total    int
+	fetched  int
+	bytes    int
+	estimate int
+}
+
+// NewProgress creates a Progress for a download of total segments.
+func NewProgress(d video_archiver.Download, total int) *Progress {
+	return &Progress{d: d, total: total}
+}
+
+// Add counts a segment of n bytes, and updates the expected size of the download.
+func (p *Progress) Add(n int) {
+	p.fetched++
+	p.bytes += n
+	estimate := p.bytes * p.total / p.fetched
+	p.d.AddExpectedBytes(estimate - p.estimate)
+	p.estimate = estimate
+}
@@ -0,0 +1,69 @@
+package segmented
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestFetch(t *testing.T) {
+	assert := assert_.New(t)
+	RetryDelay = time.Millisecond
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			if failures > 0 {
+				failures--
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+		// Ignores any byte range
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	data, err := Get(ctx, Request{URL: server.URL + "/file"})
+	if assert.NoError(err) {
+		assert.Equal("0123456789", string(data))
+	}
+	data, err = Get(ctx, Request{URL: server.URL + "/file", Offset: 2, Length: 3})
+	if assert.NoError(err) {
+		assert.Equal("234", string(data))
+	}
+	_, err = Get(ctx, Request{URL: server.URL + "/file", Offset: 8, Length: 3})
+	if assert.Error(err) {
+		assert.False(video_archiver.IsTransient(err))
+	}
+
+	failures = 2
+	data, err = Fetch(ctx, 2, Request{URL: server.URL + "/flaky"})
+	if assert.NoError(err) {
+		assert.Equal("0123456789", string(data))
+	}
+	failures = 2
+	_, err = Fetch(ctx, 1, Request{URL: server.URL + "/flaky"})
+	assert.True(video_archiver.IsTransient(err))
+	_, err = Fetch(ctx, 3, Request{URL: server.URL + "/missing"})
+	assert.False(video_archiver.IsTransient(err))
+}
+
+func TestRetriesFromOptions(t *testing.T) {
+	assert := assert_.New(t)
+	assert.Equal(DefaultRetries, generic.Unwrap(RetriesFromOptions(video_archiver.Options{}, "test.retries")))
+	assert.Equal(5, generic.Unwrap(RetriesFromOptions(video_archiver.Options{"test.retries": "5"}, "test.retries")))
+	_, err := RetriesFromOptions(video_archiver.Options{"test.retries": "many"}, "test.retries")
+	assert.Error(err)
+}
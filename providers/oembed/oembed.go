@@ -0,0 +1,273 @@
+// Package oembed adds information from a site's oEmbed endpoint (title, author, thumbnail, dimensions) to sources
+// from other providers, which otherwise often only know the URL they were given.
+package oembed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+const jsonType = "application/json+oembed"
+
+var ErrNoEndpoint = errors.New("no oEmbed endpoint found")
+
+// Responses and pages bigger than this are unlikely to be worth reading.
+const maxSize = 1024 * 1024
+
+// A Response is the information an oEmbed endpoint gives about a URL.
+type Response struct {
+	Type            string    `json:"type"`
+	Title           string    `json:"title"`
+	AuthorName      string    `json:"author_name"`
+	AuthorURL       string    `json:"author_url"`
+	ProviderName    string    `json:"provider_name"`
+	ThumbnailURL    string    `json:"thumbnail_url"`
+	ThumbnailWidth  dimension `json:"thumbnail_width"`
+	ThumbnailHeight dimension `json:"thumbnail_height"`
+	Width           dimension `json:"width"`
+	Height          dimension `json:"height"`
+}
+
+// A dimension is a number of pixels, which some endpoints give as a string.
+type dimension int
+
+func (d *dimension) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*d = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid dimension %v", string(data))
+	}
+	*d = dimension(f)
+	return nil
+}
+
+// Metadata describes the response as for video_archiver.MetadataSource.
+func (r *Response) Metadata() map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range map[string]string{
+		"oembed.title":     r.Title,
+		"oembed.author":    r.AuthorName,
+		"oembed.provider":  r.ProviderName,
+		"oembed.thumbnail": r.ThumbnailURL,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if r.Width > 0 && r.Height > 0 {
+		metadata["oembed.resolution"] = fmt.Sprintf("%dx%d", r.Width, r.Height)
+	}
+	return metadata
+}
+
+var (
+	linkPattern      = regexp.MustCompile(`(?is)<link\b([^>]*)>`)
+	attributePattern = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+)))?`)
+	headerPattern    = regexp.MustCompile(`<([^>]*)>((?:\s*;\s*[^;,]+)*)`)
+)
+
+// FindEndpoint finds the JSON oEmbed endpoint advertised by an HTML page with a <link> tag, resolved relative to
+// base, or "" if there isn't one.
+func FindEndpoint(doc string, base *url.URL) string {
+	for _, match := range linkPattern.FindAllStringSubmatch(doc, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range attributePattern.FindAllStringSubmatch(match[1], -1) {
+			attrs[strings.ToLower(attr[1])] = html.UnescapeString(attr[2] + attr[3] + attr[4])
+		}
+		if strings.EqualFold(attrs["type"], jsonType) && attrs["href"] != "" {
+			if u, err := base.Parse(attrs["href"]); err == nil {
+				return u.String()
+			}
+		}
+	}
+	return ""
+}
+
+// EndpointFromHeader finds the JSON oEmbed endpoint advertised by a "Link" response header, resolved relative to
+// base, or "" if there isn't one. This works for any response, not just HTML pages.
+func EndpointFromHeader(header http.Header, base *url.URL) string {
+	for _, value := range header.Values("Link") {
+		for _, match := range headerPattern.FindAllStringSubmatch(value, -1) {
+			for _, param := range strings.Split(match[2], ";") {
+				name, value, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(name), "type") && strings.EqualFold(strings.Trim(strings.TrimSpace(value), `"`), jsonType) {
+					if u, err := base.Parse(match[1]); err == nil {
+						return u.String()
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Discover gets the JSON oEmbed endpoint for a URL, from the response headers or, if it's an HTML page, the page
+// itself. Only the headers are requested at first, so that nothing else (e.g. a video) is downloaded.
+func Discover(ctx context.Context, s string) (string, error) {
+	resp, err := request(ctx, http.MethodHead, s)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if endpoint := EndpointFromHeader(resp.Header, resp.Request.URL); endpoint != "" {
+		return endpoint, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return "", ErrNoEndpoint
+	}
+	resp, err = request(ctx, http.MethodGet, resp.Request.URL.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize))
+	if err != nil {
+		return "", err
+	}
+	if endpoint := FindEndpoint(string(data), resp.Request.URL); endpoint != "" {
+		return endpoint, nil
+	}
+	return "", ErrNoEndpoint
+}
+
+// request makes a request with the context's http.Client, returning an error for anything but a successful response.
+func request(ctx context.Context, method string, s string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s, nil)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, video_archiver.NewHTTPError(resp)
+	}
+	return resp, nil
+}
+
+// Fetch gets the response from an oEmbed endpoint.
+func Fetch(ctx context.Context, endpoint string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, video_archiver.NewHTTPError(resp)
+	}
+	response := &Response{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSize)).Decode(response); err != nil {
+		return nil, video_archiver.Permanent(fmt.Errorf("invalid oEmbed response: %w", err))
+	}
+	return response, nil
+}
+
+// Wrap makes a provider's sources look for an oEmbed endpoint after their own Recon. Finding the endpoint is best
+// effort, so the source is resolved as before if there isn't one or it doesn't work.
+func Wrap(p video_archiver.Provider) video_archiver.Provider {
+	match := p.Match
+	p.Match = func(s string) (video_archiver.Source, error) {
+		source, err := match(s)
+		if err != nil || source == nil {
+			return source, err
+		}
+		return &wrappedSource{source}, nil
+	}
+	return p
+}
+
+type wrappedSource struct {
+	video_archiver.Source
+}
+
+func (s *wrappedSource) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	resolved, err := s.Source.Recon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := Discover(ctx, s.URL())
+	if err != nil {
+		return resolved, nil
+	}
+	response, err := Fetch(ctx, endpoint)
+	if err != nil {
+		return resolved, nil
+	}
+	return Enrich(resolved, response), nil
+}
+
+// Enrich adds the information from an oEmbed response to a resolved source: its title becomes the source's String()
+// and everything else is added to its metadata. Collections are returned as they are.
+func Enrich(resolved video_archiver.ResolvedSource, response *Response) video_archiver.ResolvedSource {
+	if _, ok := resolved.(video_archiver.CollectionSource); ok {
+		return resolved
+	}
+	enriched := &resolvedSource{ResolvedSource: resolved, response: response}
+	if _, ok := resolved.(video_archiver.InfoSource); ok {
+		return &resolvedInfoSource{enriched}
+	}
+	return enriched
+}
+
+type resolvedSource struct {
+	video_archiver.ResolvedSource
+	response *Response
+}
+
+func (s *resolvedSource) String() string {
+	if s.response.Title != "" {
+		return s.response.Title
+	}
+	return s.ResolvedSource.String()
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := s.response.Metadata()
+	if m, ok := s.ResolvedSource.(video_archiver.MetadataSource); ok {
+		for key, value := range m.Metadata() {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// A resolvedInfoSource keeps the sidecar information of a source that has it, filling in any gaps from the response.
+type resolvedInfoSource struct {
+	*resolvedSource
+}
+
+func (s *resolvedInfoSource) Info() *video_archiver.Info {
+	info := s.ResolvedSource.(video_archiver.InfoSource).Info()
+	if info.Title == "" {
+		info.Title = s.response.Title
+	}
+	if info.Uploader == "" {
+		info.Uploader = s.response.AuthorName
+	}
+	if info.Thumbnail == "" {
+		info.Thumbnail = s.response.ThumbnailURL
+	}
+	return info
+}
@@ -0,0 +1,115 @@
+package oembed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+type testSource struct {
+	url string
+}
+
+func (s *testSource) URL() string {
+	return s.url
+}
+
+func (s *testSource) String() string {
+	return s.url
+}
+
+func (s *testSource) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	return s, nil
+}
+
+func (s *testSource) Download(d video_archiver.Download) error {
+	return nil
+}
+
+func (s *testSource) Metadata() map[string]string {
+	return map[string]string{"test.url": s.url}
+}
+
+var testProvider = Wrap(video_archiver.Provider{
+	Name: "test",
+	Match: func(s string) (video_archiver.Source, error) {
+		return &testSource{url: s}, nil
+	},
+})
+
+func recon(t *testing.T, s string) video_archiver.ResolvedSource {
+	source := generic.Unwrap(testProvider.Match(s))
+	return generic.Unwrap(source.Recon(context.Background()))
+}
+
+func TestWrap(t *testing.T) {
+	assert := assert_.New(t)
+	mediaRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head>
+			<link rel="alternate" type="application/xml+oembed" href="/oembed.xml">
+			<link rel="alternate" type="application/json+oembed" href="/oembed?url=page&amp;format=json">
+			</head></html>`))
+	})
+	mux.HandleFunc("/video.mp4", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			mediaRequests++
+		}
+		w.Header().Set("Link", `</style.css>; rel=preload, </oembed?url=video>; rel="alternate"; type="application/json+oembed"`)
+		_, _ = w.Write([]byte("video data"))
+	})
+	mux.HandleFunc("/plain.mp4", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			mediaRequests++
+		}
+		_, _ = w.Write([]byte("video data"))
+	})
+	mux.HandleFunc("/oembed", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"type": "video", "version": "1.0", "title": "Title of ` + r.URL.Query().Get("url") + `",
+			"author_name": "Author", "provider_name": "Example", "thumbnail_url": "https://example.com/thumb.jpg",
+			"width": "1280", "height": 720}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resolved := recon(t, server.URL+"/page")
+	assert.Equal("Title of page", resolved.String())
+	assert.Equal(map[string]string{
+		"oembed.title":      "Title of page",
+		"oembed.author":     "Author",
+		"oembed.provider":   "Example",
+		"oembed.thumbnail":  "https://example.com/thumb.jpg",
+		"oembed.resolution": "1280x720",
+		"test.url":          server.URL + "/page",
+	}, resolved.(video_archiver.MetadataSource).Metadata())
+
+	// Discovered from the header without requesting the video
+	resolved = recon(t, server.URL+"/video.mp4")
+	assert.Equal("Title of video", resolved.String())
+
+	// No endpoint, or one that doesn't work, leaves the source as it was
+	resolved = recon(t, server.URL+"/plain.mp4")
+	assert.Equal(&testSource{url: server.URL + "/plain.mp4"}, resolved)
+	resolved = recon(t, server.URL+"/missing")
+	assert.Equal(&testSource{url: server.URL + "/missing"}, resolved)
+	assert.Equal(0, mediaRequests)
+}
+
+func TestEndpointFromHeader(t *testing.T) {
+	assert := assert_.New(t)
+	base := generic.Unwrap(url.Parse("https://example.com/videos/1"))
+	header := http.Header{}
+	assert.Equal("", EndpointFromHeader(header, base))
+	header.Add("Link", `<https://example.com/oembed.xml>; rel="alternate"; type="text/xml+oembed"`)
+	header.Add("Link", `<oembed.json>; rel="alternate"; type="application/json+oembed"; title="Video"`)
+	assert.Equal("https://example.com/videos/oembed.json", EndpointFromHeader(header, base))
+}
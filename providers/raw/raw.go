@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"sort"
 
 	"github.com/alanbriolat/video-archiver"
 	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/providers/oembed"
 	"github.com/alanbriolat/video-archiver/util"
 )
 
@@ -62,9 +64,18 @@ func (c *Config) Match(s string) (video_archiver.Source, error) {
 }
 
 func (c Config) Provider() video_archiver.Provider {
+	var patterns []string
+	for _, ext := range c.Extensions.ToSlice() {
+		patterns = append(patterns, "*"+ext)
+	}
+	sort.Strings(patterns)
 	return video_archiver.Provider{
-		Name:  "raw",
-		Match: c.Match,
+		Name:         "raw",
+		Match:        c.Match,
+		Description:  "Video files, downloaded as they are",
+		Patterns:     patterns,
+		Examples:     []string{"https://example.com/videos/video.mp4"},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityMetadata,
 	}
 }
 
@@ -91,6 +102,6 @@ func (s *source) Download(d video_archiver.Download) error {
 
 func init() {
 	video_archiver.DefaultProviderRegistry.MustAdd(
-		NewConfig().Provider().WithPriority(video_archiver.PriorityLowest - 1),
+		oembed.Wrap(NewConfig().Provider()).WithPriority(video_archiver.PriorityLowest - 2),
 	)
 }
@@ -0,0 +1,93 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dop251/goja"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+var fetchProtocols = generic.NewSet("http", "https")
+
+// fetchOptions are the optional second argument of fetch().
+type fetchOptions struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// newFetch creates the fetch() function for a runtime. Only HTTP(S) requests are allowed, made with the context's
+// http.Client, and the total size of the responses counts against the memory budget.
+func newFetch(ctx context.Context, vm *goja.Runtime, budget int64) func(goja.FunctionCall) goja.Value {
+	var used int64
+	throw := func(err error) {
+		panic(vm.NewGoError(err))
+	}
+	return func(call goja.FunctionCall) goja.Value {
+		target := call.Argument(0).String()
+		u, err := url.Parse(target)
+		if err != nil {
+			throw(err)
+		} else if !fetchProtocols.Contains(u.Scheme) {
+			throw(fmt.Errorf("fetch: unsupported URL scheme %#v", u.Scheme))
+		}
+		options := fetchOptions{Method: http.MethodGet}
+		if arg := call.Argument(1); !goja.IsUndefined(arg) && !goja.IsNull(arg) {
+			if err := vm.ExportTo(arg, &options); err != nil {
+				throw(fmt.Errorf("fetch: invalid options: %w", err))
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, strings.ToUpper(options.Method), u.String(), strings.NewReader(options.Body))
+		if err != nil {
+			throw(err)
+		}
+		for name, value := range options.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := video_archiver.HTTPClientFromContext(ctx).Do(req)
+		if err != nil {
+			throw(err)
+		}
+		defer resp.Body.Close()
+		// Read one byte more than allowed, to know if the budget has been exceeded
+		body, err := io.ReadAll(io.LimitReader(resp.Body, budget-used+1))
+		if err != nil {
+			throw(err)
+		}
+		if used += int64(len(body)); used > budget {
+			vm.Interrupt(ErrMemoryBudget)
+			return goja.Undefined()
+		}
+
+		headers := make(map[string]interface{}, len(resp.Header))
+		for name := range resp.Header {
+			headers[strings.ToLower(name)] = resp.Header.Get(name)
+		}
+		text := string(body)
+		response := vm.NewObject()
+		for name, value := range map[string]interface{}{
+			"status":  resp.StatusCode,
+			"url":     resp.Request.URL.String(),
+			"headers": headers,
+			"text":    text,
+			"json": func(goja.FunctionCall) goja.Value {
+				parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+				value, err := parse(goja.Undefined(), vm.ToValue(text))
+				if err != nil {
+					throw(err)
+				}
+				return value
+			},
+		} {
+			_ = response.Set(name, value)
+		}
+		return response
+	}
+}
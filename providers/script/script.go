@@ -0,0 +1,363 @@
+/*
+Package script provides sources from JavaScript extractors, so that support for a site can be added without rebuilding.
+
+Each script is a provider named after its file (without ".js"), and defines two functions:
+
+	// Whether the script handles the URL.
+	function match(url) { return url.startsWith("https://videos.example.com/"); }
+
+	// What to download for the URL, throwing an error if it can't be downloaded.
+	function recon(url) {
+		var video = fetch("https://videos.example.com/api/" + url.split("/").pop()).json();
+		return {
+			name: video.title,
+			metadata: {"example.quality": video.quality},
+			downloads: [{url: video.src, filename: video.id + ".mp4", headers: {"Referer": url}}],
+		};
+	}
+
+It may also set a global "priority" (see video_archiver.Provider), which defaults to 0, and describe itself to users
+with these globals:
+
+	var description = "Videos from example.com";
+	var hosts = ["videos.example.com"];
+	var patterns = ["https://videos.example.com/{id}"];
+	// URLs the script should match, which are checked by video_archiver.ProviderRegistry.CheckExamples.
+	var examples = ["https://videos.example.com/1234"];
+	// What the script can produce (see video_archiver.ParseCapabilities).
+	var capabilities = ["video", "metadata"];
+
+Scripts can't access anything outside the JavaScript runtime, except through these globals:
+
+	// Make an HTTP(S) request, returning {status, url, headers, text, json()}. Header names are lower case.
+	fetch(url, {method: "GET", headers: {...}, body: "..."})
+	// Provider options (see video_archiver.Options).
+	options
+
+Errors thrown by the script are permanent, unless the thrown object has "transient: true". Each call to a script has a
+time limit and a budget for the responses it fetches (see Limits).
+*/
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+var (
+	ErrScript       = errors.New("script failed")
+	ErrTimeout      = errors.New("script took too long")
+	ErrMemoryBudget = errors.New("script exceeded its memory budget")
+)
+
+// Limits on each call to a script.
+type Limits struct {
+	// How long the call can take, including any requests it makes.
+	Timeout time.Duration
+	// How much memory the call can use for the responses to any requests it makes. Memory used by the script itself
+	// isn't counted, because the Go heap is shared with everything else in the process.
+	MemoryBudget int64
+}
+
+var DefaultLimits = Limits{
+	Timeout:      30 * time.Second,
+	MemoryBudget: 64 * 1024 * 1024,
+}
+
+// A Script is a compiled extractor.
+type Script struct {
+	Name     string
+	Priority int16
+	Limits   Limits
+	program  *goja.Program
+
+	// Descriptions of the script, from the globals of the same name (see video_archiver.Provider).
+	Description  string
+	Hosts        []string
+	Patterns     []string
+	Examples     []string
+	Capabilities video_archiver.Capability
+}
+
+// Load compiles a script, named after its file.
+func Load(path string) (*Script, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	s := &Script{Name: name, Limits: DefaultLimits}
+	if s.program, err = goja.Compile(filepath.Base(path), string(src), false); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrScript, err)
+	}
+	// Run the script once to check it defines what it should
+	vm, err := s.newRuntime(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, function := range []string{"match", "recon"} {
+		if _, ok := goja.AssertFunction(vm.Get(function)); !ok {
+			return nil, fmt.Errorf("%w: %v doesn't define %v()", ErrScript, filepath.Base(path), function)
+		}
+	}
+	if priority := vm.Get("priority"); priority != nil && !goja.IsUndefined(priority) {
+		s.Priority = int16(priority.ToInteger())
+	}
+	if description := vm.Get("description"); description != nil && !goja.IsUndefined(description) {
+		s.Description = description.String()
+	}
+	var capabilities []string
+	for global, target := range map[string]*[]string{
+		"hosts":        &s.Hosts,
+		"patterns":     &s.Patterns,
+		"examples":     &s.Examples,
+		"capabilities": &capabilities,
+	} {
+		if value := vm.Get(global); value != nil && !goja.IsUndefined(value) {
+			if err := vm.ExportTo(value, target); err != nil {
+				return nil, fmt.Errorf("%w: %v: invalid %v: %v", ErrScript, filepath.Base(path), global, err)
+			}
+		}
+	}
+	if s.Capabilities, err = video_archiver.ParseCapabilities(capabilities); err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrScript, filepath.Base(path), err)
+	}
+	return s, nil
+}
+
+// LoadDir compiles each ".js" file in a directory, in name order.
+func LoadDir(dir string) ([]*Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.js"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var scripts []*Script
+	for _, path := range paths {
+		s, err := Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v: %w", path, err)
+		}
+		scripts = append(scripts, s)
+	}
+	return scripts, nil
+}
+
+// RegisterDir adds a provider to the registry for each script in a directory.
+func RegisterDir(r *video_archiver.ProviderRegistry, dir string) error {
+	scripts, err := LoadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range scripts {
+		if err := r.Add(s.Provider()); err != nil {
+			return fmt.Errorf("failed to add provider %v: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Script) Provider() video_archiver.Provider {
+	return video_archiver.Provider{
+		Name:         s.Name,
+		Match:        s.Match,
+		Priority:     s.Priority,
+		Description:  s.Description,
+		Hosts:        s.Hosts,
+		Patterns:     s.Patterns,
+		Examples:     s.Examples,
+		Capabilities: s.Capabilities,
+	}
+}
+
+func (s *Script) Match(u string) (video_archiver.Source, error) {
+	var matched bool
+	if err := s.call(context.Background(), "match", u, &matched); err != nil {
+		return nil, err
+	}
+	if !matched {
+		return nil, fmt.Errorf("script did not match")
+	}
+	return &source{script: s, url: u}, nil
+}
+
+// newRuntime creates a fresh runtime for a call, with the script and its globals loaded.
+func (s *Script) newRuntime(ctx context.Context) (*goja.Runtime, error) {
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+	vm.SetMaxCallStackSize(1000)
+	options := make(map[string]interface{})
+	for key, value := range video_archiver.OptionsFromContext(ctx) {
+		options[key] = value
+	}
+	if err := vm.Set("options", options); err != nil {
+		return nil, err
+	}
+	if err := vm.Set("fetch", newFetch(ctx, vm, s.Limits.MemoryBudget)); err != nil {
+		return nil, err
+	}
+	if _, err := vm.RunProgram(s.program); err != nil {
+		return nil, s.wrapError(err)
+	}
+	return vm, nil
+}
+
+// call runs a function of the script within its limits, exporting the result to out.
+func (s *Script) call(ctx context.Context, function string, u string, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Limits.Timeout)
+	defer cancel()
+
+	vm, err := s.newRuntime(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				vm.Interrupt(ErrTimeout)
+			} else {
+				vm.Interrupt(ctx.Err())
+			}
+		}
+	}()
+
+	f, _ := goja.AssertFunction(vm.Get(function))
+	result, err := f(goja.Undefined(), vm.ToValue(u))
+	if err != nil {
+		return s.wrapError(err)
+	}
+	if err := vm.ExportTo(result, out); err != nil {
+		return video_archiver.Permanent(fmt.Errorf("%w: %v: invalid result from %v(): %v", ErrScript, s.Name, function, err))
+	}
+	return nil
+}
+
+// wrapError turns an error from the runtime into a permanent error, unless it's a timeout or the thrown value is
+// marked as transient.
+func (s *Script) wrapError(err error) error {
+	var interrupted *goja.InterruptedError
+	var exception *goja.Exception
+	switch {
+	case errors.As(err, &interrupted):
+		cause, _ := interrupted.Value().(error)
+		switch {
+		case errors.Is(cause, ErrTimeout):
+			return video_archiver.Transient(fmt.Errorf("%v: %w", s.Name, cause))
+		case cause != nil:
+			return video_archiver.Permanent(fmt.Errorf("%v: %w", s.Name, cause))
+		}
+	case errors.As(err, &exception):
+		err = fmt.Errorf("%w: %v", ErrScript, exception.Error())
+		if obj, ok := exception.Value().(*goja.Object); ok {
+			if transient := obj.Get("transient"); transient != nil && transient.ToBoolean() {
+				return video_archiver.Transient(err)
+			}
+		}
+		return video_archiver.Permanent(err)
+	}
+	return video_archiver.Permanent(fmt.Errorf("%w: %v", ErrScript, err))
+}
+
+type source struct {
+	script *Script
+	url    string
+}
+
+func (s *source) URL() string {
+	return s.url
+}
+
+func (s *source) String() string {
+	return s.URL()
+}
+
+// A reconResult is what a script's recon() returns.
+type reconResult struct {
+	Name      string            `json:"name"`
+	Metadata  map[string]string `json:"metadata"`
+	Downloads []struct {
+		URL      string            `json:"url"`
+		Filename string            `json:"filename"`
+		Headers  map[string]string `json:"headers"`
+	} `json:"downloads"`
+}
+
+func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	result := &reconResult{}
+	if err := s.script.call(ctx, "recon", s.url, result); err != nil {
+		return nil, err
+	}
+	if len(result.Downloads) == 0 {
+		return nil, video_archiver.Permanent(fmt.Errorf("%w: %v: nothing to download", ErrScript, s.script.Name))
+	}
+	for i, download := range result.Downloads {
+		filename := download.Filename
+		if filename == "" {
+			u, err := url.Parse(download.URL)
+			if err != nil {
+				return nil, video_archiver.Permanent(fmt.Errorf("%w: %v: %v", ErrScript, s.script.Name, err))
+			}
+			if filename, err = util.FilenameFromURL(u); err != nil {
+				return nil, video_archiver.Permanent(fmt.Errorf("%w: %v: %v", ErrScript, s.script.Name, err))
+			}
+		}
+		if filename != filepath.Base(filename) || filename == "." || filename == ".." {
+			return nil, video_archiver.Permanent(fmt.Errorf("%w: %v: invalid filename %#v", ErrScript, s.script.Name, filename))
+		}
+		result.Downloads[i].Filename = filename
+	}
+	return &resolvedSource{source: *s, result: result}, nil
+}
+
+type resolvedSource struct {
+	source
+	result *reconResult
+}
+
+func (s *resolvedSource) String() string {
+	if s.result.Name != "" {
+		return s.result.Name
+	}
+	return s.URL()
+}
+
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := make(map[string]string, len(s.result.Metadata))
+	for key, value := range s.result.Metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+func (s *resolvedSource) Download(d video_archiver.Download) error {
+	for _, download := range s.result.Downloads {
+		req, err := http.NewRequest(http.MethodGet, download.URL, nil)
+		if err != nil {
+			return video_archiver.Permanent(err)
+		}
+		for name, value := range download.Headers {
+			req.Header.Set(name, value)
+		}
+		if err := d.SaveHTTPRequest(download.Filename, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
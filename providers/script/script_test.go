@@ -0,0 +1,139 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func newTestServer() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/abc" && r.Header.Get("X-Token") == "secret":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"title": "Example video", "quality": "720p", "src": "%v/media/abc", "thumbnail": "%v/media/abc.jpg"}`, server.URL, server.URL)
+		case r.URL.Path == "/api/large":
+			_, _ = w.Write([]byte(strings.Repeat("x", 4096)))
+		case r.URL.Path == "/media/abc" && r.Header.Get("Referer") == "https://videos.example.com/abc":
+			_, _ = w.Write([]byte("example video"))
+		case r.URL.Path == "/media/abc.jpg":
+			_, _ = w.Write([]byte("example thumbnail"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server
+}
+
+func download(t *testing.T, ctx context.Context, source video_archiver.Source) (string, video_archiver.ResolvedSource, error) {
+	resolved, err := source.Recon(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := t.TempDir()
+	d := generic.Unwrap(video_archiver.NewDownloadBuilder().
+		WithContext(ctx).
+		WithTargetPrefix(dir + string(os.PathSeparator)).
+		WithTempPath(t.TempDir()).
+		Build())
+	defer d.Close()
+	if err := resolved.Download(d); err != nil {
+		return "", resolved, err
+	}
+	generic.Unwrap_(d.Commit())
+	return dir, resolved, nil
+}
+
+func TestScript(t *testing.T) {
+	assert := assert_.New(t)
+	server := newTestServer()
+	defer server.Close()
+	ctx := video_archiver.WithOptions(context.Background(), video_archiver.Options{"test.server": server.URL})
+
+	registry := &video_archiver.ProviderRegistry{}
+	if !assert.NoError(RegisterDir(registry, "testdata/scripts")) {
+		return
+	}
+	assert.Equal([]string{"escape", "example"}, registry.List())
+	_, err := registry.MatchWith("example", "https://elsewhere.example.com/abc")
+	assert.Error(err)
+
+	// Script fetches information, and its downloads are saved, with a filename from the URL if it doesn't give one
+	match := generic.Unwrap(registry.Match("https://videos.example.com/abc"))
+	assert.Equal("example", match.ProviderName)
+	dir, resolved, err := download(t, ctx, match.Source)
+	if assert.NoError(err) {
+		assert.Equal("Example video", resolved.String())
+		assert.Equal(map[string]string{"example.quality": "720p"}, resolved.(video_archiver.MetadataSource).Metadata())
+		assert.Equal("example video", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "abc.mp4")))))
+		assert.Equal("example thumbnail", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "abc.jpg")))))
+	}
+
+	// Errors thrown by the script are permanent, unless marked as transient
+	_, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/missing")).Source)
+	if assert.ErrorIs(err, ErrScript) {
+		assert.Contains(err.Error(), "no such video")
+		assert.False(video_archiver.IsTransient(err))
+	}
+	_, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/unavailable")).Source)
+	assert.ErrorIs(err, ErrScript)
+	assert.True(video_archiver.IsTransient(err))
+	_, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://videos.example.com/other")).Source)
+	if assert.ErrorIs(err, ErrScript) {
+		assert.Contains(err.Error(), "api returned 404")
+	}
+	_, _, err = download(t, ctx, generic.Unwrap(registry.Match("https://escape.example.com/abc")).Source)
+	assert.ErrorIs(err, ErrScript)
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert_.New(t)
+	server := newTestServer()
+	defer server.Close()
+	ctx := video_archiver.WithOptions(context.Background(), video_archiver.Options{"test.server": server.URL})
+
+	s := generic.Unwrap(Load("testdata/scripts/example.js"))
+	s.Limits.Timeout = 100 * time.Millisecond
+	source := generic.Unwrap(s.Match("https://videos.example.com/forever"))
+	_, err := source.Recon(ctx)
+	assert.ErrorIs(err, ErrTimeout)
+	assert.True(video_archiver.IsTransient(err))
+
+	// Responses count towards the memory budget
+	s.Limits.MemoryBudget = 1024
+	source = generic.Unwrap(s.Match("https://videos.example.com/large"))
+	_, err = source.Recon(ctx)
+	assert.ErrorIs(err, ErrMemoryBudget)
+	assert.False(video_archiver.IsTransient(err))
+}
+
+func TestLoad(t *testing.T) {
+	assert := assert_.New(t)
+	s, err := Load("testdata/scripts/example.js")
+	if assert.NoError(err) {
+		assert.Equal("example", s.Name)
+		assert.Equal(int16(10), s.Priority)
+		assert.Equal("Videos from example.com", s.Description)
+		assert.Equal([]string{"videos.example.com"}, s.Hosts)
+		assert.Equal(video_archiver.CapabilityVideo|video_archiver.CapabilityMetadata, s.Capabilities)
+	}
+	registry := &video_archiver.ProviderRegistry{}
+	if assert.NoError(RegisterDir(registry, "testdata/scripts")) {
+		assert.Empty(registry.CheckExamples())
+	}
+	_, err = Load("testdata/broken/norecon.js")
+	assert.ErrorIs(err, ErrScript)
+	assert.Error(RegisterDir(&video_archiver.ProviderRegistry{}, "testdata/broken"))
+}
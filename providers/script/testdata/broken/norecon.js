@@ -0,0 +1,3 @@
+function match(url) {
+	return true;
+}
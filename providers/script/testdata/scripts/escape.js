@@ -0,0 +1,7 @@
+function match(url) {
+	return url.startsWith("https://escape.example.com/");
+}
+
+function recon(url) {
+	return {downloads: [{url: "https://escape.example.com/video.mp4", filename: "../video.mp4"}]};
+}
@@ -0,0 +1,33 @@
+var priority = 10;
+var description = "Videos from example.com";
+var hosts = ["videos.example.com"];
+var examples = ["https://videos.example.com/1", "https://videos.example.com/missing"];
+var capabilities = ["video", "metadata"];
+
+function match(url) {
+	return url.startsWith("https://videos.example.com/");
+}
+
+function recon(url) {
+	var id = url.split("/").pop();
+	if (id === "unavailable") {
+		throw {message: "try again later", transient: true};
+	} else if (id === "missing") {
+		throw new Error("no such video");
+	} else if (id === "forever") {
+		for (;;) {}
+	}
+	var response = fetch(options["test.server"] + "/api/" + id, {headers: {"X-Token": "secret"}});
+	if (response.status !== 200) {
+		throw new Error("api returned " + response.status);
+	}
+	var video = response.json();
+	return {
+		name: video.title,
+		metadata: {"example.quality": video.quality},
+		downloads: [
+			{url: video.src, filename: id + ".mp4", headers: {"Referer": url}},
+			{url: video.thumbnail},
+		],
+	};
+}
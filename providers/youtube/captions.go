@@ -0,0 +1,164 @@
+package youtube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+	"github.com/alanbriolat/video-archiver/internal/captions"
+)
+
+// Caption options understood by the youtube provider.
+const (
+	// Caption languages to download, e.g. "en,fr", or "all" for every language with manual captions. Defaults to
+	// video_archiver.OptionCaptions, and no captions are downloaded if neither is set.
+	OptionCaptions = "youtube.captions"
+	// Use auto-generated captions for languages without manual captions, "true" or "false".
+	OptionAutoCaptions = "youtube.auto-captions"
+	// Caption file formats, "srt" (the default), "vtt" or "srt,vtt".
+	OptionCaptionFormats = "youtube.caption-formats"
+)
+
+// A CaptionPolicy chooses which caption tracks of a video to download, and in which formats. The zero value downloads
+// no captions.
+type CaptionPolicy struct {
+	Languages []string
+	Auto      bool
+	Formats   []string
+}
+
+// CaptionPolicyFromOptions creates a CaptionPolicy from provider options (see OptionCaptions etc.).
+func CaptionPolicyFromOptions(options video_archiver.Options) (p CaptionPolicy, err error) {
+	p.Languages = options.List(OptionCaptions)
+	if len(p.Languages) == 0 {
+		p.Languages = options.List(video_archiver.OptionCaptions)
+	}
+	if p.Auto, err = options.Bool(OptionAutoCaptions); err != nil {
+		return p, err
+	}
+	p.Formats = options.List(OptionCaptionFormats)
+	if len(p.Formats) == 0 {
+		p.Formats = []string{"srt"}
+	}
+	for i, format := range p.Formats {
+		p.Formats[i] = strings.ToLower(format)
+		if p.Formats[i] != "srt" && p.Formats[i] != "vtt" {
+			return p, fmt.Errorf("invalid value for %v: unsupported format %#v", OptionCaptionFormats, format)
+		}
+	}
+	return p, nil
+}
+
+// A captionTrack is an available caption track, from the "captionTracks" in the video page's player response.
+type captionTrack struct {
+	BaseURL      string `json:"baseUrl"`
+	LanguageCode string `json:"languageCode"`
+	// "asr" for auto-generated captions
+	Kind string `json:"kind"`
+}
+
+func (t captionTrack) isAuto() bool {
+	return t.Kind == "asr"
+}
+
+// Select chooses a caption track for each language, preferring manual captions to auto-generated ones.
+func (p CaptionPolicy) Select(tracks []captionTrack) []captionTrack {
+	languages := p.Languages
+	if len(languages) == 1 && strings.ToLower(languages[0]) == "all" {
+		languages = nil
+		seen := generic.NewSet[string]()
+		for _, t := range tracks {
+			if !t.isAuto() && seen.Add(t.LanguageCode) {
+				languages = append(languages, t.LanguageCode)
+			}
+		}
+	}
+	var selected []captionTrack
+	for _, language := range languages {
+		var auto *captionTrack
+		found := false
+		for i, t := range tracks {
+			if !strings.EqualFold(t.LanguageCode, language) {
+				continue
+			} else if !t.isAuto() {
+				selected = append(selected, t)
+				found = true
+				break
+			} else if p.Auto && auto == nil {
+				auto = &tracks[i]
+			}
+		}
+		if !found && auto != nil {
+			selected = append(selected, *auto)
+		}
+	}
+	return selected
+}
+
+// extractCaptionTracks finds the JSON list of caption tracks in the video page, returning nil if there isn't one.
+func extractCaptionTracks(page []byte) ([]captionTrack, error) {
+	marker := []byte(`"captionTracks":`)
+	i := bytes.Index(page, marker)
+	if i < 0 {
+		return nil, nil
+	}
+	var tracks []captionTrack
+	if err := json.NewDecoder(bytes.NewReader(page[i+len(marker):])).Decode(&tracks); err != nil {
+		return nil, fmt.Errorf("invalid caption tracks: %w", err)
+	}
+	return tracks, nil
+}
+
+// downloadCaptions fetches each caption track as timed-text XML, and saves it in each of the formats.
+func (s *resolvedSource) downloadCaptions(d video_archiver.Download) error {
+	base := strings.TrimSuffix(s.getFilename(), "."+s.getExtension())
+	for _, track := range s.captions {
+		req, err := http.NewRequestWithContext(d.Context(), http.MethodGet, track.BaseURL, nil)
+		if err != nil {
+			return err
+		}
+		data := &bytes.Buffer{}
+		if err := d.AppendHTTPRequest(data, req); err != nil {
+			return fmt.Errorf("failed to get %v captions: %w", track.LanguageCode, err)
+		}
+		cues, err := captions.ParseTimedText(data)
+		if err != nil {
+			return video_archiver.Permanent(fmt.Errorf("failed to parse %v captions: %w", track.LanguageCode, err))
+		}
+		for _, format := range s.captionFormats {
+			if err := s.saveCaptions(d, fmt.Sprintf("%s.%s.%s", base, track.LanguageCode, format), format, cues); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *resolvedSource) saveCaptions(d video_archiver.Download, filename string, format string, cues []captions.Cue) error {
+	f, err := d.CreateFile(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := captions.Write(f, format, cues); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// captionsMetadata describes the chosen caption tracks, e.g. "en, fr (auto-generated)".
+func captionsMetadata(tracks []captionTrack) string {
+	var languages []string
+	for _, t := range tracks {
+		if t.isAuto() {
+			languages = append(languages, t.LanguageCode+" (auto-generated)")
+		} else {
+			languages = append(languages, t.LanguageCode)
+		}
+	}
+	return strings.Join(languages, ", ")
+}
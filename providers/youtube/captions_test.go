@@ -0,0 +1,68 @@
+package youtube
+
+import (
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+var testCaptionTracks = []captionTrack{
+	{BaseURL: "https://example.com/en-asr", LanguageCode: "en", Kind: "asr"},
+	{BaseURL: "https://example.com/en", LanguageCode: "en"},
+	{BaseURL: "https://example.com/fr", LanguageCode: "fr"},
+	{BaseURL: "https://example.com/de-asr", LanguageCode: "de", Kind: "asr"},
+}
+
+func TestCaptionPolicySelect(t *testing.T) {
+	cases := []struct {
+		name    string
+		options video_archiver.Options
+		urls    []string
+	}{
+		{"no captions by default", nil, nil},
+		{"manual preferred", video_archiver.Options{OptionCaptions: "en,de", OptionAutoCaptions: "true"}, []string{"https://example.com/en", "https://example.com/de-asr"}},
+		{"manual only", video_archiver.Options{OptionCaptions: "EN,de"}, []string{"https://example.com/en"}},
+		{"all manual", video_archiver.Options{OptionCaptions: "all"}, []string{"https://example.com/en", "https://example.com/fr"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert_.New(t)
+			policy := generic.Unwrap(CaptionPolicyFromOptions(c.options))
+			var urls []string
+			for _, track := range policy.Select(testCaptionTracks) {
+				urls = append(urls, track.BaseURL)
+			}
+			assert.Equal(c.urls, urls)
+		})
+	}
+}
+
+func TestCaptionPolicyFromOptions(t *testing.T) {
+	assert := assert_.New(t)
+	assert.Equal([]string{"srt"}, generic.Unwrap(CaptionPolicyFromOptions(nil)).Formats)
+	assert.Nil(generic.Unwrap(CaptionPolicyFromOptions(nil)).Languages)
+	assert.Equal([]string{"en", "fr"}, generic.Unwrap(CaptionPolicyFromOptions(video_archiver.Options{video_archiver.OptionCaptions: "en,fr"})).Languages)
+	assert.Equal([]string{"de"}, generic.Unwrap(CaptionPolicyFromOptions(video_archiver.Options{video_archiver.OptionCaptions: "en", OptionCaptions: "de"})).Languages)
+	assert.Equal([]string{"srt", "vtt"}, generic.Unwrap(CaptionPolicyFromOptions(video_archiver.Options{OptionCaptionFormats: "SRT, vtt"})).Formats)
+	_, err := CaptionPolicyFromOptions(video_archiver.Options{OptionCaptionFormats: "ass"})
+	assert.Error(err)
+	_, err = CaptionPolicyFromOptions(video_archiver.Options{OptionAutoCaptions: "maybe"})
+	assert.Error(err)
+}
+
+func TestExtractCaptionTracks(t *testing.T) {
+	assert := assert_.New(t)
+	page := []byte(`<script>var ytInitialPlayerResponse = {"captions":{"playerCaptionsTracklistRenderer":{"captionTracks":[` +
+		`{"baseUrl":"https://www.youtube.com/api/timedtext?v=x&lang=en","name":{"simpleText":"English"},"languageCode":"en","isTranslatable":true},` +
+		`{"baseUrl":"https://www.youtube.com/api/timedtext?v=x&kind=asr&lang=en","languageCode":"en","kind":"asr"}` +
+		`],"audioTracks":[]}}};</script>`)
+	assert.Equal([]captionTrack{
+		{BaseURL: "https://www.youtube.com/api/timedtext?v=x&lang=en", LanguageCode: "en"},
+		{BaseURL: "https://www.youtube.com/api/timedtext?v=x&kind=asr&lang=en", LanguageCode: "en", Kind: "asr"},
+	}, generic.Unwrap(extractCaptionTracks(page)))
+	assert.Nil(generic.Unwrap(extractCaptionTracks([]byte(`<html>no captions</html>`))))
+	assert.Equal("en, de (auto-generated)", captionsMetadata([]captionTrack{testCaptionTracks[1], testCaptionTracks[3]}))
+}
@@ -0,0 +1,265 @@
+package youtube
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kkdai/youtube/v2"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+// Options understood by the youtube provider.
+const (
+	// Maximum video height, e.g. "720".
+	OptionMaxHeight = "youtube.max-height"
+	// Preferred container, "mp4" or "webm".
+	OptionContainer = "youtube.container"
+	// Preferred codecs, most preferred first, e.g. "avc1,vp9". Matched against the start of each codec name.
+	OptionCodecs = "youtube.codecs"
+	// Download only audio, "true" or "false".
+	OptionAudioOnly = "youtube.audio-only"
+	// Maximum file size, e.g. "500M". Formats of unknown size are allowed.
+	OptionMaxSize = "youtube.max-size"
+	// Only use formats that have both video and audio, "true" or "false". Otherwise separate video and audio streams
+	// are used (and muxed together) if that gives better quality.
+	OptionMuxedOnly = "youtube.muxed-only"
+)
+
+var ErrNoFormat = errors.New("no format matches the format policy")
+
+// A FormatPolicy chooses which of the available formats of a video to download. The zero value chooses the best
+// overall quality.
+type FormatPolicy struct {
+	MaxHeight int
+	Container string
+	Codecs    []string
+	AudioOnly bool
+	MaxSize   int64
+	MuxedOnly bool
+}
+
+// FormatPolicyFromOptions creates a FormatPolicy from provider options (see OptionMaxHeight etc.).
+func FormatPolicyFromOptions(options video_archiver.Options) (p FormatPolicy, err error) {
+	if p.MaxHeight, err = options.Int(OptionMaxHeight); err != nil {
+		return p, err
+	}
+	p.Container = strings.ToLower(options.Get(OptionContainer))
+	p.Codecs = options.List(OptionCodecs)
+	if p.AudioOnly, err = options.Bool(OptionAudioOnly); err != nil {
+		return p, err
+	}
+	if p.MaxSize, err = util.ParseSize(options.Get(OptionMaxSize)); err != nil {
+		return p, fmt.Errorf("invalid value for %v: %w", OptionMaxSize, err)
+	}
+	if p.MuxedOnly, err = options.Bool(OptionMuxedOnly); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// Choose returns the formats to download: a single format with both video and audio (or just audio if AudioOnly), or
+// separate video and audio formats in the same container if that gives a higher resolution. YouTube only offers
+// resolutions above 720p as separate streams.
+func (p FormatPolicy) Choose(formats youtube.FormatList) ([]*youtube.Format, error) {
+	muxed, err := p.Select(formats)
+	if p.AudioOnly || p.MuxedOnly {
+		if err != nil {
+			return nil, err
+		}
+		return []*youtube.Format{muxed}, nil
+	}
+	if video, audio, adaptiveErr := p.selectAdaptive(formats); adaptiveErr == nil && (err != nil || video.Height > muxed.Height) {
+		return []*youtube.Format{video, audio}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []*youtube.Format{muxed}, nil
+}
+
+// Select chooses the best format that satisfies the policy. Formats are ranked by height (or audio bitrate for
+// audio-only), then preferred container, then preferred codec, then frame rate, then bitrate.
+func (p FormatPolicy) Select(formats youtube.FormatList) (*youtube.Format, error) {
+	var candidates []*youtube.Format
+	for i := range formats {
+		if f := &formats[i]; p.allows(f) {
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoFormat
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return p.better(candidates[i], candidates[j])
+	})
+	return candidates[0], nil
+}
+
+// selectAdaptive chooses the best video-only format, and the best audio-only format in the same container (see
+// isUsualAudio), whose combined size is within the size limit.
+func (p FormatPolicy) selectAdaptive(formats youtube.FormatList) (*youtube.Format, *youtube.Format, error) {
+	var videos []*youtube.Format
+	audios := make(map[string][]*youtube.Format)
+	for i := range formats {
+		f := &formats[i]
+		if container := formatContainer(f); !muxableContainers[container] {
+			continue
+		} else if strings.HasPrefix(f.MimeType, "audio/") && isUsualAudio(container, f) {
+			audios[container] = append(audios[container], f)
+		} else if strings.HasPrefix(f.MimeType, "video/") && f.AudioChannels == 0 && (p.MaxHeight <= 0 || f.Height <= p.MaxHeight) {
+			videos = append(videos, f)
+		}
+	}
+	sort.SliceStable(videos, func(i, j int) bool {
+		return p.better(videos[i], videos[j])
+	})
+	for _, candidates := range audios {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Bitrate > candidates[j].Bitrate
+		})
+	}
+	for _, video := range videos {
+		for _, audio := range audios[formatContainer(video)] {
+			if p.MaxSize > 0 && video.ContentLength+audio.ContentLength > p.MaxSize {
+				continue
+			}
+			return video, audio, nil
+		}
+	}
+	return nil, nil, ErrNoFormat
+}
+
+// Containers that separate video and audio streams can be muxed into (see internal/mux).
+var muxableContainers = map[string]bool{"mp4": true, "webm": true}
+
+// Audio codecs (by prefix) to mux into each container. Other audio in the same container (e.g. "ec-3" in MP4) is
+// skipped, because it's not what players expect to find there.
+var audioCodecs = map[string][]string{"mp4": {"mp4a"}, "webm": {"opus", "vorbis"}}
+
+// isUsualAudio returns true if all the format's codecs are in audioCodecs for the container, or it doesn't say what
+// its codecs are.
+func isUsualAudio(container string, f *youtube.Format) bool {
+	for _, codec := range formatCodecs(f) {
+		usual := false
+		for _, prefix := range audioCodecs[container] {
+			usual = usual || strings.HasPrefix(codec, prefix)
+		}
+		if !usual {
+			return false
+		}
+	}
+	return true
+}
+
+func (p FormatPolicy) allows(f *youtube.Format) bool {
+	if p.AudioOnly {
+		if !strings.HasPrefix(f.MimeType, "audio/") {
+			return false
+		}
+	} else if !strings.HasPrefix(f.MimeType, "video/") || f.AudioChannels == 0 {
+		// Only formats with both video and audio
+		return false
+	}
+	if p.MaxHeight > 0 && f.Height > p.MaxHeight {
+		return false
+	}
+	if p.MaxSize > 0 && f.ContentLength > p.MaxSize {
+		return false
+	}
+	return true
+}
+
+// better returns true if a should be chosen in preference to b.
+func (p FormatPolicy) better(a, b *youtube.Format) bool {
+	if a.Height != b.Height {
+		return a.Height > b.Height
+	}
+	if aRank, bRank := p.containerRank(a), p.containerRank(b); aRank != bRank {
+		return aRank < bRank
+	}
+	if aRank, bRank := p.codecRank(a), p.codecRank(b); aRank != bRank {
+		return aRank < bRank
+	}
+	if a.FPS != b.FPS {
+		return a.FPS > b.FPS
+	}
+	return a.Bitrate > b.Bitrate
+}
+
+func (p FormatPolicy) containerRank(f *youtube.Format) int {
+	if p.Container == "" || formatContainer(f) == p.Container {
+		return 0
+	}
+	return 1
+}
+
+// codecRank returns the position of the first of the format's codecs in the preferred codecs, or len(p.Codecs) if
+// none of them are preferred.
+func (p FormatPolicy) codecRank(f *youtube.Format) int {
+	best := len(p.Codecs)
+	for _, codec := range formatCodecs(f) {
+		for i, preferred := range p.Codecs {
+			if i < best && strings.HasPrefix(codec, strings.ToLower(preferred)) {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// formatContainer gets the container from the MIME type, e.g. "mp4" from `video/mp4; codecs="avc1.42001E, mp4a.40.2"`.
+func formatContainer(f *youtube.Format) string {
+	mimeType := strings.TrimSpace(strings.SplitN(f.MimeType, ";", 2)[0])
+	if _, subtype, ok := strings.Cut(mimeType, "/"); ok {
+		return strings.ToLower(subtype)
+	}
+	return ""
+}
+
+// formatCodecs gets the codecs from the MIME type, e.g. ["avc1.42001e", "mp4a.40.2"].
+func formatCodecs(f *youtube.Format) []string {
+	_, params, _ := strings.Cut(f.MimeType, ";")
+	_, codecs, ok := strings.Cut(params, "codecs=")
+	if !ok {
+		return nil
+	}
+	var result []string
+	for _, codec := range strings.Split(strings.Trim(strings.TrimSpace(codecs), `"`), ",") {
+		result = append(result, strings.ToLower(strings.TrimSpace(codec)))
+	}
+	return result
+}
+
+// formatMetadata describes the chosen formats, for recording in the download state.
+func formatMetadata(formats ...*youtube.Format) map[string]string {
+	var itags, mimeTypes []string
+	var bitrate int
+	var size int64
+	metadata := make(map[string]string)
+	for _, f := range formats {
+		itags = append(itags, fmt.Sprint(f.ItagNo))
+		mimeTypes = append(mimeTypes, f.MimeType)
+		bitrate += f.Bitrate
+		if size >= 0 && f.ContentLength > 0 {
+			size += f.ContentLength
+		} else {
+			size = -1
+		}
+		if f.Width > 0 && f.Height > 0 {
+			metadata["format.resolution"] = fmt.Sprintf("%dx%d", f.Width, f.Height)
+		}
+		if f.FPS > 0 {
+			metadata["format.fps"] = fmt.Sprint(f.FPS)
+		}
+	}
+	metadata["format.itag"] = strings.Join(itags, "+")
+	metadata["format.mime"] = strings.Join(mimeTypes, " + ")
+	metadata["format.bitrate"] = fmt.Sprint(bitrate)
+	if size > 0 {
+		metadata["format.size"] = fmt.Sprint(size)
+	}
+	return metadata
+}
@@ -0,0 +1,133 @@
+package youtube
+
+import (
+	"testing"
+
+	"github.com/kkdai/youtube/v2"
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+var testFormats = youtube.FormatList{
+	{ItagNo: 18, MimeType: `video/mp4; codecs="avc1.42001E, mp4a.40.2"`, Width: 640, Height: 360, FPS: 30, Bitrate: 500000, AudioChannels: 2, ContentLength: 20000000},
+	{ItagNo: 22, MimeType: `video/mp4; codecs="avc1.64001F, mp4a.40.2"`, Width: 1280, Height: 720, FPS: 30, Bitrate: 1500000, AudioChannels: 2},
+	{ItagNo: 43, MimeType: `video/webm; codecs="vp8.0, vorbis"`, Width: 640, Height: 360, FPS: 30, Bitrate: 600000, AudioChannels: 2, ContentLength: 25000000},
+	{ItagNo: 137, MimeType: `video/mp4; codecs="avc1.640028"`, Width: 1920, Height: 1080, FPS: 30, Bitrate: 4000000},
+	{ItagNo: 248, MimeType: `video/webm; codecs="vp9"`, Width: 1920, Height: 1080, FPS: 30, Bitrate: 3000000, ContentLength: 90000000},
+	{ItagNo: 140, MimeType: `audio/mp4; codecs="mp4a.40.2"`, Bitrate: 130000, AudioChannels: 2, ContentLength: 3000000},
+	{ItagNo: 251, MimeType: `audio/webm; codecs="opus"`, Bitrate: 160000, AudioChannels: 2, ContentLength: 3500000},
+	{ItagNo: 249, MimeType: `audio/webm; codecs="opus"`, Bitrate: 50000, AudioChannels: 2, ContentLength: 1000000},
+}
+
+func TestFormatPolicySelect(t *testing.T) {
+	cases := []struct {
+		name    string
+		options video_archiver.Options
+		itag    int
+	}{
+		{"best overall", nil, 22},
+		{"max height", video_archiver.Options{OptionMaxHeight: "480"}, 43},
+		{"preferred container", video_archiver.Options{OptionMaxHeight: "480", OptionContainer: "mp4"}, 18},
+		{"preferred codec", video_archiver.Options{OptionMaxHeight: "480", OptionCodecs: "avc1"}, 18},
+		{"codec preference order", video_archiver.Options{OptionMaxHeight: "480", OptionCodecs: "vp8, avc1"}, 43},
+		{"container beats codec", video_archiver.Options{OptionMaxHeight: "480", OptionContainer: "webm", OptionCodecs: "avc1"}, 43},
+		{"size cap", video_archiver.Options{OptionMaxHeight: "480", OptionMaxSize: "22M"}, 18},
+		{"unknown size is allowed", video_archiver.Options{OptionMaxSize: "1M"}, 22},
+		{"audio only", video_archiver.Options{OptionAudioOnly: "true"}, 251},
+		{"audio only container", video_archiver.Options{OptionAudioOnly: "true", OptionContainer: "mp4"}, 140},
+		{"audio only size cap", video_archiver.Options{OptionAudioOnly: "true", OptionMaxSize: "2M"}, 249},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert_.New(t)
+			policy := generic.Unwrap(FormatPolicyFromOptions(c.options))
+			format, err := policy.Select(testFormats)
+			if assert.NoError(err) {
+				assert.Equal(c.itag, format.ItagNo)
+			}
+		})
+	}
+}
+
+func TestFormatPolicyChoose(t *testing.T) {
+	cases := []struct {
+		name    string
+		options video_archiver.Options
+		itags   []int
+	}{
+		{"separate streams for higher resolution", nil, []int{137, 140}},
+		{"muxed only", video_archiver.Options{OptionMuxedOnly: "true"}, []int{22}},
+		{"max height allows muxed", video_archiver.Options{OptionMaxHeight: "720"}, []int{22}},
+		{"audio in same container", video_archiver.Options{OptionContainer: "webm"}, []int{248, 251}},
+		{"combined size cap", video_archiver.Options{OptionContainer: "webm", OptionMaxSize: "88M"}, []int{248, 249}},
+		{"no audio within size cap", video_archiver.Options{OptionMaxSize: "1M"}, []int{22}},
+		{"audio only", video_archiver.Options{OptionAudioOnly: "true"}, []int{251}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert_.New(t)
+			policy := generic.Unwrap(FormatPolicyFromOptions(c.options))
+			formats, err := policy.Choose(testFormats)
+			if assert.NoError(err) {
+				var itags []int
+				for _, f := range formats {
+					itags = append(itags, f.ItagNo)
+				}
+				assert.Equal(c.itags, itags)
+			}
+		})
+	}
+
+	// Audio is only paired with video in the same container, and with a codec that's usual in it, even if other audio
+	// has a higher bitrate
+	assert := assert_.New(t)
+	formats := append(youtube.FormatList{
+		{ItagNo: 328, MimeType: `audio/mp4; codecs="ec-3"`, Bitrate: 384000, AudioChannels: 6, ContentLength: 9000000},
+	}, testFormats...)
+	chosen, err := FormatPolicy{}.Choose(formats)
+	if assert.NoError(err) && assert.Len(chosen, 2) {
+		assert.Equal(137, chosen[0].ItagNo)
+		assert.Equal(140, chosen[1].ItagNo)
+	}
+}
+
+func TestFormatPolicyErrors(t *testing.T) {
+	assert := assert_.New(t)
+
+	_, err := FormatPolicy{MaxHeight: 240}.Select(testFormats)
+	assert.ErrorIs(err, ErrNoFormat)
+	_, err = FormatPolicy{}.Select(nil)
+	assert.ErrorIs(err, ErrNoFormat)
+
+	for _, options := range []video_archiver.Options{
+		{OptionMaxHeight: "tall"},
+		{OptionAudioOnly: "maybe"},
+		{OptionMaxSize: "big"},
+	} {
+		_, err := FormatPolicyFromOptions(options)
+		assert.Error(err, "options: %v", options)
+	}
+}
+
+func TestFormatMetadata(t *testing.T) {
+	assert := assert_.New(t)
+	assert.Equal(map[string]string{
+		"format.itag":       "18",
+		"format.mime":       `video/mp4; codecs="avc1.42001E, mp4a.40.2"`,
+		"format.bitrate":    "500000",
+		"format.resolution": "640x360",
+		"format.fps":        "30",
+		"format.size":       "20000000",
+	}, formatMetadata(&testFormats[0]))
+	assert.Equal(map[string]string{
+		"format.itag":       "137+140",
+		"format.mime":       `video/mp4; codecs="avc1.640028" + audio/mp4; codecs="mp4a.40.2"`,
+		"format.bitrate":    "4130000",
+		"format.resolution": "1920x1080",
+		"format.fps":        "30",
+	}, formatMetadata(&testFormats[3], &testFormats[5]))
+	assert.Equal([]string{"avc1.42001e", "mp4a.40.2"}, formatCodecs(&testFormats[0]))
+	assert.Equal("webm", formatContainer(&testFormats[6]))
+}
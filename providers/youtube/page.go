@@ -0,0 +1,45 @@
+package youtube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+// getVideoPage gets the video's page, for the details the YouTube client doesn't expose (see extractCaptionTracks and
+// extractKeywords).
+func getVideoPage(ctx context.Context, client *http.Client, videoURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, videoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, video_archiver.NewHTTPError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// extractKeywords finds the video's tags in the video page, returning nil if there aren't any. Tags are only
+// informational, so if they can't be read it's the same as there being none.
+func extractKeywords(page []byte) []string {
+	i := bytes.Index(page, []byte(`"videoDetails":`))
+	if i < 0 {
+		return nil
+	}
+	var videoDetails struct {
+		Keywords []string `json:"keywords"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(page[i+len(`"videoDetails":`):])).Decode(&videoDetails); err != nil {
+		return nil
+	}
+	return videoDetails.Keywords
+}
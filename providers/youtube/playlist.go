@@ -0,0 +1,96 @@
+package youtube
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/kkdai/youtube/v2"
+
+	"github.com/alanbriolat/video-archiver"
+)
+
+type playlistSource struct {
+	playlistID string
+}
+
+func (s *playlistSource) URL() string {
+	return fmt.Sprintf("https://www.youtube.com/playlist?list=%s", s.playlistID)
+}
+
+func (s *playlistSource) String() string {
+	return s.URL()
+}
+
+func (s *playlistSource) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
+	client := youtube.Client{HTTPClient: video_archiver.HTTPClientFromContext(ctx)}
+	playlist, err := client.GetPlaylistContext(ctx, s.URL())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlist info: %w", classifyError(err))
+	}
+	return &resolvedPlaylistSource{
+		playlistSource: *s,
+		playlist:       playlist,
+	}, nil
+}
+
+type resolvedPlaylistSource struct {
+	playlistSource
+	playlist *youtube.Playlist
+}
+
+func (s *resolvedPlaylistSource) Download(video_archiver.Download) error {
+	// Nothing to download, each video is downloaded separately
+	return nil
+}
+
+func (s *resolvedPlaylistSource) Children() []video_archiver.Source {
+	children := make([]video_archiver.Source, 0, len(s.playlist.Videos))
+	for _, entry := range s.playlist.Videos {
+		children = append(children, &source{videoID: entry.ID})
+	}
+	return children
+}
+
+func (s *resolvedPlaylistSource) String() string {
+	return fmt.Sprintf("%s [%s]", s.playlist.Title, s.playlist.ID)
+}
+
+func (s *resolvedPlaylistSource) Metadata() map[string]string {
+	return map[string]string{
+		"playlist.author": s.playlist.Author,
+		"playlist.videos": fmt.Sprint(len(s.playlist.Videos)),
+	}
+}
+
+// Extract playlist ID from YouTube URL. A channel's uploads are a playlist with the same ID but "UU" in place of "UC".
+//
+// Allowed URL formats:
+//		http(s?)://(www|m).youtube.com/playlist?list={PLAYLIST_ID}
+//		http(s?)://(www|m).youtube.com/channel/UC{CHANNEL_ID}(/...)
+func extractPlaylistID(url *url.URL) (string, error) {
+	var id string
+	switch url.Hostname() {
+	case "www.youtube.com", "m.youtube.com":
+		if url.Path == "/playlist" {
+			if url.Query().Has("list") {
+				id = url.Query().Get("list")
+			} else {
+				return "", fmt.Errorf("missing ?list= query parameter")
+			}
+		} else if strings.HasPrefix(url.Path, "/channel/") {
+			channelID := strings.SplitN(url.Path, "/", 4)[2]
+			if !strings.HasPrefix(channelID, "UC") {
+				return "", fmt.Errorf("unrecognised channel ID")
+			}
+			id = "UU" + strings.TrimPrefix(channelID, "UC")
+		}
+	default:
+		return "", fmt.Errorf("unrecognised hostname")
+	}
+	if id == "" {
+		return "", fmt.Errorf("could not extract playlist ID")
+	}
+	return id, nil
+}
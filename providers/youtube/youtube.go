@@ -2,13 +2,17 @@ package youtube
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/kkdai/youtube/v2"
 
 	"github.com/alanbriolat/video-archiver"
+	"github.com/alanbriolat/video-archiver/internal/mux"
 )
 
 type source struct {
@@ -24,60 +28,266 @@ func (s *source) String() string {
 }
 
 func (s *source) Recon(ctx context.Context) (video_archiver.ResolvedSource, error) {
-	client := youtube.Client{}
+	policy, err := FormatPolicyFromOptions(video_archiver.OptionsFromContext(ctx))
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	captionPolicy, err := CaptionPolicyFromOptions(video_archiver.OptionsFromContext(ctx))
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	client := youtube.Client{HTTPClient: video_archiver.HTTPClientFromContext(ctx)}
 	videoDetails, err := client.GetVideoContext(ctx, s.URL())
 	if err != nil {
-		return nil, fmt.Errorf("failed to get video info: %w", err)
+		return nil, fmt.Errorf("failed to get video info: %w", classifyError(err))
+	}
+	formats, err := policy.Choose(videoDetails.Formats)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	resolved := &resolvedSource{
+		source:         *s,
+		videoDetails:   videoDetails,
+		formats:        formats,
+		captionFormats: captionPolicy.Formats,
+	}
+	sidecars, err := video_archiver.OptionsFromContext(ctx).Bool(video_archiver.OptionSidecars)
+	if err != nil {
+		return nil, video_archiver.Permanent(err)
+	}
+	if err := resolved.readPage(ctx, client.HTTPClient, sidecars, captionPolicy); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// readPage gets the tags (if wanted for sidecars) and the caption tracks chosen by captionPolicy from the video's page,
+// since the YouTube client doesn't expose them. The page is only fetched if one of them is wanted, and failing to get
+// it only matters for the captions, because the tags are just informational.
+func (s *resolvedSource) readPage(ctx context.Context, client *http.Client, tags bool, captionPolicy CaptionPolicy) error {
+	if !tags && len(captionPolicy.Languages) == 0 {
+		return nil
+	}
+	page, err := getVideoPage(ctx, client, s.URL())
+	if err != nil {
+		if len(captionPolicy.Languages) > 0 {
+			return fmt.Errorf("failed to get video page: %w", err)
+		}
+		return nil
+	}
+	if tags {
+		s.tags = extractKeywords(page)
+	}
+	if len(captionPolicy.Languages) > 0 {
+		tracks, err := extractCaptionTracks(page)
+		if err != nil {
+			return fmt.Errorf("failed to get caption tracks: %w", err)
+		}
+		s.captions = captionPolicy.Select(tracks)
 	}
-	// TODO: select "highest" quality
-	formats := videoDetails.Formats.WithAudioChannels()
-	videoFormat := &formats[0]
-	return &resolvedSource{
-		source:       *s,
-		videoDetails: videoDetails,
-		videoFormat:  videoFormat,
-	}, nil
+	return nil
 }
 
 type resolvedSource struct {
 	source
 	videoDetails *youtube.Video
-	videoFormat  *youtube.Format
+	// Either a single format, or separate video and audio formats to be muxed together
+	formats []*youtube.Format
+	tags    []string
+	// Caption tracks to save in each of the caption formats
+	captions       []captionTrack
+	captionFormats []string
 }
 
 func (s *resolvedSource) Download(d video_archiver.Download) error {
-	client := youtube.Client{}
-	stream, size, err := client.GetStreamContext(d.Context(), s.videoDetails, s.videoFormat)
+	client := youtube.Client{HTTPClient: video_archiver.HTTPClientFromContext(d.Context())}
+	if err := s.downloadVideo(d, client); err != nil {
+		return err
+	}
+	return s.downloadCaptions(d)
+}
+
+func (s *resolvedSource) downloadVideo(d video_archiver.Download, client youtube.Client) error {
+	if len(s.formats) > 1 {
+		return s.downloadAdaptive(d, client)
+	}
+	stream, size, err := client.GetStreamContext(d.Context(), s.videoDetails, s.formats[0])
+	if err != nil {
+		return fmt.Errorf("failed to get stream: %w", classifyError(err))
+	}
+	defer stream.Close()
+	d.AddExpectedBytes(int(size))
+	return classifyError(d.SaveStream(s.getFilename(), stream))
+}
+
+// downloadAdaptive downloads the separate streams in parallel to temporary files, and then muxes them together.
+func (s *resolvedSource) downloadAdaptive(d video_archiver.Download, client youtube.Client) error {
+	ctx, cancel := context.WithCancel(d.Context())
+	defer cancel()
+	paths := make([]string, len(s.formats))
+	errs := make([]error, len(s.formats))
+	var wg sync.WaitGroup
+	for i, format := range s.formats {
+		wg.Add(1)
+		go func(i int, format *youtube.Format) {
+			defer wg.Done()
+			if paths[i], errs[i] = s.downloadStream(ctx, d, client, format); errs[i] != nil {
+				// No point continuing with the other streams
+				cancel()
+			}
+		}(i, format)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return err
+	}
+
+	f, err := d.CreateFile(s.getFilename())
+	if err != nil {
+		return fmt.Errorf("failed to open target file: %w", err)
+	}
+	defer f.Close()
+	if err := mux.MuxFiles(f, formatContainer(s.formats[0]), paths...); err != nil {
+		return video_archiver.Permanent(fmt.Errorf("failed to mux streams: %w", err))
+	}
+	return f.Close()
+}
+
+func (s *resolvedSource) downloadStream(ctx context.Context, d video_archiver.Download, client youtube.Client, format *youtube.Format) (string, error) {
+	stream, size, err := client.GetStreamContext(ctx, s.videoDetails, format)
 	if err != nil {
-		return fmt.Errorf("failed to get stream: %w", err)
+		return "", fmt.Errorf("failed to get stream: %w", classifyError(err))
 	}
 	defer stream.Close()
 	d.AddExpectedBytes(int(size))
-	return d.SaveStream(s.getFilename(), stream)
+	path, err := d.TempSaveStream(fmt.Sprintf("%d-*.%s", format.ItagNo, formatContainer(format)), stream)
+	return path, classifyError(err)
+}
+
+// firstError returns the first error that isn't just the result of cancelling the other streams after an error.
+func firstError(errs []error) error {
+	var first error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		} else if first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 func (s *resolvedSource) String() string {
 	return fmt.Sprintf("%s [%s]", s.videoDetails.Title, s.videoDetails.ID)
 }
 
+func (s *resolvedSource) Metadata() map[string]string {
+	metadata := formatMetadata(s.formats...)
+	if len(s.captions) > 0 {
+		metadata["captions"] = captionsMetadata(s.captions)
+	}
+	return metadata
+}
+
+// Info describes the video for sidecar files.
+func (s *resolvedSource) Info() *video_archiver.Info {
+	info := &video_archiver.Info{
+		Filename:    s.getFilename(),
+		Title:       s.videoDetails.Title,
+		ID:          s.videoDetails.ID,
+		Uploader:    s.videoDetails.Author,
+		UploadDate:  s.videoDetails.PublishDate,
+		Duration:    s.videoDetails.Duration,
+		Description: s.videoDetails.Description,
+		Tags:        s.tags,
+		URL:         s.URL(),
+		Format:      s.Metadata(),
+	}
+	var best uint
+	for _, thumbnail := range s.videoDetails.Thumbnails {
+		if size := thumbnail.Width * thumbnail.Height; info.Thumbnail == "" || size > best {
+			info.Thumbnail = thumbnail.URL
+			best = size
+		}
+	}
+	return info
+}
+
 func (s *resolvedSource) getFilename() string {
-	mimeType := strings.SplitN(s.videoFormat.MimeType, ";", 2)[0]
-	ext := strings.SplitN(mimeType, "/", 2)[1]
-	return strings.Join([]string{s.videoDetails.Title, s.videoDetails.ID, ext}, ".")
+	return strings.Join([]string{s.videoDetails.Title, s.videoDetails.ID, s.getExtension()}, ".")
+}
+
+func (s *resolvedSource) getExtension() string {
+	ext := formatContainer(s.formats[0])
+	if ext == "mp4" && strings.HasPrefix(s.formats[0].MimeType, "audio/") {
+		ext = "m4a"
+	}
+	return ext
+}
+
+// classifyError marks errors from the YouTube client according to whether it's worth retrying.
+func classifyError(err error) error {
+	var playability *youtube.ErrPlayabiltyStatus
+	var statusCode youtube.ErrUnexpectedStatusCode
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &playability),
+		errors.Is(err, youtube.ErrVideoPrivate),
+		errors.Is(err, youtube.ErrLoginRequired),
+		errors.Is(err, youtube.ErrNotPlayableInEmbed),
+		errors.Is(err, youtube.ErrInvalidCharactersInVideoID),
+		errors.Is(err, youtube.ErrVideoIDMinLength):
+		return video_archiver.Permanent(err)
+	case errors.As(err, &statusCode):
+		if statusCode == http.StatusTooManyRequests || statusCode >= 500 {
+			return video_archiver.Transient(err)
+		} else {
+			return video_archiver.Permanent(err)
+		}
+	default:
+		return err
+	}
 }
 
 func Match(s string) (video_archiver.Source, error) {
-	if parsedURL, err := url.Parse(s); err != nil {
-		return nil, err
-	} else if videoID, err := extractVideoID(parsedURL); err != nil {
+	parsedURL, err := url.Parse(s)
+	if err != nil {
 		return nil, err
-	} else {
+	}
+	videoID, err := extractVideoID(parsedURL)
+	if err == nil {
 		return &source{videoID: *videoID}, nil
 	}
+	if playlistID, playlistErr := extractPlaylistID(parsedURL); playlistErr == nil {
+		return &playlistSource{playlistID: playlistID}, nil
+	}
+	return nil, err
 }
 
 func New() video_archiver.Provider {
-	return video_archiver.Provider{Name: "youtube", Match: Match}
+	return video_archiver.Provider{
+		Name:        "youtube",
+		Match:       Match,
+		Description: "YouTube videos, playlists and channels",
+		Hosts:       []string{"www.youtube.com", "m.youtube.com", "youtu.be"},
+		Patterns: []string{
+			"https://www.youtube.com/watch?v={id}",
+			"https://www.youtube.com/v/{id}",
+			"https://youtu.be/{id}",
+			"https://www.youtube.com/playlist?list={id}",
+			"https://www.youtube.com/channel/{id}",
+		},
+		Examples: []string{
+			"https://www.youtube.com/watch?v=jNQXAC9IVRw",
+			"https://m.youtube.com/v/jNQXAC9IVRw",
+			"https://youtu.be/jNQXAC9IVRw",
+			"https://www.youtube.com/playlist?list=PL590L5WQmH8fJ54F369BLDSqIwcs-TCfs",
+			"https://www.youtube.com/channel/UC4QobU6STFB0P71PMvOGN5A",
+		},
+		Capabilities: video_archiver.CapabilityVideo | video_archiver.CapabilityAudio |
+			video_archiver.CapabilitySubtitles | video_archiver.CapabilityPlaylists | video_archiver.CapabilityMetadata,
+	}
 }
 
 // Extract video ID from YouTube URL.
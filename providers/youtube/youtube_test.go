@@ -0,0 +1,88 @@
+package youtube
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+)
+
+// A pageTransport serves page for every request, or fails if page is empty, counting the requests.
+type pageTransport struct {
+	page     string
+	requests int
+}
+
+func (t *pageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	if t.page == "" {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: http.NoBody, Request: req}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(t.page)), Request: req}, nil
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		input string
+		url   string
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PLFgquLnL59alCl_2TQvOiD5Vgm1hCaGSI", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://www.youtube.com/playlist?list=PLFgquLnL59alCl_2TQvOiD5Vgm1hCaGSI", "https://www.youtube.com/playlist?list=PLFgquLnL59alCl_2TQvOiD5Vgm1hCaGSI"},
+		{"https://m.youtube.com/channel/UCuAXFkgsw1L7xaCfnd5JJOw/videos", "https://www.youtube.com/playlist?list=UUuAXFkgsw1L7xaCfnd5JJOw"},
+		{"https://www.youtube.com/playlist", ""},
+		{"https://www.youtube.com/channel/xyz", ""},
+		{"https://example.com/watch?v=dQw4w9WgXcQ", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			assert := assert_.New(t)
+			source, err := Match(c.input)
+			if c.url == "" {
+				assert.Error(err)
+			} else if assert.NoError(err) {
+				assert.Equal(c.url, source.URL())
+			}
+		})
+	}
+}
+
+func TestExtractKeywords(t *testing.T) {
+	assert := assert_.New(t)
+	page := []byte(`<script>var ytInitialPlayerResponse = {"videoDetails":{"videoId":"x","title":"Video",` +
+		`"keywords":["music","live"],"shortDescription":"..."},"microformat":{}};</script>`)
+	assert.Equal([]string{"music", "live"}, extractKeywords(page))
+	assert.Nil(extractKeywords([]byte(`<script>var ytInitialPlayerResponse = {"videoDetails":{"videoId":"x"}};</script>`)))
+	assert.Nil(extractKeywords([]byte(`<html>no details</html>`)))
+}
+
+func TestReadPage(t *testing.T) {
+	assert := assert_.New(t)
+	ctx := context.Background()
+	page := `<script>var ytInitialPlayerResponse = {"captions":{"playerCaptionsTracklistRenderer":{"captionTracks":[` +
+		`{"baseUrl":"https://example.com/en","languageCode":"en"}]}},"videoDetails":{"keywords":["music"]}};</script>`
+	captions := CaptionPolicy{Languages: []string{"en"}}
+
+	// Nothing wanted from the page, so it isn't fetched
+	transport := &pageTransport{page: page}
+	s := &resolvedSource{source: source{videoID: "x"}}
+	assert.NoError(s.readPage(ctx, &http.Client{Transport: transport}, false, CaptionPolicy{}))
+	assert.Equal(0, transport.requests)
+
+	s = &resolvedSource{source: source{videoID: "x"}}
+	assert.NoError(s.readPage(ctx, &http.Client{Transport: transport}, true, captions))
+	assert.Equal(1, transport.requests)
+	assert.Equal([]string{"music"}, s.tags)
+	assert.Equal([]captionTrack{{BaseURL: "https://example.com/en", LanguageCode: "en"}}, s.captions)
+
+	// Without the page there are no tags, which is only an error if captions were wanted too
+	transport = &pageTransport{}
+	s = &resolvedSource{source: source{videoID: "x"}}
+	assert.NoError(s.readPage(ctx, &http.Client{Transport: transport}, true, CaptionPolicy{}))
+	assert.Nil(s.tags)
+	assert.Error(s.readPage(ctx, &http.Client{Transport: transport}, true, captions))
+}
@@ -0,0 +1,141 @@
+// Package ratelimit provides a token bucket rate limiter for byte streams, whose rate can be changed while in use.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alanbriolat/video-archiver/util"
+)
+
+// A Limiter is a token bucket that refills at a rate of bytes per second, holding at most one second's worth of bytes.
+// A rate <= 0 means unlimited.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+func New(rate int64) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Rate returns the current rate in bytes per second.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate, including for anything currently waiting on the Limiter.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	// Wake up anything that's waiting, so that it can recalculate how long to wait for
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// WaitN takes n bytes from the Limiter, blocking until the bucket isn't empty or ctx is done. The bucket may go into
+// "debt", which delays subsequent callers, so that n can be larger than the bucket size.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		l.refill(now)
+		if l.tokens > 0 {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// refill adds tokens according to the time elapsed since the last refill. Must be called with the lock held.
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// maxChunk limits how much is read at once by a Reader, to keep the rate smooth.
+const maxChunk = 32 * 1024
+
+// A Reader is an io.Reader that waits on each of its Limiters after every read.
+type Reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader wraps r so that reads are limited by all of limiters, waiting only as long as ctx allows.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) *Reader {
+	return &Reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(r.limiters) > 0 && len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// ParseRate parses a rate in bytes per second, written as for util.ParseSize with an optional "/s" suffix, e.g. "500K"
+// or "1.5MB/s". An empty string or "0" means unlimited.
+func ParseRate(s string) (int64, error) {
+	size := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	if size == "" && strings.TrimSpace(s) != "" {
+		return 0, fmt.Errorf("invalid rate: %q", s)
+	}
+	rate, err := util.ParseSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %q", s)
+	}
+	return rate, nil
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestParseRate(t *testing.T) {
+	assert := assert_.New(t)
+	cases := []struct {
+		in  string
+		out int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1000", 1000},
+		{"500K", 500 * 1024},
+		{"500k", 500 * 1024},
+		{"1.5M", 1024 * 1024 * 3 / 2},
+		{"2MB", 2 * 1024 * 1024},
+		{"1G", 1024 * 1024 * 1024},
+		{"100KB/s", 100 * 1024},
+	}
+	for _, c := range cases {
+		assert.Equal(c.out, generic.Unwrap(ParseRate(c.in)), "input: %q", c.in)
+	}
+	for _, s := range []string{"b", "K", "fast", "-1", "1X"} {
+		_, err := ParseRate(s)
+		assert.Error(err, "input: %q", s)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert_.New(t)
+	ctx := context.Background()
+
+	// Unlimited doesn't wait
+	l := New(0)
+	start := time.Now()
+	generic.Unwrap(io.Copy(io.Discard, NewReader(ctx, bytes.NewReader(make([]byte, 1<<20)), l)))
+	assert.Less(time.Since(start), 100*time.Millisecond)
+
+	// 1 second worth of data is available straight away, and then the rate applies
+	l = New(100 * 1024)
+	start = time.Now()
+	generic.Unwrap(io.Copy(io.Discard, NewReader(ctx, bytes.NewReader(make([]byte, 150*1024)), l)))
+	elapsed := time.Since(start)
+	assert.Greater(elapsed, 300*time.Millisecond)
+	assert.Less(elapsed, 1000*time.Millisecond)
+
+	// Changing the rate takes effect for something already waiting
+	l = New(1)
+	assert.NoError(l.WaitN(ctx, 1000))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(l.WaitN(ctx, 1))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("waiter not woken by rate change")
+	}
+
+	// Waiting respects the context
+	l = New(1)
+	assert.NoError(l.WaitN(ctx, 1000))
+	cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(l.WaitN(cancelCtx, 1), context.DeadlineExceeded)
+}
@@ -0,0 +1,121 @@
+package video_archiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrTooManyHops = errors.New("too many redirects")
+
+// DefaultMaxHops is how many redirects and canonical links ResolveURL should follow, if there's no reason to choose
+// differently.
+const DefaultMaxHops = 10
+
+// Only this much of a page is searched for a canonical link, which should be in the <head>.
+const canonicalSearchLimit = 512 * 1024
+
+var (
+	linkTagPattern   = regexp.MustCompile(`(?is)<link\b([^>]*)>`)
+	attributePattern = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+)))?`)
+)
+
+// ResolveURL finds where a URL really points, e.g. for a link shortener, by following HTTP redirects and the
+// <link rel="canonical"> of HTML pages, up to maxHops of them in total. Non-HTTP(S) URLs are returned unchanged. The
+// status of the final response doesn't matter, only where it is.
+func ResolveURL(ctx context.Context, s string, maxHops int) (string, error) {
+	current, err := url.Parse(s)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	if current.Scheme != "http" && current.Scheme != "https" {
+		return s, nil
+	}
+	hops := 0
+	client := *HTTPClientFromContext(ctx)
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if hops++; hops > maxHops {
+			return ErrTooManyHops
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		return nil
+	}
+	for {
+		final, canonical, err := resolveOnce(ctx, &client, current)
+		if errors.Is(err, ErrTooManyHops) {
+			return "", Permanent(fmt.Errorf("failed to resolve %v: %w", s, ErrTooManyHops))
+		} else if err != nil {
+			return "", fmt.Errorf("failed to resolve %v: %w", s, err)
+		}
+		if canonical == nil || withoutFragment(canonical) == withoutFragment(final) {
+			keepFragment(final, current)
+			return final.String(), nil
+		}
+		if hops++; hops > maxHops {
+			return "", Permanent(fmt.Errorf("failed to resolve %v: %w", s, ErrTooManyHops))
+		}
+		keepFragment(canonical, current)
+		current = canonical
+	}
+}
+
+// keepFragment copies the fragment to where a URL led, unless it has its own, as for an HTTP redirect.
+func keepFragment(to *url.URL, from *url.URL) {
+	if to.Fragment == "" {
+		to.Fragment, to.RawFragment = from.Fragment, from.RawFragment
+	}
+}
+
+func withoutFragment(u *url.URL) string {
+	without := *u
+	without.Fragment, without.RawFragment = "", ""
+	return without.String()
+}
+
+// resolveOnce requests a URL, giving the URL of the final response after any redirects, and its canonical URL if it's
+// an HTML page that has one.
+func resolveOnce(ctx context.Context, client *http.Client, u *url.URL) (*url.URL, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, Permanent(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Closing the body without reading it all means the rest (e.g. a video) isn't downloaded
+	defer resp.Body.Close()
+	final := *resp.Request.URL
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "text/html" {
+		return &final, nil, nil
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, canonicalSearchLimit))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range linkTagPattern.FindAllSubmatch(page, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range attributePattern.FindAllSubmatch(tag[1], -1) {
+			attrs[strings.ToLower(string(attr[1]))] = string(attr[2]) + string(attr[3]) + string(attr[4])
+		}
+		if !strings.EqualFold(strings.TrimSpace(attrs["rel"]), "canonical") || strings.TrimSpace(attrs["href"]) == "" {
+			continue
+		}
+		href := html.UnescapeString(strings.TrimSpace(attrs["href"]))
+		if canonical, err := final.Parse(href); err == nil && (canonical.Scheme == "http" || canonical.Scheme == "https") {
+			return &final, canonical, nil
+		}
+	}
+	return &final, nil, nil
+}
@@ -0,0 +1,62 @@
+package video_archiver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	assert_ "github.com/stretchr/testify/assert"
+)
+
+func TestResolveURL(t *testing.T) {
+	assert := assert_.New(t)
+	mux := http.NewServeMux()
+	mux.Handle("/short", http.RedirectHandler("/redirected", http.StatusMovedPermanently))
+	mux.Handle("/redirected", http.RedirectHandler("/page?id=1", http.StatusFound))
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"><LINK REL=canonical HREF="/canonical?id=1&amp;x=2"></head></html>`))
+	})
+	mux.HandleFunc("/canonical", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<link href="/canonical?id=1&x=2" rel="canonical">`))
+	})
+	mux.HandleFunc("/video.mp4", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		_, _ = w.Write([]byte(`<link rel="canonical" href="/elsewhere">`))
+	})
+	mux.Handle("/loop", http.RedirectHandler("/loop", http.StatusFound))
+	mux.HandleFunc("/canonical-loop", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<link rel="canonical" href="/canonical-loop?` + r.URL.RawQuery + `x">`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+
+	resolved, err := ResolveURL(ctx, server.URL+"/short#t=10", DefaultMaxHops)
+	if assert.NoError(err) {
+		assert.Equal(server.URL+"/canonical?id=1&x=2#t=10", resolved)
+	}
+	_, err = ResolveURL(ctx, server.URL+"/short", 2)
+	assert.ErrorIs(err, ErrTooManyHops)
+	// Only HTML pages have canonical links
+	assert.Equal(server.URL+"/video.mp4", mustResolve(t, ctx, server.URL+"/video.mp4"))
+	// Not found is still where the URL points
+	assert.Equal(server.URL+"/missing", mustResolve(t, ctx, server.URL+"/missing"))
+	assert.Equal("ftp://example.com/video.mp4", mustResolve(t, ctx, "ftp://example.com/video.mp4"))
+
+	for _, path := range []string{"/loop", "/canonical-loop"} {
+		_, err = ResolveURL(ctx, server.URL+path, DefaultMaxHops)
+		if assert.ErrorIs(err, ErrTooManyHops, path) {
+			assert.False(IsTransient(err))
+		}
+	}
+}
+
+func mustResolve(t *testing.T, ctx context.Context, s string) string {
+	resolved, err := ResolveURL(ctx, s, DefaultMaxHops)
+	assert_.NoError(t, err)
+	return resolved
+}
@@ -0,0 +1,62 @@
+package video_archiver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ResumeInfo records how much of a file has been saved, along with the validators needed to safely continue the
+// download with a Range request.
+type ResumeInfo struct {
+	Filename     string
+	Offset       int64
+	ETag         string
+	LastModified string
+}
+
+// ifRange returns the validator to use in an If-Range header, or "" if the download can't be safely resumed.
+func (i *ResumeInfo) ifRange() string {
+	// Weak entity tags are not allowed in If-Range
+	if i.ETag != "" && !strings.HasPrefix(i.ETag, "W/") {
+		return i.ETag
+	}
+	return i.LastModified
+}
+
+// parseContentRange extracts the first byte position and the complete length from a Content-Range header, e.g.
+// "bytes 100-199/200" or "bytes */200". Either value is -1 if not known.
+func parseContentRange(s string) (start int64, size int64, err error) {
+	start, size = -1, -1
+	if !strings.HasPrefix(s, "bytes ") {
+		return start, size, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+	spec := strings.TrimPrefix(s, "bytes ")
+	byteRange, sizeString, ok := strings.Cut(spec, "/")
+	if !ok {
+		return start, size, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+	if sizeString != "*" {
+		if size, err = strconv.ParseInt(sizeString, 10, 64); err != nil {
+			return -1, -1, fmt.Errorf("invalid Content-Range: %q", s)
+		}
+	}
+	if byteRange != "*" {
+		startString, _, _ := strings.Cut(byteRange, "-")
+		if start, err = strconv.ParseInt(startString, 10, 64); err != nil {
+			return -1, -1, fmt.Errorf("invalid Content-Range: %q", s)
+		}
+	}
+	return start, size, nil
+}
+
+// truncateFile empties the file and moves back to the start of it.
+func truncateFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,141 @@
+package video_archiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Options about what to save alongside a video, understood by any provider they apply to.
+const (
+	// Set to "true" in the options of a download whose sidecar files will be written (see WriteSidecars), so that
+	// providers can skip gathering details that only go in the sidecar files.
+	OptionSidecars = "sidecars"
+	// Caption languages to download, e.g. "en,fr", or "all", unless overridden by a provider's own option (e.g.
+	// "youtube.captions").
+	OptionCaptions = "captions"
+)
+
+// Info describes a downloaded video, for archiving alongside it in sidecar files (see WriteSidecars).
+type Info struct {
+	// The name of the downloaded media file, which sidecar files are named after.
+	Filename    string
+	Title       string
+	ID          string
+	Uploader    string
+	UploadDate  time.Time
+	Duration    time.Duration
+	Description string
+	Tags        []string
+	URL         string
+	// The chosen format, as for MetadataSource.
+	Format map[string]string
+	// URL of the best available thumbnail, if any.
+	Thumbnail string
+	// When the video was downloaded; set by WriteSidecars if not already set.
+	ArchivedAt time.Time
+}
+
+func (i Info) MarshalJSON() ([]byte, error) {
+	type infoJSON struct {
+		Filename    string            `json:"filename"`
+		Title       string            `json:"title"`
+		ID          string            `json:"id"`
+		Uploader    string            `json:"uploader,omitempty"`
+		UploadDate  string            `json:"upload_date,omitempty"`
+		Duration    float64           `json:"duration,omitempty"`
+		Description string            `json:"description,omitempty"`
+		Tags        []string          `json:"tags,omitempty"`
+		URL         string            `json:"url"`
+		Format      map[string]string `json:"format,omitempty"`
+		Thumbnail   string            `json:"thumbnail,omitempty"`
+		ArchivedAt  time.Time         `json:"archived_at"`
+	}
+	j := infoJSON{
+		Filename:    i.Filename,
+		Title:       i.Title,
+		ID:          i.ID,
+		Uploader:    i.Uploader,
+		Duration:    i.Duration.Seconds(),
+		Description: i.Description,
+		Tags:        i.Tags,
+		URL:         i.URL,
+		Format:      i.Format,
+		Thumbnail:   i.Thumbnail,
+		ArchivedAt:  i.ArchivedAt,
+	}
+	if !i.UploadDate.IsZero() {
+		j.UploadDate = i.UploadDate.Format("2006-01-02")
+	}
+	return json.Marshal(j)
+}
+
+// An InfoSource is a ResolvedSource that can describe the downloaded video for sidecar files.
+type InfoSource interface {
+	ResolvedSource
+	Info() *Info
+}
+
+// WriteSidecars saves files alongside the downloaded media file: "<name>.info.json" with everything in the Info,
+// "<name>.description" if there is a description, and the thumbnail as e.g. "<name>.jpg" if there is one and it can be
+// downloaded.
+func WriteSidecars(d Download, info *Info) error {
+	if info.ArchivedAt.IsZero() {
+		info.ArchivedAt = time.Now().UTC()
+	}
+	base := strings.TrimSuffix(info.Filename, filepath.Ext(info.Filename))
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(d, base+".info.json", data); err != nil {
+		return err
+	}
+
+	if info.Description != "" {
+		if err := writeFile(d, base+".description", []byte(info.Description)); err != nil {
+			return err
+		}
+	}
+
+	if info.Thumbnail != "" {
+		// Only nice to have, so it mustn't fail the download of the media it goes with. It's fetched before creating
+		// the file so that there isn't a partial thumbnail left behind if it fails.
+		var thumbnail bytes.Buffer
+		if err := d.AppendURL(&thumbnail, info.Thumbnail); err != nil {
+			zap.S().Warnf("failed to download thumbnail %v: %v", info.Thumbnail, err)
+		} else if err := writeFile(d, base+thumbnailExt(info.Thumbnail), thumbnail.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(d Download, filename string, data []byte) error {
+	f, err := d.CreateFile(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// thumbnailExt gets the file extension from the thumbnail URL, assuming JPEG if there isn't one.
+func thumbnailExt(thumbnailURL string) string {
+	if u, err := url.Parse(thumbnailURL); err == nil {
+		if ext := path.Ext(u.Path); ext != "" {
+			return strings.ToLower(ext)
+		}
+	}
+	return ".jpg"
+}
@@ -0,0 +1,70 @@
+package video_archiver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestWriteSidecars(t *testing.T) {
+	assert := assert_.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("thumbnail"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	d := generic.Unwrap(NewDownloadBuilder().WithTargetPrefix(dir + string(os.PathSeparator)).Build())
+	defer d.Close()
+	info := &Info{
+		Filename:    "Title.abc123.mp4",
+		Title:       "Title",
+		ID:          "abc123",
+		Uploader:    "Someone",
+		UploadDate:  time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC),
+		Duration:    90 * time.Second,
+		Description: "A video\nabout things",
+		URL:         "https://example.com/abc123",
+		Format:      map[string]string{"format.itag": "22"},
+		Thumbnail:   server.URL + "/vi/abc123/maxresdefault.webp?x=1",
+	}
+	if !assert.NoError(WriteSidecars(d, info)) || !assert.NoError(d.Commit()) {
+		return
+	}
+
+	var saved map[string]interface{}
+	generic.Unwrap_(json.Unmarshal(generic.Unwrap(os.ReadFile(filepath.Join(dir, "Title.abc123.info.json"))), &saved))
+	assert.Equal("abc123", saved["id"])
+	assert.Equal("Someone", saved["uploader"])
+	assert.Equal("2022-03-04", saved["upload_date"])
+	assert.Equal(90.0, saved["duration"])
+	assert.Equal(map[string]interface{}{"format.itag": "22"}, saved["format"])
+	assert.NotEmpty(saved["archived_at"])
+	assert.NotContains(saved, "tags")
+	assert.Equal("A video\nabout things", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "Title.abc123.description")))))
+	assert.Equal("thumbnail", string(generic.Unwrap(os.ReadFile(filepath.Join(dir, "Title.abc123.webp")))))
+
+	assert.Equal(".jpg", thumbnailExt("https://example.com/thumbnail"))
+
+	// A thumbnail that can't be downloaded is left out, rather than failing the download
+	dir = t.TempDir()
+	d = generic.Unwrap(NewDownloadBuilder().WithTargetPrefix(dir + string(os.PathSeparator)).Build())
+	defer d.Close()
+	info.Thumbnail = server.URL + "/missing.jpg"
+	if assert.NoError(WriteSidecars(d, info)) && assert.NoError(d.Commit()) {
+		assert.FileExists(filepath.Join(dir, "Title.abc123.info.json"))
+		assert.NoFileExists(filepath.Join(dir, "Title.abc123.jpg"))
+	}
+}
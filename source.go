@@ -21,3 +21,18 @@ type ResolvedSource interface {
 	// Download should fetch the actual video, using methods on the Download to save the downloaded data.
 	Download(Download) error
 }
+
+// A MetadataSource is a ResolvedSource that can describe what it will download, e.g. the format that was chosen. The
+// metadata is recorded in the download's state.
+type MetadataSource interface {
+	ResolvedSource
+	Metadata() map[string]string
+}
+
+// A CollectionSource is a ResolvedSource that stands for a collection of other sources, e.g. a playlist or a channel,
+// rather than something to download itself. Each of the Children should be downloaded separately; Download does
+// nothing.
+type CollectionSource interface {
+	ResolvedSource
+	Children() []Source
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpOnlyPrefix marks HttpOnly cookies in the domain field, as written by curl and most browser exporters.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// A NetscapeCookie is a cookie along with the host it was set by.
+type NetscapeCookie struct {
+	http.Cookie
+	Host string
+}
+
+// URL returns a URL that the cookie could have been received from, for use with http.CookieJar.SetCookies.
+func (c *NetscapeCookie) URL() *url.URL {
+	u := &url.URL{Scheme: "http", Host: c.Host, Path: c.Path}
+	if c.Secure {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// ParseNetscapeCookies reads cookies in the Netscape cookies.txt format, as used by curl, wget and browser cookie
+// exporters. Each line has 7 tab-separated fields: domain, include subdomains, path, secure, expiry (Unix time, 0 for
+// a session cookie), name and value.
+//
+// Cookies that apply to subdomains have Domain set (without the leading dot), other cookies are host-only and have
+// Domain set to "".
+func ParseNetscapeCookies(r io.Reader) ([]NetscapeCookie, error) {
+	var cookies []NetscapeCookie
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			httpOnly = true
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+		} else if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// Some exporters leave out the value field entirely when it's empty
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab-separated fields, got %d", lineNumber, len(fields))
+		}
+		domain := strings.ToLower(fields[0])
+		includeSubdomains := strings.EqualFold(fields[1], "TRUE")
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", lineNumber, fields[4])
+		}
+		cookie := NetscapeCookie{
+			Cookie: http.Cookie{
+				Name:     fields[5],
+				Value:    fields[6],
+				Path:     fields[2],
+				Secure:   strings.EqualFold(fields[3], "TRUE"),
+				HttpOnly: httpOnly,
+			},
+			Host: strings.TrimPrefix(domain, "."),
+		}
+		if includeSubdomains || strings.HasPrefix(domain, ".") {
+			cookie.Domain = strings.TrimPrefix(domain, ".")
+		}
+		if cookie.Path == "" {
+			cookie.Path = "/"
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, cookie)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestParseNetscapeCookies(t *testing.T) {
+	assert := assert_.New(t)
+	input := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"# This is a generated file!  Do not edit.",
+		"",
+		".youtube.com\tTRUE\t/\tTRUE\t1700000000\tSID\tabc123",
+		"#HttpOnly_www.example.com\tFALSE\t/videos\tFALSE\t0\tsession\txyz\r",
+		"example.org\tFALSE\t/\tFALSE\t0\tempty",
+	}, "\n")
+	cookies := generic.Unwrap(ParseNetscapeCookies(strings.NewReader(input)))
+	if !assert.Len(cookies, 3) {
+		return
+	}
+
+	assert.Equal("SID", cookies[0].Name)
+	assert.Equal("abc123", cookies[0].Value)
+	assert.Equal("youtube.com", cookies[0].Domain)
+	assert.True(cookies[0].Secure)
+	assert.Equal(time.Unix(1700000000, 0), cookies[0].Expires)
+	assert.Equal("https://youtube.com/", cookies[0].URL().String())
+
+	assert.Equal("session", cookies[1].Name)
+	assert.Equal("xyz", cookies[1].Value)
+	assert.Equal("", cookies[1].Domain)
+	assert.True(cookies[1].HttpOnly)
+	assert.True(cookies[1].Expires.IsZero())
+	assert.Equal("http://www.example.com/videos", cookies[1].URL().String())
+
+	assert.Equal("empty", cookies[2].Name)
+	assert.Equal("", cookies[2].Value)
+
+	_, err := ParseNetscapeCookies(strings.NewReader("example.com\tFALSE\t/\n"))
+	assert.Error(err)
+	_, err = ParseNetscapeCookies(strings.NewReader("example.com\tFALSE\t/\tFALSE\tnever\tname\tvalue\n"))
+	assert.Error(err)
+}
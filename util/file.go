@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MoveFile moves the file at src to dst, replacing dst if it exists. If a simple rename isn't possible, e.g. because
+// src and dst are on different filesystems, the file is copied to a temporary file next to dst which is then renamed
+// into place, so that dst never contains a partial file.
+func MoveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	tempPath := out.Name()
+	// Clean up the temporary file if anything goes wrong
+	defer os.Remove(tempPath)
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if info, err := in.Stat(); err == nil {
+		_ = os.Chmod(tempPath, info.Mode().Perm())
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrPathEscapes = errors.New("path escapes target directory")
+)
+
+// MaxFilenameLength is the maximum length in bytes of a sanitised filename. Most filesystems allow 255 bytes, but we
+// leave room for the suffixes added to temporary files.
+const MaxFilenameLength = 240
+
+// Extensions longer than this are treated as part of the name when truncating.
+const maxExtensionLength = 16
+
+// Characters that are not allowed in filenames on at least one common platform.
+const illegalFilenameChars = `/\:*?"<>|`
+
+// Reserved device names on Windows, which can't be used as a filename even with an extension.
+var reservedFilenames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns an arbitrary string (e.g. a video title) into a single path component that is valid on all
+// common platforms: Unicode is normalised to NFC, illegal and control characters are replaced with "_", reserved names
+// are avoided, and the result is truncated to MaxFilenameLength bytes while keeping the extension.
+func SanitizeFilename(name string) string {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(illegalFilenameChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows doesn't allow trailing dots or spaces, and leading/trailing whitespace is never intentional
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if strings.ReplaceAll(name, ".", "") == "" {
+		// Empty, or just ".", "..", etc.
+		return "_"
+	}
+	stem := name
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		stem = name[:i]
+	}
+	if reservedFilenames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+	return truncateFilename(name, MaxFilenameLength)
+}
+
+// truncateFilename shortens name to at most max bytes, keeping the extension and not splitting any UTF-8 sequences.
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtensionLength {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return strings.TrimRight(stem[:limit], ". ") + ext
+}
+
+// ContainedPath joins dir and name, returning ErrPathEscapes if the result would be outside of dir.
+func ContainedPath(dir string, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	result := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, result); err != nil {
+		return "", err
+	} else if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", ErrPathEscapes
+	}
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	assert_ "github.com/stretchr/testify/assert"
+
+	"github.com/alanbriolat/video-archiver/generic"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	assert := assert_.New(t)
+
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"video.mp4", "video.mp4"},
+		{"AC/DC - Live.mp4", "AC_DC - Live.mp4"},
+		{`a\b:c*d?e"f<g>h|i.webm`, "a_b_c_d_e_f_g_h_i.webm"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"..", "_"},
+		{".", "_"},
+		{"", "_"},
+		{"  spaced out. . ", "spaced out"},
+		{"tab\there\nnewline\x00null\x7f.mp4", "tab_here_newline_null_.mp4"},
+		{"CON", "_CON"},
+		{"con.mp4", "_con.mp4"},
+		{"LPT1.tar.gz", "_LPT1.tar.gz"},
+		{"CONSOLE.mp4", "CONSOLE.mp4"},
+		// Decomposed "é" is normalised to the composed form
+		{"Café.mp4", "Café.mp4"},
+		{"bad\xffutf8.mp4", "bad_utf8.mp4"},
+	}
+	for _, c := range cases {
+		assert.Equal(c.out, SanitizeFilename(c.in), "input: %q", c.in)
+	}
+
+	// Long names are truncated to the byte limit without breaking UTF-8 or losing the extension
+	long := SanitizeFilename(strings.Repeat("日本語", 100) + ".mp4")
+	assert.LessOrEqual(len(long), MaxFilenameLength)
+	assert.True(utf8.ValidString(long))
+	assert.True(strings.HasSuffix(long, "語.mp4") || strings.HasSuffix(long, "本.mp4") || strings.HasSuffix(long, "日.mp4"))
+
+	// A silly extension isn't preserved
+	long = SanitizeFilename("a." + strings.Repeat("x", 300))
+	assert.Equal(MaxFilenameLength, len(long))
+}
+
+func TestContainedPath(t *testing.T) {
+	assert := assert_.New(t)
+	dir := filepath.Join("some", "dir")
+
+	assert.Equal(filepath.Join(dir, "file.mp4"), generic.Unwrap(ContainedPath(dir, "file.mp4")))
+	assert.Equal(filepath.Join(dir, "sub", "file.mp4"), generic.Unwrap(ContainedPath(dir, "sub/file.mp4")))
+	_, err := ContainedPath(dir, "../file.mp4")
+	assert.ErrorIs(err, ErrPathEscapes)
+	_, err = ContainedPath(dir, "sub/../../../file.mp4")
+	assert.ErrorIs(err, ErrPathEscapes)
+	_, err = ContainedPath(dir, "..")
+	assert.ErrorIs(err, ErrPathEscapes)
+}
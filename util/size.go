@@ -0,0 +1,36 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeSuffixes = map[byte]float64{
+	'k': 1 << 10,
+	'm': 1 << 20,
+	'g': 1 << 30,
+}
+
+// ParseSize parses a number of bytes, with an optional K, M or G suffix (binary multiples, like curl and wget) and
+// optional trailing "B", e.g. "500K", "1.5M" or "2GB". An empty string means 0.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	lower := strings.TrimSuffix(strings.ToLower(s), "b")
+	if lower == "" {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	if m, ok := sizeSuffixes[lower[len(lower)-1]]; ok && len(lower) > 1 {
+		multiplier = m
+		lower = lower[:len(lower)-1]
+	}
+	value, err := strconv.ParseFloat(lower, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(value * multiplier), nil
+}